@@ -0,0 +1,221 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// archiveExtensions lists the archive formats the minifier reads and
+// writes, by file name suffix
+var archiveExtensions = []string{".zip", ".tar.gz", ".tgz"}
+
+// archiveExt returns the archive suffix of path, or "" when path does not
+// name a supported archive
+func archiveExt(path string) string {
+	lower := strings.ToLower(path)
+	for _, ext := range archiveExtensions {
+		if strings.HasSuffix(lower, ext) {
+			return path[len(path)-len(ext):]
+		}
+	}
+	return ""
+}
+
+// archiveOutputPath returns where the minified copy of the archive at
+// inputPath is written by default: assets.zip becomes assets.min.zip and
+// assets.tar.gz becomes assets.min.tar.gz
+func archiveOutputPath(inputPath string) string {
+	ext := archiveExt(inputPath)
+	return strings.TrimSuffix(inputPath, ext) + ".min" + ext
+}
+
+// archiveEntries accumulates the statistics of the entries minified in an
+// archive
+type archiveEntries struct {
+	opts     Options
+	original int
+	minified int
+	vars     int
+}
+
+// minifies reports whether the entry called name is minified, rather than
+// copied as it is: JavaScript files, and HTML pages with -html, except
+// those that are minified already
+func (a *archiveEntries) minifies(name string) bool {
+	ext := strings.ToLower(path.Ext(name))
+	if isMinifiedName(name) {
+		return false
+	}
+	return ext == ".js" || a.opts.HTML && isHTMLFile(name)
+}
+
+// minify minifies the content of the entry called name in the archive at
+// archivePath
+func (a *archiveEntries) minify(archivePath, name string, content []byte) ([]byte, error) {
+	minified, vars, err := minifySource(archivePath+":"+name, content, a.opts)
+	if err != nil {
+		return nil, err
+	}
+	a.vars += vars
+	a.original += len(content)
+	a.minified += len(minified)
+	return []byte(minified), nil
+}
+
+// minifyArchive writes a copy of the .zip or .tar.gz archive at inputPath
+// to outputPath in which every JavaScript file is minified. Other entries
+// are copied unchanged. The sizes in the statistics count the minified
+// entries only.
+func minifyArchive(inputPath, outputPath string, opts Options) (stat MinificationStats, err error) {
+	start := time.Now()
+	if outputPath == "" {
+		outputPath = archiveOutputPath(inputPath)
+	}
+	if samePath(inputPath, outputPath) {
+		return stat, fmt.Errorf("refusing to overwrite input archive %s", inputPath)
+	}
+
+	var out bytes.Buffer
+	entries := &archiveEntries{opts: opts}
+	if strings.EqualFold(archiveExt(inputPath), ".zip") {
+		err = minifyZip(inputPath, &out, entries)
+	} else {
+		err = minifyTarGz(inputPath, &out, entries)
+	}
+	if err != nil {
+		debugLog("Error minifying archive: %v", err)
+		return stat, err
+	}
+
+	if opts.StatsOnly {
+		outputPath = ""
+	} else if err = checkOverwrite(outputPath, opts); err != nil {
+		userOutput.Println(err)
+		return stat, err
+	} else if err = ioutil.WriteFile(outputPath, out.Bytes(), 0644); err != nil {
+		debugLog("Error writing output file: %v", err)
+		return stat, err
+	}
+
+	stat = MinificationStats{
+		InputFile:    inputPath,
+		OutputFile:   outputPath,
+		OriginalSize: entries.original,
+		MinifiedSize: entries.minified,
+		ProcessTime:  float64(time.Since(start).Microseconds()) / 1000.0,
+		VarsMangled:  entries.vars,
+	}
+	if entries.original > 0 {
+		stat.Reduction = float64(entries.original-entries.minified) / float64(entries.original) * 100
+	}
+	processMetrics.record(stat)
+	return stat, nil
+}
+
+// minifyZip copies the zip archive at inputPath to out, minifying its
+// entries
+func minifyZip(inputPath string, out io.Writer, entries *archiveEntries) error {
+	r, err := zip.OpenReader(inputPath)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	w := zip.NewWriter(out)
+	for _, f := range r.File {
+		if !entries.minifies(f.Name) {
+			// Entries that are not minified keep their compressed data
+			if err := w.Copy(f); err != nil {
+				return err
+			}
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return err
+		}
+		content, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+		minified, err := entries.minify(inputPath, f.Name, content)
+		if err != nil {
+			return err
+		}
+		header := f.FileHeader
+		ew, err := w.CreateHeader(&header)
+		if err != nil {
+			return err
+		}
+		if _, err := ew.Write(minified); err != nil {
+			return err
+		}
+	}
+	return w.Close()
+}
+
+// minifyTarGz copies the gzipped tar archive at inputPath to out,
+// minifying its entries
+func minifyTarGz(inputPath string, out io.Writer, entries *archiveEntries) error {
+	f, err := os.Open(inputPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	gr, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	defer gr.Close()
+
+	gw := gzip.NewWriter(out)
+	tr := tar.NewReader(gr)
+	tw := tar.NewWriter(gw)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if header.Typeflag != tar.TypeReg || !entries.minifies(header.Name) {
+			if err := tw.WriteHeader(header); err != nil {
+				return err
+			}
+			if _, err := io.Copy(tw, tr); err != nil {
+				return err
+			}
+			continue
+		}
+		content, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return err
+		}
+		minified, err := entries.minify(inputPath, header.Name, content)
+		if err != nil {
+			return err
+		}
+		header.Size = int64(len(minified))
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if _, err := tw.Write(minified); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gw.Close()
+}
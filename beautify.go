@@ -0,0 +1,394 @@
+package main
+
+import "strings"
+
+// beautifyIndent is the indentation of one level of nesting
+const beautifyIndent = "  "
+
+// operators lists the multi-character operators made of punctuator bytes,
+// longest first, which beautify splits runs of punctuators into
+var operators = []string{
+	">>>=", "===", "!==", "**=", "<<=", ">>=", ">>>", "&&=", "||=", "??=",
+	"==", "!=", "<=", ">=", "&&", "||", "??", "++", "--", "**", "<<", ">>",
+	"+=", "-=", "*=", "/=", "%=", "&=", "|=", "^=",
+}
+
+// operandKeywords are the reserved words that end an operand like a name
+var operandKeywords = map[string]bool{
+	"this": true, "super": true, "true": true, "false": true, "null": true,
+	"undefined": true, "arguments": true, "eval": true,
+}
+
+// beautifier re-lays out collapsed code one token at a time
+type beautifier struct {
+	tokens   []token
+	literals []string
+	b        strings.Builder
+	indent   int
+	open     []string // brackets not yet closed, "o" for object and "c" for class braces
+	ternary  []int    // pending `?` per open bracket, the first for the top level
+
+	lineStart    bool  // nothing has been written on the current line
+	space        bool  // a space is due before the next token
+	prev         token // the last significant token written
+	ternaryColon bool  // the last `:` separated ternary branches
+	classHead    int   // 1 + the open brackets at a class keyword until its body opens
+}
+
+// beautify lays out collapsed, protected code predictably: one statement
+// per line, blocks indented by two spaces and single spaces around binary
+// operators and after commas. Only whitespace is added, so the result has
+// the same tokens, and the same meaning, as the input.
+func beautify(code string, literals []string) string {
+	bf := &beautifier{
+		tokens:    tokenize(code),
+		literals:  literals,
+		ternary:   []int{0},
+		lineStart: true,
+	}
+	bf.b.Grow(len(code) * 2)
+	for i := 0; i < len(bf.tokens); i++ {
+		t := bf.tokens[i]
+		switch t.kind {
+		case tokSpace:
+			// The collapsed code keeps line breaks only where they end a
+			// statement or separate tokens
+			if strings.ContainsAny(t.text, "\n\r") && !bf.inParens() {
+				bf.newline()
+			} else {
+				bf.space = true
+			}
+		case tokWord:
+			bf.word(t)
+		case tokLiteral:
+			bf.literal(t)
+		default:
+			i = bf.punct(i)
+		}
+	}
+	return strings.TrimRight(bf.b.String(), " \n") + "\n"
+}
+
+// top returns the innermost open bracket
+func (bf *beautifier) top() string {
+	if len(bf.open) == 0 {
+		return ""
+	}
+	return bf.open[len(bf.open)-1]
+}
+
+// inParens reports whether the innermost open bracket is not a brace
+func (bf *beautifier) inParens() bool {
+	return bf.top() == "(" || bf.top() == "["
+}
+
+// opensObject reports whether a brace written now opens an object literal
+// or destructuring pattern rather than a block or class body
+func (bf *beautifier) opensObject() bool {
+	switch bf.prev.kind {
+	case tokSpace, tokLiteral:
+		return false
+	case tokWord:
+		switch bf.prev.text {
+		case "return", "typeof", "void", "in", "of", "delete", "throw", "yield", "await", "case",
+			"var", "let", "const", "new", "import", "export":
+			return true
+		}
+		return false
+	}
+	switch bf.prev.text {
+	case ")", "]", "}", ";", "{", "=>":
+		return false
+	case ":":
+		return bf.top() == "o" || bf.ternaryColon
+	}
+	return true
+}
+
+// write appends s, indenting it if it starts a line
+func (bf *beautifier) write(s string, t token) {
+	if bf.lineStart {
+		for i := 0; i < bf.indent; i++ {
+			bf.b.WriteString(beautifyIndent)
+		}
+	} else if bf.space {
+		bf.b.WriteByte(' ')
+	}
+	bf.b.WriteString(s)
+	bf.lineStart = false
+	bf.space = false
+	bf.prev = t
+}
+
+// newline ends the current line, unless it is empty
+func (bf *beautifier) newline() {
+	if !bf.lineStart {
+		bf.b.WriteByte('\n')
+	}
+	bf.lineStart = true
+	bf.space = false
+}
+
+// next returns the significant token after position i
+func (bf *beautifier) next(i int) token {
+	for i++; i < len(bf.tokens); i++ {
+		if bf.tokens[i].kind != tokSpace {
+			return bf.tokens[i]
+		}
+	}
+	return token{kind: tokSpace}
+}
+
+// endsOperand reports whether the last token written ends an operand, after
+// which an operator is binary
+func (bf *beautifier) endsOperand() bool {
+	switch bf.prev.kind {
+	case tokWord:
+		return !jsKeywords[bf.prev.text] || operandKeywords[bf.prev.text]
+	case tokLiteral:
+		return true
+	case tokPunct:
+		return bf.prev.text == ")" || bf.prev.text == "]" || bf.prev.text == "}"
+	}
+	return false
+}
+
+func (bf *beautifier) word(t token) {
+	if bf.prev.kind == tokWord || bf.prev.kind == tokLiteral || bf.endsOperand() {
+		bf.space = true
+	}
+	if t.text == "class" && bf.prev.text != "." {
+		bf.classHead = len(bf.open) + 1
+	}
+	bf.write(t.text, t)
+}
+
+func (bf *beautifier) literal(t token) {
+	text, _ := literalText(t.text, bf.literals)
+	switch {
+	case strings.HasPrefix(text, "}"):
+		// The rest of a template literal after a substitution
+		bf.space = false
+	case bf.prev.kind == tokWord || bf.prev.kind == tokLiteral:
+		bf.space = true
+	}
+	startsLine := bf.lineStart
+	bf.write(t.text, t)
+	if strings.HasSuffix(text, "${") {
+		// A substitution starts like a parenthesized expression
+		bf.prev = token{kind: tokPunct, text: "("}
+	}
+	switch {
+	case isLineComment(text):
+		// A line comment carries its own line break
+		bf.lineStart = true
+		bf.space = false
+	case strings.HasPrefix(text, "/*") && startsLine:
+		bf.newline()
+	}
+}
+
+// punct writes the punctuator at position i and returns the position of the
+// last token it consumed
+func (bf *beautifier) punct(i int) int {
+	t := bf.tokens[i]
+	depth := len(bf.ternary) - 1
+	switch t.text {
+	case "{":
+		object := bf.opensObject()
+		class := bf.classHead == len(bf.open)+1
+		if class {
+			bf.classHead = 0
+		}
+		if bf.prev.text != "(" && bf.prev.text != "[" {
+			bf.space = true
+		}
+		bf.write("{", t)
+		if bf.next(i).text == "}" {
+			for i++; bf.tokens[i].text != "}"; i++ {
+			}
+			bf.write("}", bf.tokens[i])
+			bf.afterBrace(i)
+			return i
+		}
+		switch {
+		case object:
+			bf.open = append(bf.open, "o")
+		case class:
+			bf.open = append(bf.open, "c")
+		default:
+			bf.open = append(bf.open, "{")
+		}
+		bf.ternary = append(bf.ternary, 0)
+		bf.indent++
+		bf.newline()
+	case "}":
+		bf.close()
+		bf.indent--
+		bf.newline()
+		bf.write("}", t)
+		bf.afterBrace(i)
+	case "(", "[":
+		if bf.prev.kind == tokWord && jsKeywords[bf.prev.text] && !operandKeywords[bf.prev.text] && bf.prev.text != "function" && bf.prev.text != "import" {
+			bf.space = true
+		} else if bf.endsOperand() {
+			bf.space = false
+		}
+		bf.write(t.text, t)
+		bf.open = append(bf.open, t.text)
+		bf.ternary = append(bf.ternary, 0)
+	case ")", "]":
+		bf.close()
+		bf.space = false
+		bf.write(t.text, t)
+	case ";":
+		bf.space = false
+		bf.write(";", t)
+		if bf.inParens() {
+			bf.space = true
+		} else {
+			bf.newline()
+		}
+	case ",":
+		bf.space = false
+		bf.write(",", t)
+		if bf.top() == "o" {
+			bf.newline()
+		} else {
+			bf.space = true
+		}
+	case ".", "?.":
+		// The space in `5 .toString()` keeps the dot from being read
+		// as a decimal point
+		if bf.endsOperand() && !(t.text == "." && bf.prev.kind == tokWord && isNumber(bf.prev.text)) {
+			bf.space = false
+		}
+		bf.write(t.text, t)
+	case "...", "#", "@":
+		bf.write(t.text, t)
+	case "=>":
+		bf.space = true
+		bf.write("=>", t)
+		bf.space = true
+	case ":":
+		bf.ternaryColon = bf.ternary[depth] > 0
+		if bf.ternaryColon {
+			bf.ternary[depth]--
+			bf.binary(":", t)
+		} else {
+			// Object keys, case clauses and labels
+			bf.space = false
+			bf.write(":", t)
+			bf.space = true
+		}
+	default:
+		return bf.operator(i)
+	}
+	return i
+}
+
+// close pops the innermost open bracket
+func (bf *beautifier) close() {
+	if len(bf.open) > 0 {
+		bf.open = bf.open[:len(bf.open)-1]
+		bf.ternary = bf.ternary[:len(bf.ternary)-1]
+	}
+}
+
+// afterBrace decides what follows the closing brace at position i: the
+// rest of the statement on the same line, or a new line
+func (bf *beautifier) afterBrace(i int) {
+	next := bf.next(i)
+	switch {
+	case bf.inParens():
+	case next.kind == tokWord:
+		switch next.text {
+		case "else", "catch", "finally", "while", "from", "as":
+			bf.space = true
+		default:
+			bf.newline()
+		}
+	case next.kind == tokLiteral, next.text == "{", next.text == "#", next.text == "@":
+		bf.newline()
+	case next.text == "*" && bf.top() == "c":
+		// A generator method
+		bf.newline()
+	}
+}
+
+// operator writes the operator starting with the punctuator at position i,
+// which may span several tokens, and returns the position of its last token
+func (bf *beautifier) operator(i int) int {
+	// Only the start of a run of punctuators can make up the operator, and
+	// reading the rest of a long run for each of its operators would take
+	// quadratic time
+	var run strings.Builder
+	for end := i; end < len(bf.tokens) && end < i+len(operators[0]) && bf.tokens[end].kind == tokPunct && len(bf.tokens[end].text) == 1 &&
+		strings.IndexByte("=+-*/%<>!&|^~?", bf.tokens[end].text[0]) >= 0; end++ {
+		run.WriteString(bf.tokens[end].text)
+	}
+	if run.Len() == 0 {
+		bf.write(bf.tokens[i].text, bf.tokens[i])
+		return i
+	}
+	op := run.String()[:1]
+	for _, candidate := range operators {
+		if strings.HasPrefix(run.String(), candidate) {
+			op = candidate
+			break
+		}
+	}
+	t := token{kind: tokPunct, text: op}
+	last := i + len(op) - 1
+
+	switch {
+	case op == "?":
+		bf.ternary[len(bf.ternary)-1]++
+		bf.binary(op, t)
+	case op == "++" || op == "--":
+		// A line break before the operator makes it prefix
+		postfix := bf.endsOperand() && !bf.lineStart
+		if postfix {
+			bf.space = false
+		} else if bf.prev.kind == tokWord {
+			bf.space = true
+		}
+		bf.write(op, t)
+		if postfix {
+			// An operator after `a++` is binary
+			bf.prev = token{kind: tokPunct, text: ")"}
+		}
+	case op == "*" && bf.prev.kind == tokWord && bf.prev.text == "yield":
+		// Delegation to another generator: `yield* items()`
+		bf.space = false
+		bf.write(op, t)
+		bf.space = true
+	case !bf.endsOperand() || op == "*" && bf.generatorStar():
+		// Unary: `!x`, `-x`, `typeof -x`, and the `*` of a generator
+		// method such as `async *items()`
+		if bf.prev.kind == tokWord {
+			bf.space = true
+		}
+		bf.write(op, t)
+	default:
+		bf.binary(op, t)
+	}
+	return last
+}
+
+// generatorStar reports whether a `*` written now marks a generator method
+// after a modifier or at the start of a line of a class body, where a
+// binary `*` would follow the operand before it
+func (bf *beautifier) generatorStar() bool {
+	if bf.prev.kind == tokWord && (bf.prev.text == "async" || bf.prev.text == "static") {
+		return true
+	}
+	return bf.lineStart && bf.top() == "c"
+}
+
+// binary writes op surrounded by spaces
+func (bf *beautifier) binary(op string, t token) {
+	bf.space = true
+	bf.write(op, t)
+	bf.space = true
+}
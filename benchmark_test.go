@@ -1,8 +1,11 @@
 package main
 
 import (
+	"bytes"
 	"io/ioutil"
 	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 )
 
@@ -53,27 +56,43 @@ func BenchmarkMinification(b *testing.B) {
 				input := string(content)
 				b.ResetTimer()
 
+				var result string
 				for i := 0; i < b.N; i++ {
 					minifier := NewMinifier(input, tc.options.preserveLicense, tc.options.shortenVars)
-					_ = minifier.Minify()
+					result = minifier.Minify()
 				}
+				b.StopTimer()
+				reportQuality(b, input, result)
 			})
 		}
 	}
 }
 
-func BenchmarkLargeFile(b *testing.B) {
-	// Create a large file by repeating the complex test file
+// reportQuality adds the size reduction of output over input, and the
+// bytes it saved per millisecond of minifying, to the benchmark results,
+// so that a faster pass that minifies less well shows up as such
+func reportQuality(b *testing.B, input, output string) {
+	if len(input) == 0 || b.N == 0 {
+		return
+	}
+	saved := float64(len(input) - len(output))
+	b.ReportMetric(saved/float64(len(input))*100, "%reduction")
+	if ms := float64(b.Elapsed().Nanoseconds()) / float64(b.N) / 1e6; ms > 0 {
+		b.ReportMetric(saved/ms, "saved-B/ms")
+	}
+}
+
+// largeInput builds a ~100KB file by repeating the complex test file
+func largeInput(tb testing.TB) string {
 	content, err := ioutil.ReadFile(filepath.Join("test", "testdata", "complex.js"))
 	if err != nil {
-		b.Fatal(err)
+		tb.Fatal(err)
 	}
+	return strings.Repeat(string(content), 100)
+}
 
-	// Repeat the content 100 times to create a ~100KB file
-	largeContent := ""
-	for i := 0; i < 100; i++ {
-		largeContent += string(content)
-	}
+func BenchmarkLargeFile(b *testing.B) {
+	largeContent := largeInput(b)
 
 	b.ResetTimer()
 
@@ -82,3 +101,124 @@ func BenchmarkLargeFile(b *testing.B) {
 		_ = minifier.Minify()
 	}
 }
+
+// TestLargeFileAllocations locks in the allocation budget of the large-file
+// path. A run measures about 1500 allocations; the budget leaves a third
+// on top of that, so that a pass allocating per token again fails here
+// while small changes do not. The race detector adds allocations of its
+// own, so the test is skipped under -race.
+func TestLargeFileAllocations(t *testing.T) {
+	if raceEnabled {
+		t.Skip("allocation counts are not meaningful under the race detector")
+	}
+	largeContent := largeInput(t)
+
+	allocs := testing.AllocsPerRun(5, func() {
+		minifier := NewMinifier(largeContent, true, true)
+		_ = minifier.Minify()
+	})
+
+	const maxAllocs = 2000
+	if allocs > maxAllocs {
+		t.Errorf("Large file minification made %.0f allocations, want at most %d", allocs, maxAllocs)
+	}
+}
+
+// smallInputs returns the test files, each of them a small input
+func smallInputs(b *testing.B) []string {
+	files, err := filepath.Glob(filepath.Join("test", "testdata", "*.js"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	var inputs []string
+	for _, file := range files {
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			b.Fatalf("Failed to read test file %s: %v", file, err)
+		}
+		inputs = append(inputs, string(content))
+	}
+	return inputs
+}
+
+// BenchmarkManySmallFiles compares allocating a minifier per file with
+// reusing pooled minifiers through Reset
+func BenchmarkManySmallFiles(b *testing.B) {
+	inputs := smallInputs(b)
+
+	b.Run("Fresh", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			for _, input := range inputs {
+				minifier := NewMinifier(input, false, true)
+				_ = minifier.Minify()
+			}
+		}
+	})
+
+	b.Run("Pooled", func(b *testing.B) {
+		pool := sync.Pool{
+			New: func() interface{} { return NewMinifier("", false, true) },
+		}
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			for _, input := range inputs {
+				minifier := pool.Get().(*Minifier)
+				minifier.Reset(input)
+				_ = minifier.Minify()
+				pool.Put(minifier)
+			}
+		}
+	})
+}
+
+// BenchmarkIncrementalEdit compares re-minifying a large file after a small
+// edit incrementally with minifying it from scratch
+func BenchmarkIncrementalEdit(b *testing.B) {
+	original := largeInput(b)
+	edited := strings.Replace(original, "const multiplier = 2.5", "const multiplier = 3.5", 1)
+	versions := []string{original, edited}
+	opts := DefaultOptions()
+
+	b.Run("Full", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			_ = NewMinifierWithOptions(versions[i%2], opts).Minify()
+		}
+	})
+
+	b.Run("Incremental", func(b *testing.B) {
+		inc := NewIncrementalMinifier(opts)
+		inc.Minify(original)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			_ = inc.Minify(versions[(i+1)%2])
+		}
+	})
+}
+
+// BenchmarkByteAPI compares MinifyBytes with converting a medium-sized
+// file to a string for Minify and converting the result back to bytes
+func BenchmarkByteAPI(b *testing.B) {
+	content, err := ioutil.ReadFile(filepath.Join("test", "testdata", "complex.js"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	medium := bytes.Repeat(content, 8)
+	opts := DefaultOptions()
+
+	b.Run("String", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_ = []byte(NewMinifierWithOptions(string(medium), opts).Minify())
+		}
+	})
+
+	b.Run("Bytes", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := MinifyBytes(medium, opts); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
+)
+
+// bundleSeparator is placed after every bundled file. The newline ends a
+// trailing line comment and the semicolon ends a trailing statement that
+// relies on automatic semicolon insertion, so that it cannot merge with
+// the first tokens of the next file, as in `a = b` followed by `(f)()`.
+const bundleSeparator = "\n;\n"
+
+// checkBundled runs the checks processFileWith makes of a single file on
+// a file to be bundled. A bundle is minified as a whole, so it cannot hold
+// a JSX file or one marked @no-minify unchanged; those are refused rather
+// than copied.
+func checkBundled(path string, content []byte) error {
+	if err := checkText(path, content); err != nil {
+		return err
+	}
+	code := string(content)
+	if hasNoMinifyPragma(code) {
+		return newFileError(path, code, 0, bundleNoMinifyMessage)
+	}
+	if at := findTypeScript(code); at >= 0 {
+		return newFileError(path, code, at, typeScriptMessage)
+	}
+	if at := findJSX(code); at >= 0 {
+		return newFileError(path, code, at, bundleJSXMessage)
+	}
+	return nil
+}
+
+// bundleFiles concatenates the input files in order and minifies them as a
+// single script written to outputPath. The warnings about the bundle are
+// reported for the files they are about.
+func bundleFiles(inputPaths []string, outputPath string, opts Options) (MinificationStats, error) {
+	start := time.Now()
+
+	var b strings.Builder
+	lines := make([]int, len(inputPaths)) // the line of the bundle each file starts on
+	line := 1
+	for k, path := range inputPaths {
+		content, err := readSourceFile(path, opts.MaxFileSize)
+		if err != nil {
+			debugLog("Error reading input file: %v", err)
+			return MinificationStats{}, err
+		}
+		if err := checkBundled(path, content); err != nil {
+			userOutput.Println(err)
+			return MinificationStats{}, err
+		}
+		// A byte order mark or #! line is only allowed at the start of
+		// the bundle, where Minify handles those of the first file. The
+		// line break after a #! line is kept so that lines still count.
+		code := strings.TrimPrefix(string(content), byteOrderMark)
+		if k > 0 && strings.HasPrefix(code, "#!") {
+			end := strings.IndexByte(code, '\n')
+			if end < 0 {
+				end = len(code)
+			}
+			code = code[end:]
+		}
+		lines[k] = line
+		line += strings.Count(code, "\n") + strings.Count(bundleSeparator, "\n")
+		b.WriteString(code)
+		b.WriteString(bundleSeparator)
+	}
+	bundle := b.String()
+
+	minifier := NewMinifierWithOptions(bundle, opts)
+	minified, warnings := minifier.MinifyWithWarnings()
+	for _, w := range warnings {
+		k := sort.SearchInts(lines, w.Line+1) - 1
+		w.Line -= lines[k] - 1
+		reportWarnings(inputPaths[k], []Warning{w})
+	}
+	if opts.StatsOnly {
+		outputPath = ""
+	} else {
+		if err := checkOverwrite(outputPath, opts); err != nil {
+			userOutput.Println(err)
+			return MinificationStats{}, err
+		}
+		err := ioutil.WriteFile(outputPath, []byte(minified), 0644)
+		if err == nil && opts.NamesMap && opts.ShortenVars {
+			err = writeNamesMap(outputPath, minifier.VarMap())
+		}
+		if err != nil {
+			debugLog("Error writing output file: %v", err)
+			return MinificationStats{}, err
+		}
+	}
+
+	stat := MinificationStats{
+		InputFile:    strings.Join(inputPaths, ","),
+		OutputFile:   outputPath,
+		OriginalSize: len(bundle),
+		MinifiedSize: len(minified),
+		ProcessTime:  float64(time.Since(start).Microseconds()) / 1000.0,
+		VarsMangled:  len(minifier.varMap),
+	}
+	if len(bundle) > 0 {
+		stat.Reduction = float64(len(bundle)-len(minified)) / float64(len(bundle)) * 100
+	}
+	processMetrics.record(stat)
+	return stat, nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import "strings"
+
+// emptyBodyHeads lists the words before the parenthesized head of a
+// statement whose body may be an empty statement, as in `if(x);`
+var emptyBodyHeads = map[string]bool{"if": true, "for": true, "while": true, "with": true}
+
+// removeEmptyStatements drops the semicolons of collapsed code that end an
+// empty statement right after another statement, as in `a();;`; inside a
+// for head, as in `for(;;)`, semicolons separate the clauses and are kept.
+// With blocks set it also drops the empty statements that open the code
+// or a block or follow a block, and empty blocks, which may hold
+// semicolons only: a block standing as a statement of its own is removed,
+// and the empty block body of an if, for, while or with statement, or of
+// else or do, becomes `;`. The braces of functions, methods, even those
+// named like statements, classes, try and switch statements and object
+// literals are left alone. literals holds the text of the placeholders in
+// code.
+func removeEmptyStatements(code string, literals []string, blocks bool) string {
+	var b strings.Builder
+	b.Grow(len(code))
+	brackets := bracketTracker{code: code, literals: literals}
+	var open []byte    // the brackets not yet closed, innermost last
+	var heads []string // for each open parenthesis, the word before it
+	head := ""         // the word before the last closed parenthesis
+	blockEnd := false  // the last brace written closes a block
+
+	for i := 0; i < len(code); i++ {
+		c := code[i]
+		if c == placeholderMark {
+			end := i + 1 + strings.IndexByte(code[i+1:], placeholderMark)
+			b.WriteString(code[i : end+1])
+			i = end
+			continue
+		}
+
+		switch c {
+		case ';':
+			if len(open) > 0 && open[len(open)-1] == '(' {
+				break
+			}
+			out := b.String()
+			prev := significantBefore(out, len(out), literals)
+			if prev < 0 && blocks || prev >= 0 && (out[prev] == ';' || blocks && (out[prev] == '{' || out[prev] == '}' && blockEnd)) {
+				continue
+			}
+		case '{':
+			next := i + 1
+			for next < len(code) && code[next] == ';' {
+				next++
+			}
+			if !blocks || next == len(code) || code[next] != '}' {
+				break
+			}
+			if kind := brackets.openBrace(i); kind.expression || kind.class {
+				break
+			}
+			out := b.String()
+			prev := significantBefore(out, len(out), literals)
+			if prev < 0 || out[prev] == ';' || out[prev] == '{' || out[prev] == '}' && blockEnd {
+				// A block statement of its own
+				i = next
+				continue
+			}
+			if word, _ := brackets.wordBefore(i); out[prev] == ')' && emptyBodyHeads[head] || word == "else" || word == "do" {
+				b.WriteByte(';')
+				i = next
+				continue
+			}
+			// The body of a function, a try statement and the like cannot
+			// be a bare semicolon
+		}
+
+		brackets.track(i)
+		switch c {
+		case '(':
+			word, _ := brackets.wordBefore(i)
+			if brackets.inClass() || brackets.inObject() {
+				// The head of a method, which may be named like a
+				// statement, as in `{ if() {} }`
+				word = ""
+			}
+			heads = append(heads, word)
+			open = append(open, c)
+		case '[', '{':
+			open = append(open, c)
+		case ')', ']', '}':
+			if len(open) > 0 {
+				open = open[:len(open)-1]
+			}
+			if c == ')' && len(heads) > 0 {
+				head = heads[len(heads)-1]
+				heads = heads[:len(heads)-1]
+			}
+			if c == '}' {
+				blockEnd = !brackets.closedExpression
+			}
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
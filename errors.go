@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// MinifyError describes a problem found in a piece of JavaScript, with the
+// position at which it was detected so that it can be shown to the user
+type MinifyError struct {
+	File string // path of the file, empty when not known
+	Line int    // 1-based line number
+	Col  int    // 1-based column, counted in bytes
+	Msg  string
+}
+
+// newMinifyError creates an error for offset in code
+func newMinifyError(code string, offset int, msg string) *MinifyError {
+	line := strings.Count(code[:offset], "\n") + 1
+	col := offset - strings.LastIndexByte(code[:offset], '\n')
+	return &MinifyError{Line: line, Col: col, Msg: msg}
+}
+
+// newFileError creates an error for offset in code, the content of the
+// file at path
+func newFileError(path, code string, offset int, msg string) *MinifyError {
+	err := newMinifyError(code, offset, msg)
+	err.File = path
+	return err
+}
+
+// Error formats the error as file:line:col: message
+func (e *MinifyError) Error() string {
+	if e.File == "" {
+		return fmt.Sprintf("%d:%d: %s", e.Line, e.Col, e.Msg)
+	}
+	return fmt.Sprintf("%s:%d:%d: %s", e.File, e.Line, e.Col, e.Msg)
+}
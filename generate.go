@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"go/format"
+	gotoken "go/token"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// generatedHeader starts every Go file written by generate, in the form the
+// go tool recognizes as generated code
+const generatedHeader = "// Code generated by js-minifier generate; DO NOT EDIT.\n"
+
+// generateConstName returns the exported Go constant name for the source
+// file at path: the words of its base name, capitalized and joined, so that
+// app-main.js becomes AppMainJs. A name that would not start with a letter
+// is prefixed with File.
+func generateConstName(path string) string {
+	var b strings.Builder
+	upper := true
+	for _, r := range filepath.Base(path) {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			upper = true
+			continue
+		}
+		if upper {
+			r = unicode.ToUpper(r)
+			upper = false
+		}
+		b.WriteRune(r)
+	}
+	name := b.String()
+	if name == "" || !unicode.IsLetter([]rune(name)[0]) {
+		name = "File" + name
+	}
+	return name
+}
+
+// generateGoFile minifies the JavaScript file at inputPath, or the files of
+// the directory at inputPath, and writes a Go source file of package pkg to
+// outputPath that declares the minified code of each file as a string
+// constant. The sizes in the statistics count all the files together.
+func generateGoFile(inputPath, outputPath, pkg string, opts Options) (stat MinificationStats, err error) {
+	start := time.Now()
+	if !gotoken.IsIdentifier(pkg) {
+		return stat, fmt.Errorf("invalid package name %q", pkg)
+	}
+	files := []string{inputPath}
+	if info, err := os.Stat(inputPath); err != nil {
+		return stat, err
+	} else if info.IsDir() {
+		if files, err = listSourceFiles(inputPath, opts); err != nil {
+			return stat, err
+		}
+		sort.Strings(files)
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "%s\npackage %s\n", generatedHeader, pkg)
+	names := make(map[string]string)
+	original, minified, vars := 0, 0, 0
+	for _, path := range files {
+		name := generateConstName(path)
+		if other, ok := names[name]; ok {
+			return stat, fmt.Errorf("%s and %s would both be the constant %s", other, path, name)
+		}
+		names[name] = path
+
+		content, err := readSourceFile(path, opts.MaxFileSize)
+		if err != nil {
+			return stat, err
+		}
+		code, n, err := minifySource(path, content, opts)
+		if err != nil {
+			return stat, err
+		}
+		fmt.Fprintf(&b, "\n// %s is the minified %s\nconst %s = %s\n", name, filepath.Base(path), name, strconv.Quote(code))
+		original += len(content)
+		minified += len(code)
+		vars += n
+	}
+	source, err := format.Source(b.Bytes())
+	if err != nil {
+		return stat, err
+	}
+
+	if opts.StatsOnly {
+		outputPath = ""
+	} else if err = checkGeneratedOverwrite(outputPath, opts); err != nil {
+		return stat, err
+	} else if err = ioutil.WriteFile(outputPath, source, 0644); err != nil {
+		debugLog("Error writing output file: %v", err)
+		return stat, err
+	}
+
+	stat = MinificationStats{
+		InputFile:    inputPath,
+		OutputFile:   outputPath,
+		OriginalSize: original,
+		MinifiedSize: minified,
+		ProcessTime:  float64(time.Since(start).Microseconds()) / 1000.0,
+		VarsMangled:  vars,
+	}
+	if original > 0 {
+		stat.Reduction = float64(original-minified) / float64(original) * 100
+	}
+	processMetrics.record(stat)
+	return stat, nil
+}
+
+// checkGeneratedOverwrite is checkOverwrite for the Go file of generate,
+// which replaces a file it generated before without -force, so that
+// go:generate can be run again
+func checkGeneratedOverwrite(outputPath string, opts Options) error {
+	content, err := ioutil.ReadFile(outputPath)
+	if err == nil && bytes.HasPrefix(content, []byte(generatedHeader)) {
+		return nil
+	}
+	return checkOverwrite(outputPath, opts)
+}
+
+// runGenerate handles the generate subcommand of run
+func runGenerate(inputPath, outputPath, pkg string, opts Options, jsonOutput bool, maxSize int) int {
+	if inputPath == "" || outputPath == "" {
+		debugLog("Please provide the input file or directory using -input and the Go file to write using -out")
+		return 1
+	}
+	if opts.InPlace {
+		debugLog("The -inplace flag cannot be used with generate")
+		return 1
+	}
+	stat, err := generateGoFile(inputPath, outputPath, pkg, opts)
+	if err != nil {
+		userOutput.Println(err)
+		return 1
+	}
+	if jsonOutput {
+		jsonStats, _ := json.MarshalIndent(stat, "", "  ")
+		debugLog("%s", string(jsonStats))
+	} else {
+		reportStats(stat)
+	}
+	return checkBudget([]MinificationStats{stat}, maxSize)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// gitignore matches paths against the patterns of a .gitignore file. It
+// supports the common subset of the format: comments, `!` negation, `*`,
+// `?`, `[...]` and `**` wildcards, a leading `/` anchoring a pattern to the
+// directory of the file and a trailing `/` matching directories only.
+type gitignore struct {
+	rules []ignoreRule
+}
+
+// ignoreRule is a single compiled .gitignore pattern
+type ignoreRule struct {
+	re      *regexp.Regexp
+	negate  bool
+	dirOnly bool
+}
+
+// loadGitignore reads the .gitignore file in dir. A missing file gives a
+// matcher that ignores nothing. Unlike git, it does not read the
+// .gitignore files of the directories above dir; only the files directly
+// in dir are minified, so those of the directories below never apply.
+func loadGitignore(dir string) (*gitignore, error) {
+	content, err := ioutil.ReadFile(filepath.Join(dir, ".gitignore"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return &gitignore{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return parseGitignore(string(content)), nil
+}
+
+// parseGitignore compiles the patterns in the content of a .gitignore file
+func parseGitignore(content string) *gitignore {
+	g := &gitignore{}
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimRight(line, "\r")
+		if !strings.HasSuffix(line, `\ `) {
+			line = strings.TrimRight(line, " ")
+		}
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		var rule ignoreRule
+		if line[0] == '!' {
+			rule.negate = true
+			line = line[1:]
+		} else if line[0] == '\\' {
+			line = line[1:] // an escaped leading # or !
+		}
+		if strings.HasSuffix(line, "/") {
+			rule.dirOnly = true
+			line = strings.TrimRight(line, "/")
+		}
+		if line == "" {
+			continue
+		}
+		rule.re = compileIgnorePattern(line)
+		g.rules = append(g.rules, rule)
+	}
+	return g
+}
+
+// compileIgnorePattern turns a .gitignore pattern into a regular expression
+// matching slash-separated paths relative to the .gitignore file. A pattern
+// without a slash matches a name at any depth.
+func compileIgnorePattern(pattern string) *regexp.Regexp {
+	var b strings.Builder
+	if strings.Contains(pattern, "/") {
+		b.WriteString("^")
+		pattern = strings.TrimPrefix(pattern, "/")
+	} else {
+		b.WriteString("(?:^|/)")
+	}
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; {
+		case strings.HasPrefix(pattern[i:], "**/"):
+			b.WriteString("(?:.*/)?")
+			i += 2
+		case strings.HasPrefix(pattern[i:], "/**") && i+3 == len(pattern):
+			b.WriteString("/.*")
+			i += 2
+		case strings.HasPrefix(pattern[i:], "**"):
+			b.WriteString(".*")
+			i++
+		case c == '*':
+			b.WriteString("[^/]*")
+		case c == '?':
+			b.WriteString("[^/]")
+		case c == '[' && strings.IndexByte(pattern[i+1:], ']') > 0:
+			end := i + 1 + strings.IndexByte(pattern[i+1:], ']')
+			class := pattern[i+1 : end]
+			if class[0] == '!' {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + strings.ReplaceAll(class, `\`, `\\`) + "]")
+			i = end
+		case c == '\\' && i+1 < len(pattern):
+			i++
+			b.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+	re, err := regexp.Compile(b.String())
+	if err != nil {
+		// A malformed character class; match the pattern literally
+		return regexp.MustCompile("(?:^|/)" + regexp.QuoteMeta(pattern) + "$")
+	}
+	return re
+}
+
+// ignored reports whether the path rel, relative to the directory of the
+// .gitignore file and naming a directory if isDir is set, is ignored. A
+// path inside an ignored directory is ignored too.
+func (g *gitignore) ignored(rel string, isDir bool) bool {
+	rel = filepath.ToSlash(rel)
+	parts := strings.Split(rel, "/")
+	for i := 1; i < len(parts); i++ {
+		if g.match(strings.Join(parts[:i], "/"), true) {
+			return true
+		}
+	}
+	return g.match(rel, isDir)
+}
+
+// match applies the rules to a single path; the last matching rule wins
+func (g *gitignore) match(rel string, isDir bool) bool {
+	ignored := false
+	for _, rule := range g.rules {
+		if rule.dirOnly && !isDir {
+			continue
+		}
+		if rule.re.MatchString(rel) {
+			ignored = !rule.negate
+		}
+	}
+	return ignored
+}
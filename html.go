@@ -0,0 +1,74 @@
+package main
+
+import (
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+var (
+	scriptBlockRe = regexp.MustCompile(`(?is)(<script\b[^>]*>)(.*?)(</script\s*>)`)
+	scriptSrcRe   = regexp.MustCompile(`(?i)\ssrc\s*=`)
+	scriptTypeRe  = regexp.MustCompile(`(?i)\stype\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s>]+))`)
+)
+
+// javaScriptTypes lists the <script type> values whose contents are JavaScript
+var javaScriptTypes = map[string]bool{
+	"":                       true,
+	"module":                 true,
+	"text/javascript":        true,
+	"application/javascript": true,
+	"text/ecmascript":        true,
+	"application/ecmascript": true,
+}
+
+// isHTMLFile reports whether path looks like an HTML page
+func isHTMLFile(path string) bool {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".html", ".htm":
+		return true
+	}
+	return false
+}
+
+// isInlineJavaScript reports whether a <script> opening tag holds inline
+// JavaScript, as opposed to an external reference or a non-JS payload such
+// as a JSON blob or a client-side template
+func isInlineJavaScript(openTag string) bool {
+	if scriptSrcRe.MatchString(openTag) {
+		return false
+	}
+	parts := scriptTypeRe.FindStringSubmatch(openTag)
+	if parts == nil {
+		return true
+	}
+	scriptType := strings.ToLower(strings.TrimSpace(parts[1] + parts[2] + parts[3]))
+	return javaScriptTypes[scriptType]
+}
+
+// minifyHTMLScripts minifies the contents of every inline JavaScript
+// <script> block in an HTML page, leaving the rest of the markup untouched.
+// It also returns the warnings about the scripts, at their positions in
+// the page.
+func minifyHTMLScripts(html string, opts Options) (string, []Warning) {
+	// The page keeps its own line breaks, and so its final newline
+	opts.FinalNewline = false
+	var b strings.Builder
+	var warnings []Warning
+	last := 0
+	for _, loc := range scriptBlockRe.FindAllStringSubmatchIndex(html, -1) {
+		openTag, body := html[loc[2]:loc[3]], html[loc[4]:loc[5]]
+		if !isInlineJavaScript(openTag) || strings.TrimSpace(body) == "" {
+			continue
+		}
+		minified, found := NewMinifierWithOptions(body, opts).MinifyWithWarnings()
+		for _, w := range found {
+			warnings = append(warnings, w.in(html, loc[4]))
+		}
+		b.WriteString(html[last:loc[4]])
+		b.WriteString(minified)
+		last = loc[5]
+	}
+	b.WriteString(html[last:])
+	return b.String(), warnings
+}
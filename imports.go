@@ -0,0 +1,223 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+// importDecl is a top-level import declaration found by parseImport
+type importDecl struct {
+	start, end  int      // token range of the declaration, end exclusive
+	lineEnd     bool     // the declaration ends at a line break, not a `;`
+	module      string   // module specifier, without quotes
+	source      string   // tokens from `from` up to and including any `;`
+	defaultName string   // default import binding, if any
+	named       []string // named specifiers such as "a" or "a as b"
+}
+
+// mergeImports combines the top-level import declarations that load the
+// same module into the first of them and drops duplicate specifiers, so
+// that `import{a}from'm';import{b}from'm';` becomes `import{a,b}from'm';`.
+// A declaration without a semicolon ends at the line break after its module
+// specifier, where automatic semicolon insertion ends it.
+// Declarations importing a namespace (`* as ns`), imports for side effects
+// and modules imported with two different default names are left as they
+// are. Code is the collapsed code with its literals protected; literals
+// holds their text, by which module specifiers are compared.
+func mergeImports(code string, literals []string) string {
+	tokens := tokenize(code)
+
+	var decls []*importDecl
+	first := make(map[string]*importDecl)
+	merged := make(map[int]*importDecl) // declarations merged away, by start
+	depth := 0
+	prev := ""
+	for i := 0; i < len(tokens); i++ {
+		t := tokens[i]
+		switch {
+		case t.kind == tokSpace:
+			if strings.ContainsAny(t.text, "\n\r") {
+				prev = "\n" // a statement may end at the line break
+			}
+			continue
+		case t.text == "(" || t.text == "[" || t.text == "{":
+			depth++
+		case t.text == ")" || t.text == "]" || t.text == "}":
+			depth--
+		case t.text == "import" && depth == 0 && (prev == "" || prev == ";" || prev == "}" || prev == "\n"):
+			decl := parseImport(tokens, i, literals)
+			if decl == nil {
+				break
+			}
+			if into := first[decl.module]; into == nil {
+				first[decl.module] = decl
+				decls = append(decls, decl)
+			} else if into.merge(decl) {
+				merged[decl.start] = decl
+			}
+			i = decl.end - 1
+			prev = ";"
+			continue
+		}
+		prev = t.text
+	}
+	if len(merged) == 0 {
+		return code
+	}
+
+	starts := make(map[int]*importDecl, len(decls))
+	for _, decl := range decls {
+		starts[decl.start] = decl
+	}
+	var b strings.Builder
+	b.Grow(len(code))
+	for i := 0; i < len(tokens); i++ {
+		if decl := starts[i]; decl != nil {
+			b.WriteString(decl.render())
+			i = decl.end - 1
+			continue
+		}
+		if decl := merged[i]; decl != nil {
+			i = decl.end - 1
+			continue
+		}
+		if decl := merged[i+1]; decl != nil && tokens[i].kind == tokSpace && (decl.lineEnd || decl.end == len(tokens)) {
+			// The line break ending the statement before a declaration
+			// that ends at a line break of its own, or the code, goes
+			// with it
+			continue
+		}
+		b.WriteString(tokens[i].text)
+	}
+	return b.String()
+}
+
+// parseImport parses the import declaration starting at tokens[start]. It
+// returns nil for declarations that cannot be merged.
+func parseImport(tokens []token, start int, literals []string) *importDecl {
+	decl := &importDecl{start: start}
+	i := skipSpace(tokens, start+1)
+	if i < len(tokens) && tokens[i].kind == tokWord && tokens[i].text != "from" {
+		decl.defaultName = tokens[i].text
+		i = skipSpace(tokens, i+1)
+		if i < len(tokens) && tokens[i].text == "," {
+			i = skipSpace(tokens, i+1)
+		}
+	}
+	if i < len(tokens) && tokens[i].text == "{" {
+		var spec []string
+		for i = skipSpace(tokens, i+1); i < len(tokens) && tokens[i].text != "}"; i = skipSpace(tokens, i+1) {
+			if tokens[i].text == "," {
+				if len(spec) > 0 {
+					decl.named = append(decl.named, strings.Join(spec, " "))
+				}
+				spec = spec[:0]
+				continue
+			}
+			if tokens[i].kind != tokWord {
+				return nil
+			}
+			spec = append(spec, tokens[i].text)
+		}
+		if len(spec) > 0 {
+			decl.named = append(decl.named, strings.Join(spec, " "))
+		}
+		i = skipSpace(tokens, i+1)
+	}
+	if decl.defaultName == "" && len(decl.named) == 0 {
+		return nil // side-effect or namespace import
+	}
+
+	from := i
+	if i >= len(tokens) || tokens[i].text != "from" {
+		return nil
+	}
+	i = skipSpace(tokens, i+1)
+	if i >= len(tokens) || tokens[i].kind != tokLiteral {
+		return nil
+	}
+	module, ok := literalText(tokens[i].text, literals)
+	if !ok || len(module) < 2 {
+		return nil
+	}
+	decl.module = module[1 : len(module)-1]
+	switch next := skipSpace(tokens, i+1); {
+	case next < len(tokens) && tokens[next].text == ";":
+		decl.end = next + 1
+	case next < len(tokens) && (tokens[next].text == "with" || tokens[next].text == "assert"):
+		return nil // import attributes
+	case next == len(tokens) || strings.ContainsAny(tokens[i+1].text, "\n\r"):
+		// Without a semicolon the declaration ends at the line break
+		decl.end = i + 1
+		decl.lineEnd = true
+	default:
+		return nil
+	}
+
+	var source strings.Builder
+	for _, t := range tokens[from:decl.end] {
+		source.WriteString(t.text)
+	}
+	decl.source = source.String()
+	return decl
+}
+
+// merge adds the specifiers of other to decl, skipping those it already
+// has. It reports false, leaving decl unchanged, if the two declarations
+// bind different default names.
+func (decl *importDecl) merge(other *importDecl) bool {
+	if other.defaultName != "" && decl.defaultName != "" && other.defaultName != decl.defaultName {
+		return false
+	}
+	if decl.defaultName == "" {
+		decl.defaultName = other.defaultName
+	}
+	for _, spec := range other.named {
+		duplicate := false
+		for _, existing := range decl.named {
+			if existing == spec {
+				duplicate = true
+			}
+		}
+		if !duplicate {
+			decl.named = append(decl.named, spec)
+		}
+	}
+	return true
+}
+
+// render returns the declaration in minified form
+func (decl *importDecl) render() string {
+	var b strings.Builder
+	b.WriteString("import")
+	if decl.defaultName != "" {
+		b.WriteString(" " + decl.defaultName)
+	}
+	if len(decl.named) > 0 {
+		if decl.defaultName != "" {
+			b.WriteString(",")
+		}
+		b.WriteString("{" + strings.Join(decl.named, ",") + "}")
+	} else {
+		b.WriteString(" ")
+	}
+	b.WriteString(decl.source)
+	return b.String()
+}
+
+// skipSpace returns the index of the first non-space token at or after i
+func skipSpace(tokens []token, i int) int {
+	for i < len(tokens) && tokens[i].kind == tokSpace {
+		i++
+	}
+	return i
+}
+
+// literalText returns the text recorded for the placeholder p
+func literalText(p string, literals []string) (string, bool) {
+	n, err := strconv.Atoi(strings.Trim(p, string(placeholderMark)))
+	if err != nil || n >= len(literals) {
+		return "", false
+	}
+	return literals[n], true
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"strings"
+)
+
+// IncrementalMinifier minifies successive versions of the same file, as
+// watch mode does on every save. The file is split into top-level
+// statements and the output of each one is cached, so after a small edit
+// only the statements that changed are minified again.
+//
+// Minifying statements separately gives the same result as minifying the
+// whole file because every pass apart from variable shortening is local
+// and the whitespace at a statement boundary, which follows a `;` or `}`,
+// is dropped unless the `}` ends an expression. When the options make the
+// output depend on the file as a whole, Minify falls back to minifying it
+// in one piece.
+type IncrementalMinifier struct {
+	opts  Options
+	cache map[statementKey]minifiedStatement
+}
+
+// statementKey identifies a cached statement. The first statement of a
+// file is keyed separately since only it can carry the license comment.
+type statementKey struct {
+	source string
+	first  bool
+}
+
+// minifiedStatement is the cached output of a statement
+type minifiedStatement struct {
+	code    string
+	closing braceKind // the brace the code ends with, if any
+}
+
+// NewIncrementalMinifier creates an incremental minifier with the given options
+func NewIncrementalMinifier(opts Options) *IncrementalMinifier {
+	return &IncrementalMinifier{
+		opts:  opts,
+		cache: make(map[statementKey]minifiedStatement),
+	}
+}
+
+// incremental reports whether the options allow statements to be minified
+// independently of each other
+func (im *IncrementalMinifier) incremental() bool {
+	return !im.opts.ShortenVars && im.opts.MangleProps == nil && !im.opts.MergeImports && !im.opts.Banner && !im.opts.Beautify &&
+		!im.opts.TopLevelNewlines && !im.opts.RemoveEmpty && im.opts.LineWidth == 0 &&
+		!strings.ContainsAny(im.opts.KeepSpacesAround, ";}")
+}
+
+// Minify minifies input, reusing the output of statements that are
+// unchanged since the previous call. Only the statements of the latest
+// input are kept in the cache.
+func (im *IncrementalMinifier) Minify(input string) string {
+	result, _ := im.MinifyWithWarnings(input)
+	return result
+}
+
+// MinifyWithWarnings minifies input like Minify and also returns the
+// warnings of Minifier.MinifyWithWarnings. Input with JSX is minified in
+// one piece, since no statement of it would be minified on its own.
+func (im *IncrementalMinifier) MinifyWithWarnings(input string) (string, []Warning) {
+	if !im.incremental() || findJSX(input) >= 0 {
+		return NewMinifierWithOptions(input, im.opts).MinifyWithWarnings()
+	}
+
+	cache := make(map[statementKey]minifiedStatement, len(im.cache))
+	var b strings.Builder
+	b.Grow(len(input))
+	var closing braceKind
+	for i, statement := range splitStatements(input) {
+		key := statementKey{source: statement, first: i == 0}
+		cached, ok := im.cache[key]
+		if !ok {
+			opts := im.opts
+			// A license comment is only recognized at the start of a file
+			opts.PreserveLicense = opts.PreserveLicense && i == 0
+			opts.FinalNewline = false
+			m := NewMinifierWithOptions(statement, opts)
+			cached = minifiedStatement{m.Minify(), m.closing}
+		}
+		cache[key] = cached
+
+		minified := cached.code
+		if strings.HasSuffix(b.String(), ";") {
+			// Repeated semicolons are merged across statements too
+			minified = strings.TrimLeft(minified, ";")
+		}
+		if closing.expression && startsOnNewLine(statement, minified, closing.arrow) {
+			b.WriteByte('\n')
+		}
+		b.WriteString(minified)
+		closing = cached.closing
+	}
+	im.cache = cache
+	if im.opts.FinalNewline {
+		return withFinalNewline(b.String()), nil
+	}
+	return b.String(), nil
+}
+
+// startsOnNewLine reports whether a statement, minified as minified, must
+// stay on its own line after an expression ending with `}`, the body of an
+// arrow function if arrow is set: its source starts on a new line that
+// keepsLineBreak keeps. A `/` starting a statement begins a regular
+// expression unless it starts a kept comment.
+func startsOnNewLine(statement, minified string, arrow bool) bool {
+	rest := strings.TrimLeft(statement, " \t")
+	if rest == "" || rest[0] != '\n' && rest[0] != '\r' || minified == "" {
+		return false
+	}
+	if strings.HasPrefix(minified, "//") {
+		return false // a line comment ends with a line break of its own
+	}
+	c := minified[0]
+	regex := c == '/' && !strings.HasPrefix(minified, "/*")
+	return keepsLineBreak(true, true, arrow, minified, c == '\'' || c == '"' || c == '`' || regex)
+}
@@ -1,267 +1,1623 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
+	"log"
 	"os"
 	"path/filepath"
 	"regexp"
+	"runtime"
 	"strings"
 	"sync"
 	"time"
+	"unicode/utf8"
+	"unsafe"
 )
 
-var debugFile *os.File
+// debugLogger writes debugging output to debug.log. A log.Logger serializes
+// its writes, so the goroutines minifying a directory can share it.
+var debugLogger = log.New(ioutil.Discard, "", 0)
 
 func init() {
-	var err error
-	debugFile, err = os.OpenFile("debug.log", os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	debugFile, err := os.OpenFile("debug.log", os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Failed to open debug file: %v\n", err)
 		return
 	}
+	debugLogger.SetOutput(debugFile)
 }
 
 func debugLog(format string, args ...interface{}) {
-	if debugFile != nil {
-		fmt.Fprintf(debugFile, format+"\n", args...)
-	}
+	debugLogger.Printf(format, args...)
 }
 
 // MinificationStats holds statistics about the minification process
 type MinificationStats struct {
-	InputFile     string  `json:"input_file"`
-	OutputFile    string  `json:"output_file"`
-	OriginalSize  int     `json:"original_size"`
-	MinifiedSize  int     `json:"minified_size"`
-	Reduction     float64 `json:"reduction_percentage"`
-	ProcessTime   float64 `json:"process_time_ms"`
+	InputFile    string  `json:"input_file"`
+	OutputFile   string  `json:"output_file"`
+	OriginalSize int     `json:"original_size"`
+	MinifiedSize int     `json:"minified_size"`
+	Reduction    float64 `json:"reduction_percentage"`
+	ProcessTime  float64 `json:"process_time_ms"`
+	// VarsMangled is the number of variable names shortened; it stays
+	// zero without ShortenVars and for HTML files
+	VarsMangled int `json:"vars_mangled"`
+	// Error explains why the file was skipped; it is empty for files
+	// that were minified
+	Error string `json:"error,omitempty"`
+}
+
+// Options controls which transformations the minifier applies
+type Options struct {
+	PreserveLicense    bool
+	ShortenVars        bool
+	StripLineComments  bool
+	StripBlockComments bool
+	PreserveJSDoc      bool
+	// KeepLegalComments keeps comments anywhere in the code that start
+	// with `/*!` or `//!` or mention @license or @preserve
+	KeepLegalComments bool
+	// KeepSpacesAround lists operator characters, such as "+-", whose
+	// surrounding whitespace is left alone instead of being collapsed
+	KeepSpacesAround string
+	Banner           bool
+	HTML             bool
+	StatsOnly        bool
+	InPlace          bool
+	// MaxFileSize is the size in bytes above which input files are
+	// refused; zero means no limit
+	MaxFileSize int64
+	// MergeImports combines import declarations loading the same module
+	MergeImports bool
+	// MangleProps selects the property names to shorten; nil disables
+	// property mangling
+	MangleProps *regexp.Regexp
+	// Profile records how long each pass of Minify takes
+	Profile bool
+	// KeepSourceMappingURL keeps `//# sourceMappingURL=` comments, which
+	// are otherwise stripped whatever the other comment options say
+	KeepSourceMappingURL bool
+	// Beautify lays the output out one statement per line with indented
+	// blocks instead of keeping it compact
+	Beautify bool
+	// NamesMap writes the variable names shortened in each file to a
+	// .names.json file next to the minified output
+	NamesMap bool
+	// KeepPureAnnotations keeps `/*#__PURE__*/` and `/*#__NO_SIDE_EFFECTS__*/`
+	// annotations, which are otherwise stripped whatever the other
+	// comment options say
+	KeepPureAnnotations bool
+	// FrequencyNames gives the shortest names to the variables used most
+	// often instead of to those declared first
+	FrequencyNames bool
+	// FinalNewline ends non-empty output with exactly one newline
+	FinalNewline bool
+	// Gitignore skips the files of a directory that its .gitignore
+	// matches. The .gitignore files of parent directories are not read.
+	Gitignore bool
+	// Quote is the quote character string literals are rewritten to use
+	// where they need no more escapes; zero keeps their own quotes
+	Quote byte
+	// TopLevelNewlines puts each top-level statement on its own line,
+	// while the code inside blocks and functions is fully collapsed
+	TopLevelNewlines bool
+	// ReadRetries is how many more times reading an input file is tried
+	// after a failure, such as a file an editor is still writing
+	ReadRetries int
+	// OrderedOutput reports the files of a directory in the order they
+	// are listed rather than in the order they finish
+	OrderedOutput bool
+	// RemoveEmpty removes empty statements and empty blocks wherever the
+	// code means the same without them, not only repeated semicolons
+	RemoveEmpty bool
+	// Force allows output files that already exist to be overwritten;
+	// without it they are refused, except in place and in watch mode
+	Force bool
+	// FoldStrings joins string literals added to each other, so that
+	// "foo" + "bar" becomes "foobar"
+	FoldStrings bool
+	// LineWidth is the length in bytes beyond which lines of compact
+	// output are broken where that is safe; zero leaves them unbroken
+	LineWidth int
+	// RequiredSpaces removes every space the grammar does not need, also
+	// those next to literals and operators such as `%` that are otherwise
+	// kept, as in `"key"in obj`
+	RequiredSpaces bool
+	// HashNames puts a hash of the minified content in output file names,
+	// so that app.min.js becomes app.min.3f2a9c1e.js
+	HashNames bool
+	// SafeMangle limits ShortenVars to the variables that cannot be seen
+	// from outside the file: the top-level declarations of scripts without
+	// import or export are kept, and code with a with statement is not
+	// renamed at all
+	SafeMangle bool
 }
 
-// Minifier handles JavaScript minification
+// DefaultOptions returns the options used by NewMinifier: all comments are
+// stripped, licenses are dropped and variable names are left untouched
+func DefaultOptions() Options {
+	return Options{
+		StripLineComments:  true,
+		StripBlockComments: true,
+	}
+}
+
+// Minifier handles JavaScript minification. A Minifier holds the names it
+// has assigned while shortening variables, so it must not be used by more
+// than one goroutine at a time; use one minifier per file, or Reset it
+// between files. The package-level helpers it relies on keep no state and
+// are safe for concurrent use.
 type Minifier struct {
-	input           string
-	preserveLicense bool
-	shortenVars     bool
-	varMap          map[string]string
-	varCounter      int
+	input      string
+	opts       Options
+	varMap     map[string]string
+	varCounter int
+
+	// nameGenerator returns the n-th name for shortened variables; nil
+	// uses shortName
+	nameGenerator func(index int) string
+
+	propMap     map[string]string
+	propCounter int
+
+	// closing describes the brace the last output ended with, if any.
+	// After one closing an expression, such as an object literal, a
+	// statement following on the next line must not be joined to it.
+	closing braceKind
+
+	// jsx is the offset just past the first `<` opening a JSX element in
+	// the code given to protectLiterals, or zero when there is none
+	jsx int
+
+	// timings holds the pass durations of the last Minify call when
+	// profiling is enabled
+	timings []passTiming
+
+	// warnings holds the transformations the last Minify call skipped
+	warnings []Warning
 }
 
 // NewMinifier creates a new minifier instance
 func NewMinifier(input string, preserveLicense, shortenVars bool) *Minifier {
+	opts := DefaultOptions()
+	opts.PreserveLicense = preserveLicense
+	opts.ShortenVars = shortenVars
+	return NewMinifierWithOptions(input, opts)
+}
+
+// NewMinifierWithOptions creates a new minifier instance with explicit options
+func NewMinifierWithOptions(input string, opts Options) *Minifier {
 	return &Minifier{
-		input:           input,
-		preserveLicense: preserveLicense,
-		shortenVars:    shortenVars,
-		varMap:         make(map[string]string),
-		varCounter:     0,
+		input:      input,
+		opts:       opts,
+		varMap:     make(map[string]string),
+		varCounter: 0,
+		propMap:    make(map[string]string),
+	}
+}
+
+// Reset prepares the minifier for a new input, keeping its options. The
+// name map is cleared rather than reallocated, so a minifier taken from a
+// sync.Pool minifies each file without allocating fresh state.
+func (m *Minifier) Reset(input string) {
+	m.input = input
+	for name := range m.varMap {
+		delete(m.varMap, name)
 	}
+	m.varCounter = 0
+	for name := range m.propMap {
+		delete(m.propMap, name)
+	}
+	m.propCounter = 0
+	m.timings = m.timings[:0]
+	m.warnings = m.warnings[:0]
+}
+
+// Patterns used by the minification passes. They are compiled once at start
+// up rather than on every call, which keeps per-file allocations low.
+var (
+	licenseRe          = regexp.MustCompile(`^/\*![\s\S]*?\*/`)
+	declarationStartRe = regexp.MustCompile(`^\s*(export|function|class|const|let|var|async)\b`)
+)
+
+// byteOrderMark is the UTF-8 encoding of U+FEFF, which editors may put at
+// the start of a file
+const byteOrderMark = "\uFEFF"
+
+// punctuation lists the characters around which whitespace is never needed
+const punctuation = "+-*/=<>!?:&|;,{}[]()"
+
+// SetNameGenerator makes variable shortening take its names from gen,
+// which is called with 0, 1, 2, ... and must return a different valid
+// identifier for every index. Names that are keywords or already used in
+// the code are skipped, as with the built-in names. A nil gen restores the
+// default names a, b, c, ... z, a1, b1, ... The generator is kept by Reset.
+func (m *Minifier) SetNameGenerator(gen func(index int) string) {
+	m.nameGenerator = gen
 }
 
 // generateVarName generates short variable names (a, b, c, ... z, a1, b1, ...)
+// or those of the generator set by SetNameGenerator
 func (m *Minifier) generateVarName() string {
-	alphabet := "abcdefghijklmnopqrstuvwxyz"
-	suffix := m.varCounter / 26
-	char := alphabet[m.varCounter%26]
+	var name string
+	if m.nameGenerator != nil {
+		name = m.nameGenerator(m.varCounter)
+	} else {
+		name = shortName(m.varCounter)
+	}
 	m.varCounter++
+	return name
+}
+
+// shortName returns the n-th generated name
+func shortName(n int) string {
+	alphabet := "abcdefghijklmnopqrstuvwxyz"
+	suffix := n / 26
+	char := alphabet[n%26]
 	if suffix == 0 {
 		return string(char)
 	}
 	return fmt.Sprintf("%c%d", char, suffix)
 }
 
-// shortenVariableNames replaces variable names with shorter versions
-func (m *Minifier) shortenVariableNames(code string) string {
-	// Preserve strings
-	stringLiterals := make(map[string]string)
-	re := regexp.MustCompile(`"[^"]*"|'[^']*'`)
-	code = re.ReplaceAllStringFunc(code, func(s string) string {
-		placeholder := fmt.Sprintf("__STR_%d__", len(stringLiterals))
-		stringLiterals[placeholder] = s
-		return placeholder
-	})
+// shortenVariableNames replaces variable and parameter names with shorter
+// versions. Property names, object keys and class members are left alone,
+// and shorthand properties are expanded so that their keys survive. Names
+// are handed out in order of declaration or, with FrequencyNames, of use.
+// With keepGlobals the names declared at the top level keep their spelling.
+func (m *Minifier) shortenVariableNames(code string, keepGlobals bool) string {
+	mg := newMangler(code)
+	if keepGlobals {
+		mg.excludeTopLevel()
+	}
+	reserved := mg.reserved()
+	declared := mg.declared
+	if m.opts.FrequencyNames {
+		declared = mg.byFrequency(declared)
+	}
+	for _, name := range declared {
+		if mg.excluded[name] {
+			continue
+		}
+		if _, exists := m.varMap[name]; exists {
+			continue
+		}
+		short := m.generateVarName()
+		for reserved[short] || jsKeywords[short] {
+			short = m.generateVarName()
+		}
+		m.varMap[name] = short
+	}
+	return mg.rename(m.varMap, nil)
+}
+
+// VarMap returns a copy of the names shortened by the last Minify, mapping
+// each original name to its short replacement
+func (m *Minifier) VarMap() map[string]string {
+	names := make(map[string]string, len(m.varMap))
+	for name, short := range m.varMap {
+		names[name] = short
+	}
+	return names
+}
+
+// mangleProperties renames the property names matching the MangleProps
+// filter consistently across the code. Properties accessed through string
+// keys, such as obj["name"], are not renamed, which is why only properties
+// selected by the filter are touched.
+func (m *Minifier) mangleProperties(code string) string {
+	mg := newMangler(code)
+	reserved := mg.reserved()
+	for _, name := range mg.properties(m.opts.MangleProps) {
+		if _, exists := m.propMap[name]; exists {
+			continue
+		}
+		short := shortName(m.propCounter)
+		m.propCounter++
+		for reserved[short] || jsKeywords[short] {
+			short = shortName(m.propCounter)
+			m.propCounter++
+		}
+		m.propMap[name] = short
+	}
+	return mg.rename(nil, m.propMap)
+}
+
+// keepComment reports whether comment c, followed by the source in rest,
+// survives minification under the current options
+func (m *Minifier) keepComment(c, rest string) bool {
+	if isSourceMappingURL(c) {
+		// The map describes the unminified file, so it rarely fits the
+		// output and is only kept on request
+		return m.opts.KeepSourceMappingURL
+	}
+	if isPureAnnotation(c) {
+		// Bundlers read these to drop unused calls; once they have run
+		// the annotations are dead weight
+		return m.opts.KeepPureAnnotations
+	}
+	if m.opts.KeepLegalComments && isLegalComment(c) {
+		return true
+	}
+	if isLineComment(c) {
+		return !m.opts.StripLineComments
+	}
+	if !m.opts.StripBlockComments {
+		return true
+	}
+	// JSDoc blocks are only worth keeping when they document a declaration
+	isJSDoc := strings.HasPrefix(c, "/**") && c != "/**/"
+	return m.opts.PreserveJSDoc && isJSDoc && declarationStartRe.MatchString(rest)
+}
+
+// isSourceMappingURL reports whether comment c links a source map, as in
+// `//# sourceMappingURL=app.js.map` or the older `//@ sourceMappingURL=`
+func isSourceMappingURL(c string) bool {
+	body := c[2:]
+	if !strings.HasPrefix(body, "#") && !strings.HasPrefix(body, "@") {
+		return false
+	}
+	return strings.HasPrefix(strings.TrimLeft(body[1:], " \t"), "sourceMappingURL=")
+}
+
+// pureAnnotationRe matches the annotations marking a call as free of side
+// effects, such as `/*#__PURE__*/` and `/*@__NO_SIDE_EFFECTS__*/`
+var pureAnnotationRe = regexp.MustCompile(`^/\*\s*[#@]__(PURE|NO_SIDE_EFFECTS)__\s*\*/$`)
+
+// isPureAnnotation reports whether comment c is a PURE or NO_SIDE_EFFECTS
+// annotation
+func isPureAnnotation(c string) bool {
+	return strings.HasPrefix(c, "/*") && pureAnnotationRe.MatchString(c)
+}
+
+// isLegalComment reports whether comment c carries licensing information:
+// it starts with `/*!` or `//!`, or mentions @license or @preserve
+func isLegalComment(c string) bool {
+	return strings.HasPrefix(c[2:], "!") || strings.Contains(c, "@license") || strings.Contains(c, "@preserve")
+}
+
+// applyCommentPolicy sets the comment options of opts from a -comments
+// policy: "none" strips every comment, "some" keeps only license comments
+// and "all" keeps every comment
+func applyCommentPolicy(opts *Options, policy string) error {
+	switch policy {
+	case "none":
+		opts.PreserveLicense = false
+		opts.KeepLegalComments = false
+		opts.PreserveJSDoc = false
+		opts.StripLineComments = true
+		opts.StripBlockComments = true
+	case "some":
+		opts.PreserveLicense = true
+		opts.KeepLegalComments = true
+		opts.PreserveJSDoc = false
+		opts.StripLineComments = true
+		opts.StripBlockComments = true
+	case "all":
+		opts.PreserveLicense = true
+		opts.StripLineComments = false
+		opts.StripBlockComments = false
+	default:
+		return fmt.Errorf("unknown comment policy %q, want all, some or none", policy)
+	}
+	return nil
+}
+
+// applyPreset turns on the options of the named preset, a common
+// combination of options: "conservative" only collapses whitespace and
+// keeps every comment, "balanced" is the default, "aggressive" also
+// shortens variables, giving the shortest names to the most used ones,
+// merges imports and strips every comment, and "terser-like" does the
+// same while keeping license comments, like Terser. Options a preset does
+// not mention keep their values, so flags can add to it.
+func applyPreset(opts *Options, preset string) error {
+	switch preset {
+	case "conservative":
+		return applyCommentPolicy(opts, "all")
+	case "balanced":
+	case "aggressive", "terser-like":
+		opts.ShortenVars = true
+		opts.FrequencyNames = true
+		opts.MergeImports = true
+		if preset == "aggressive" {
+			return applyCommentPolicy(opts, "none")
+		}
+		return applyCommentPolicy(opts, "some")
+	default:
+		return fmt.Errorf("unknown preset %q, want conservative, balanced, aggressive or terser-like", preset)
+	}
+	return nil
+}
+
+// bannerComment returns the comment prepended by the banner option, stating
+// how much smaller the minified output is than the original
+func bannerComment(originalSize, minifiedSize int) string {
+	reduction := 0.0
+	if originalSize > 0 {
+		reduction = float64(originalSize-minifiedSize) / float64(originalSize) * 100
+	}
+	return fmt.Sprintf("/* minified: %.0f%% smaller */", reduction)
+}
+
+// collapsiblePunctuation returns the punctuation characters whose
+// surrounding whitespace may be removed, leaving out those listed in keep
+func collapsiblePunctuation(keep string) string {
+	if keep == "" {
+		return punctuation
+	}
+	var b strings.Builder
+	for i := 0; i < len(punctuation); i++ {
+		if strings.IndexByte(keep, punctuation[i]) < 0 {
+			b.WriteByte(punctuation[i])
+		}
+	}
+	return b.String()
+}
+
+// collapseWhitespace removes whitespace that is not needed to separate
+// tokens in a single pass: whitespace next to a character in punct is
+// dropped and other runs of whitespace become one character. A run with a
+// line break stays a newline, since the break may end a statement through
+// automatic semicolon insertion, as in `let x = 1` followed by `let y = 2`.
+// So does one after a closing bracket that ends an expression, as in
+// `f()` or `x = {a: 1}` followed by another statement on the next line.
+// Whitespace next to a kept comment that spans a line break is dropped too,
+// as the comment already separates the lines; literals holds the text of
+// the placeholders in code. With requiredOnly the other spaces are only kept
+// where the tokens on either side would otherwise run together, as two
+// words or a number and a member access do. The result reports too whether
+// the collapsed code ends with a brace that closes an expression.
+func collapseWhitespace(code, punct string, literals []string, requiredOnly bool) (string, braceKind) {
+	code = strings.TrimSpace(code)
+	var b strings.Builder
+	b.Grow(len(code))
+	brackets := bracketTracker{code: code, literals: literals}
+
+	for i := 0; i < len(code); {
+		if !isSpace(code[i]) {
+			brackets.track(i)
+			b.WriteByte(code[i])
+			i++
+			continue
+		}
+
+		start := i
+		for i < len(code) && isSpace(code[i]) {
+			i++
+		}
+		run := code[start:i]
+
+		if code[start-1] == placeholderMark && breaksLine(placeholderBefore(code, start, literals)) ||
+			code[i] == placeholderMark && breaksLine(placeholderAfter(code, i, literals)) {
+			continue
+		}
+		// The inside of a template substitution needs no padding, just
+		// like the inside of parentheses
+		if code[start-1] == placeholderMark && strings.HasSuffix(placeholderBefore(code, start, literals), "${") ||
+			code[i] == placeholderMark && strings.HasPrefix(placeholderAfter(code, i, literals), "}") {
+			continue
+		}
+		// Kept comments do not separate tokens, so look past them
+		prev := significantBefore(code, start, literals)
+		next := significantAfter(code, i, literals)
+		if prev < 0 || next < 0 {
+			continue
+		}
+		newline := strings.ContainsAny(run, "\n\r")
+		if newline && restrictedLineBreak(code, prev, next) ||
+			newline && keepsLineBreak(brackets.endsExpression(prev), brackets.endsOperand(prev), brackets.endsArrowBody(prev), code[next:], code[next] == placeholderMark) {
+			b.WriteByte('\n')
+			continue
+		}
+		// The text right next to the whitespace, kept comments included
+		before, after := code[:start], code[i:]
+		if code[start-1] == placeholderMark {
+			before = placeholderBefore(code, start, literals)
+		}
+		if code[i] == placeholderMark {
+			after = placeholderAfter(code, i, literals)
+		}
+		// A literal or comment ends within itself, but one starting with a
+		// `/` can join a division before it, and a regular expression
+		// without flags ends in a `/` that can start a comment
+		if (code[start-1] != placeholderMark || isRegexLiteral(before)) && operatorsJoin(before, after) {
+			b.WriteByte(' ')
+			continue
+		}
+		if strings.IndexByte(punct, code[prev]) >= 0 || strings.IndexByte(punct, code[next]) >= 0 {
+			continue
+		}
+		if code[next] == '.' {
+			// Member access needs no separator, except after a number
+			// such as `5 .toString()`, or before one such as `.5`
+			if !endsNumber(code, prev) && (next+1 >= len(code) || code[next+1] < '0' || code[next+1] > '9') {
+				continue
+			}
+		} else if newline {
+			b.WriteByte('\n')
+			continue
+		}
+		if requiredOnly && !(isWordByte(code[prev]) && endsNumber(code, prev)) && !wordsJoin(before, after) &&
+			strings.IndexByte(punctuation, code[prev]) < 0 && strings.IndexByte(punctuation, code[next]) < 0 {
+			// Neither side is a word, nor an operator whose spaces
+			// KeepSpacesAround keeps
+			continue
+		}
+		b.WriteByte(' ')
+	}
+	collapsed := b.String()
+	if !strings.HasSuffix(collapsed, "}") {
+		return collapsed, braceKind{}
+	}
+	return collapsed, braceKind{expression: brackets.closedExpression, arrow: brackets.closedArrow}
+}
 
-	// Find and replace variable declarations
-	re = regexp.MustCompile(`\b(var|let|const)\s+([a-zA-Z_$][a-zA-Z0-9_$]*)\b`)
-	code = re.ReplaceAllStringFunc(code, func(s string) string {
-		parts := re.FindStringSubmatch(s)
-		if len(parts) == 3 {
-			original := parts[2]
-			if _, exists := m.varMap[original]; !exists {
-				m.varMap[original] = m.generateVarName()
+// topLevelNewlines puts every top-level statement of collapsed code on a
+// line of its own, leaving the statements nested in blocks and functions
+// collapsed. A line break follows each top-level `;` and each `}` closing
+// a top-level block, unless the statement goes on, as with `else`.
+func topLevelNewlines(code string, literals []string) string {
+	var b strings.Builder
+	b.Grow(len(code) + len(code)/16)
+	brackets := bracketTracker{code: code, literals: literals}
+	substitutions := 0 // open template literal substitutions
+	for i := 0; i < len(code); i++ {
+		if code[i] == placeholderMark {
+			end := i + 1 + strings.IndexByte(code[i+1:], placeholderMark)
+			text := placeholderText(code[i+1:end], literals)
+			if strings.HasPrefix(text, "}") {
+				substitutions--
 			}
-			return parts[1] + " " + m.varMap[original]
+			if strings.HasSuffix(text, "${") {
+				substitutions++
+			}
+			b.WriteString(code[i : end+1])
+			i = end
+			continue
 		}
-		return s
-	})
+		brackets.track(i)
+		b.WriteByte(code[i])
+		if len(brackets.braces) > 0 || len(brackets.parens) > 0 || substitutions > 0 {
+			continue
+		}
+		if code[i] != ';' && (code[i] != '}' || brackets.closedExpression) {
+			continue
+		}
+		rest := strings.TrimLeft(code[i+1:], " \t")
+		if rest == "" || rest[0] == '\n' || rest[0] == ';' {
+			continue
+		}
+		switch leadingWord(rest) {
+		case "else", "catch", "finally", "while":
+			continue
+		}
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
 
-	// Replace variable usages
-	for original, short := range m.varMap {
-		re = regexp.MustCompile(`\b` + original + `\b`)
-		code = re.ReplaceAllString(code, short)
+// leadingWord returns the word at the start of code, or "" if code does
+// not start with one
+func leadingWord(code string) string {
+	end := 0
+	for end < len(code) && isWordByte(code[end]) {
+		end++
 	}
+	return code[:end]
+}
 
-	// Restore strings
-	for placeholder, str := range stringLiterals {
-		code = strings.Replace(code, placeholder, str, -1)
+// endsNumber reports whether the word ending at offset end of code is a
+// number
+func endsNumber(code string, end int) bool {
+	start := end
+	for start > 0 && isWordByte(code[start-1]) {
+		start--
 	}
+	return code[start] >= '0' && code[start] <= '9'
+}
 
-	return code
+// operatorsJoin reports whether the punctuators ending left and starting
+// right would read as other tokens without whitespace between them:
+// `a - -b` and `1e-5 + +x` would become a decrement or increment, `a / /x/`
+// and `a / /*c*/ b` would start a comment, and `a < !--b` and `a-- >b` would
+// start HTML-like comments
+func operatorsJoin(left, right string) bool {
+	if left == "" || right == "" {
+		return false
+	}
+	switch l := left[len(left)-1]; {
+	case (l == '+' || l == '-') && right[0] == l:
+		return true
+	case l == '/' && (right[0] == '/' || right[0] == '*'):
+		return true
+	case l == '<' && strings.HasPrefix(right, "!--"):
+		return true
+	case strings.HasSuffix(left, "--") && right[0] == '>':
+		return true
+	}
+	return false
+}
+
+// wordsJoin reports whether left ends and right starts with a character
+// of a word, such as a name, keyword, number or the flags of a regular
+// expression, which without whitespace would read as one word. A name may
+// also start with a \u escape. A word after a regular expression without
+// flags, as in `/a/ in o`, would become its flags.
+func wordsJoin(left, right string) bool {
+	if left == "" || right == "" || !isWordByte(right[0]) && right[0] != '\\' {
+		return false
+	}
+	return isRegexLiteral(left) || isWordByte(left[len(left)-1])
+}
+
+// isRegexLiteral reports whether the text of a placeholder is a regular
+// expression literal rather than a comment, string or template
+func isRegexLiteral(text string) bool {
+	return len(text) > 2 && text[0] == '/' && text[1] != '*' && text[1] != '/'
+}
+
+// keepsLineBreak reports whether a line break before next, the code after
+// it, ends the statement before it by automatic semicolon insertion, so
+// that removing it would continue the statement instead. That is so before
+// a word or literal after a bracket closing an expression, before a block
+// or a prefix ++ or -- after anything that ends an operand, and before
+// anything but a separator or closing bracket after the body of an arrow
+// function, which cannot be called, indexed or tagged as `(`, `[` or a
+// template would; expression, operand and arrow tell which of those the
+// code before ends with, and literal whether next starts with a literal.
+// The incremental minifier joins statements minified apart by the same
+// rule.
+func keepsLineBreak(expression, operand, arrow bool, next string, literal bool) bool {
+	switch {
+	case arrow:
+		return literal || strings.IndexByte(",;:)]}", next[0]) < 0
+	case literal || isWordByte(next[0]):
+		return expression
+	case next[0] == '{':
+		return operand
+	}
+	return operand && (strings.HasPrefix(next, "++") || strings.HasPrefix(next, "--"))
+}
+
+// restrictedLineBreak reports whether a line break between the bytes at
+// prev and next must be kept even though punctuation surrounds it. A line
+// break after return, break, continue or yield ends the statement, and so
+// does one before a prefix ++ or -- or after a postfix one.
+func restrictedLineBreak(code string, prev, next int) bool {
+	wordStart := prev + 1
+	for wordStart > 0 && isWordByte(code[wordStart-1]) {
+		wordStart--
+	}
+	switch code[wordStart : prev+1] {
+	case "return", "break", "continue", "yield":
+		return true
+	}
+
+	endsOperand := isWordByte(code[prev]) || strings.IndexByte(")]}"+string(placeholderMark), code[prev]) >= 0
+	if endsOperand && (strings.HasPrefix(code[next:], "++") || strings.HasPrefix(code[next:], "--")) {
+		return true
+	}
+	postfix := prev > 0 && (code[prev-1:prev+1] == "++" || code[prev-1:prev+1] == "--")
+	startsOperand := isWordByte(code[next]) || strings.IndexByte("([{!~"+string(placeholderMark), code[next]) >= 0
+	return postfix && startsOperand
+}
+
+// bracketTracker follows the brackets of code as collapseWhitespace writes
+// it, to tell the braces that close an expression, such as an object
+// literal or a function expression, from those that close a block or a
+// declaration. When unsure it assumes an expression, which at worst keeps a
+// line break that was not needed.
+type bracketTracker struct {
+	code     string
+	literals []string
+
+	braces []braceKind // the braces not yet closed
+	parens []bool      // for each open parenthesis, whether it heads a block
+
+	blockAfterParen  bool // the last closed parenthesis heads a block
+	closedExpression bool // the last closed brace ended an expression
+	closedArrow      bool // the last closed brace ended an arrow function body
+}
+
+// braceKind describes an open brace
+type braceKind struct {
+	expression bool // the brace is part of an expression
+	class      bool // the brace opens a class body
+	object     bool // the brace opens an object literal
+	arrow      bool // the brace opens the body of an arrow function
+}
+
+// track records the bracket, if any, at offset i of the code
+func (bt *bracketTracker) track(i int) {
+	switch bt.code[i] {
+	case '(':
+		bt.parens = append(bt.parens, bt.headsBlock(i))
+	case ')':
+		if n := len(bt.parens); n > 0 {
+			bt.blockAfterParen = bt.parens[n-1]
+			bt.parens = bt.parens[:n-1]
+		}
+	case '{':
+		bt.braces = append(bt.braces, bt.openBrace(i))
+	case '}':
+		if n := len(bt.braces); n > 0 {
+			bt.closedExpression = bt.braces[n-1].expression
+			bt.closedArrow = bt.braces[n-1].arrow
+			bt.braces = bt.braces[:n-1]
+		}
+	}
+}
+
+// endsExpression reports whether the closing bracket at offset p, the last
+// one tracked, ends an expression
+func (bt *bracketTracker) endsExpression(p int) bool {
+	switch bt.code[p] {
+	case ')', ']':
+		return true
+	case '}':
+		return bt.closedExpression
+	}
+	return false
+}
+
+// endsArrowBody reports whether the closing bracket at offset p, the last
+// one tracked, ends the body of an arrow function
+func (bt *bracketTracker) endsArrowBody(p int) bool {
+	return bt.code[p] == '}' && bt.closedArrow
+}
+
+// endsOperand reports whether the byte at offset p, the last one tracked,
+// can end an expression statement, so that a line break between it and a
+// `{` ends the statement and the brace opens a block. Keywords such as
+// else and try, and parentheses heading a block, are followed by a brace
+// anyway.
+func (bt *bracketTracker) endsOperand(p int) bool {
+	switch c := bt.code[p]; {
+	case c == placeholderMark:
+		return true
+	case c == ')':
+		return !bt.blockAfterParen
+	case isWordByte(c):
+		word, _ := bt.wordBefore(p + 1)
+		switch word {
+		case "else", "do", "try", "finally", "static":
+			return false
+		}
+		return true
+	}
+	return bt.endsExpression(p)
+}
+
+// inClass reports whether the innermost open brace is a class body
+func (bt *bracketTracker) inClass() bool {
+	return len(bt.braces) > 0 && bt.braces[len(bt.braces)-1].class
+}
+
+// inObject reports whether the innermost open brace is an object literal
+func (bt *bracketTracker) inObject() bool {
+	return len(bt.braces) > 0 && bt.braces[len(bt.braces)-1].object
+}
+
+// wordBefore returns the word ending just before the significant byte at
+// offset end, and the offset it starts at, or "" and -1 if there is none
+func (bt *bracketTracker) wordBefore(end int) (string, int) {
+	p := significantBefore(bt.code, end, bt.literals)
+	if p < 0 || !isWordByte(bt.code[p]) {
+		return "", -1
+	}
+	start := p
+	for start > 0 && isWordByte(bt.code[start-1]) {
+		start--
+	}
+	return bt.code[start : p+1], start
+}
+
+// headsBlock reports whether the parenthesis at offset i opens the head of
+// a control statement, a function declaration or a method, whose body is
+// a block rather than part of an expression
+func (bt *bracketTracker) headsBlock(i int) bool {
+	word, start := bt.wordBefore(i)
+	switch word {
+	case "":
+		// A computed method name: [key]() {}
+		p := significantBefore(bt.code, i, bt.literals)
+		return p >= 0 && bt.code[p] == ']' && bt.inClass()
+	case "if", "for", "while", "switch", "catch", "with":
+		return true
+	case "await":
+		w, _ := bt.wordBefore(start)
+		return w == "for"
+	case "function":
+		return bt.statementStart(start)
+	}
+	if bt.inClass() {
+		return true
+	}
+	p := significantBefore(bt.code, start, bt.literals)
+	if p >= 0 && bt.code[p] == '*' {
+		start = p
+	}
+	if w, s := bt.wordBefore(start); w == "function" {
+		return bt.statementStart(s)
+	}
+	return false
+}
+
+// openBrace classifies the brace at offset i by what precedes it
+func (bt *bracketTracker) openBrace(i int) braceKind {
+	p := significantBefore(bt.code, i, bt.literals)
+	if p < 0 {
+		return braceKind{}
+	}
+	switch c := bt.code[p]; {
+	case c == ')':
+		return braceKind{expression: !bt.blockAfterParen}
+	case c == '>' && p > 0 && bt.code[p-1] == '=':
+		return braceKind{expression: true, arrow: true}
+	case isWordByte(c):
+		word, start := bt.wordBefore(i)
+		switch word {
+		case "else", "try", "finally", "do":
+			return braceKind{}
+		case "static":
+			if bt.inClass() {
+				return braceKind{}
+			}
+		}
+		if class := bt.classStart(word, start); class >= 0 {
+			return braceKind{expression: !bt.statementStart(class), class: true}
+		}
+		return braceKind{expression: true, object: true}
+	case c == placeholderMark:
+		// An object literal can open a template substitution
+		substitution := strings.HasSuffix(placeholderBefore(bt.code, p+1, bt.literals), "${")
+		return braceKind{expression: substitution, object: substitution}
+	case strings.IndexByte(";{}]", c) >= 0:
+		return braceKind{}
+	}
+	return braceKind{expression: true, object: true}
+}
+
+// classStart returns the offset of the class keyword if word, starting at
+// start, ends a class head such as `class A extends B`, or -1
+func (bt *bracketTracker) classStart(word string, start int) int {
+	words := []string{word}
+	starts := []int{start}
+	for len(words) < 4 {
+		w, s := bt.wordBefore(starts[len(starts)-1])
+		if s < 0 {
+			break
+		}
+		words = append(words, w)
+		starts = append(starts, s)
+	}
+	for k, w := range words {
+		if w == "class" && (k <= 1 || words[1] == "extends" && k <= 3) {
+			return starts[k]
+		}
+	}
+	return -1
+}
+
+// statementStart reports whether the declaration keyword at offset start,
+// such as function or class, begins a statement rather than an expression
+func (bt *bracketTracker) statementStart(start int) bool {
+	for {
+		word, s := bt.wordBefore(start)
+		switch word {
+		case "async", "export", "default":
+			start = s
+			continue
+		case "return", "typeof", "void", "delete", "new", "throw", "yield", "await",
+			"in", "of", "instanceof", "case", "extends":
+			return false
+		case "":
+		default:
+			// A declaration cannot continue an expression, so the line
+			// break before it ended the previous statement
+			return true
+		}
+		break
+	}
+	p := significantBefore(bt.code, start, bt.literals)
+	return p < 0 || strings.IndexByte(";{})]", bt.code[p]) >= 0 || bt.code[p] == placeholderMark
+}
+
+// significantBefore returns the offset of the last byte of code[:end] that
+// is neither whitespace nor part of a kept comment, or -1 if there is none
+func significantBefore(code string, end int, literals []string) int {
+	for end > 0 {
+		c := code[end-1]
+		switch {
+		case isSpace(c):
+			end--
+		case c == placeholderMark && isComment(placeholderBefore(code, end, literals)):
+			end = strings.LastIndexByte(code[:end-1], placeholderMark)
+		default:
+			return end - 1
+		}
+	}
+	return -1
+}
+
+// significantAfter returns the offset of the first byte of code[start:]
+// that is neither whitespace nor part of a kept comment, or -1 if there is
+// none
+func significantAfter(code string, start int, literals []string) int {
+	for start < len(code) {
+		c := code[start]
+		switch {
+		case isSpace(c):
+			start++
+		case c == placeholderMark && isComment(placeholderAfter(code, start, literals)):
+			start += strings.IndexByte(code[start+1:], placeholderMark) + 2
+		default:
+			return start
+		}
+	}
+	return -1
+}
+
+// isComment reports whether protected text is a comment
+func isComment(text string) bool {
+	return isLineComment(text) || strings.HasPrefix(text, "/*")
+}
+
+// isLineComment reports whether text is a single-line comment, including
+// the HTML-like `<!--` and `-->` comments of scripts
+func isLineComment(text string) bool {
+	return strings.HasPrefix(text, "//") || strings.HasPrefix(text, "<!--") || strings.HasPrefix(text, "-->")
+}
+
+// breaksLine reports whether protected text is a comment spanning a line
+// break, which includes every kept line comment
+func breaksLine(text string) bool {
+	return isComment(text) && strings.ContainsAny(text, "\n\r")
+}
+
+// isSpace reports whether c is an ASCII whitespace character
+func isSpace(c byte) bool {
+	switch c {
+	case ' ', '\t', '\n', '\r', '\f', '\v':
+		return true
+	}
+	return false
 }
 
 // Minify performs the minification process
 func (m *Minifier) Minify() string {
 	debugLog("DEBUG: Minify function called")
+	m.timings = m.timings[:0]
+	m.warnings = m.warnings[:0]
 	result := m.input
 	debugLog("Initial input: %s", result)
 
+	// Drop a UTF-8 byte order mark so that it cannot hide a license
+	// comment or end up glued to the first token
+	result = strings.TrimPrefix(result, byteOrderMark)
+
+	// A #! interpreter line is not JavaScript and must stay the first line
+	var shebang string
+	if strings.HasPrefix(result, "#!") {
+		end := strings.IndexByte(result, '\n')
+		if end < 0 {
+			end = len(result)
+		}
+		shebang = strings.TrimRight(result[:end], "\r") + "\n"
+		result = strings.TrimLeft(result[end:], " \t\r\n")
+	}
+
 	// Preserve license comments if requested
 	var licenseComment string
-	if m.preserveLicense {
-		re := regexp.MustCompile(`^/\*![\s\S]*?\*/`)
-		license := re.FindString(result)
+	if m.opts.PreserveLicense {
+		license := licenseRe.FindString(result)
 		if license != "" {
 			licenseComment = license + "\n"
-			result = re.ReplaceAllString(result, "")
+			result = result[len(license):]
 		}
 	}
 	debugLog("After license preservation: %s", result)
 
-	// Remove single-line comments
-	re := regexp.MustCompile(`//.*`)
-	result = re.ReplaceAllString(result, "")
-	debugLog("After removing single-line comments: %s", result)
-
-	// Remove multi-line comments (except license)
-	re = regexp.MustCompile(`/\*[\s\S]*?\*/`)
-	result = re.ReplaceAllString(result, "")
-	debugLog("After removing multi-line comments: %s", result)
-
-	// Remove whitespace at the beginning and end of lines
-	re = regexp.MustCompile(`^\s+|\s+$`)
-	result = re.ReplaceAllString(result, "")
-	debugLog("After trimming whitespace: %s", result)
+	// Remove comments and protect literals. Literals and kept comments are
+	// swapped for placeholders and restored once all passes are done.
+	var literals []string
+	start := time.Now()
+	skipped := len(m.input) - len(result)
+	result = m.protectLiterals(result, &literals)
+	m.recordPass("remove comments", start)
+	debugLog("After protecting literals: %s", result)
 
-	// Replace multiple spaces with a single space
-	re = regexp.MustCompile(`\s{2,}`)
-	result = re.ReplaceAllString(result, " ")
-	debugLog("After replacing multiple spaces: %s", result)
+	// Minified as JavaScript, JSX would come out broken, so it is returned
+	// unchanged with a warning
+	if m.jsx > 0 {
+		m.warn(skipped+m.jsx-1, jsxMessage)
+		return m.input
+	}
 
-	// Remove spaces around operators
-	operators := []string{`+`, `-`, `*`, `/`, `=`, `<`, `>`, `!`, `?`, `:`, `&`, `|`, `;`, `,`}
-	for _, op := range operators {
-		re = regexp.MustCompile(`\s*` + regexp.QuoteMeta(op) + `\s*`)
-		result = re.ReplaceAllString(result, op)
+	if m.opts.Quote != 0 {
+		start = time.Now()
+		normalizeQuotes(literals, m.opts.Quote)
+		m.recordPass("normalize quotes", start)
 	}
-	debugLog("After fixing operators: %s", result)
+
+	// Remove whitespace around operators, brackets and between lines
+	start = time.Now()
+	result, m.closing = collapseWhitespace(result, collapsiblePunctuation(m.opts.KeepSpacesAround), literals, m.opts.RequiredSpaces)
+	m.recordPass("collapse whitespace", start)
+	debugLog("After collapsing whitespace: %s", result)
 
 	// Remove unnecessary semicolons
-	re = regexp.MustCompile(`;;+`)
-	result = re.ReplaceAllString(result, ";")
+	start = time.Now()
+	result = removeEmptyStatements(result, literals, m.opts.RemoveEmpty)
+	m.recordPass("remove semicolons", start)
 	debugLog("After removing semicolons: %s", result)
 
-	// Remove spaces after function keywords and parentheses
-	re = regexp.MustCompile(`function\s+`)
-	result = re.ReplaceAllString(result, "function ")
-
-	// Fix spaces between function name and parentheses
-	re = regexp.MustCompile(`([a-zA-Z0-9_$])\s*\(`)
-	result = re.ReplaceAllString(result, "$1(")
-	debugLog("After fixing function spacing: %s", result)
-
-	// Remove newlines
-	re = regexp.MustCompile(`\n+`)
-	result = re.ReplaceAllString(result, "")
-	debugLog("After removing newlines: %s", result)
-
-	// Remove spaces after commas
-	re = regexp.MustCompile(`,\s+`)
-	result = re.ReplaceAllString(result, ",")
-
-	// Remove spaces around brackets
-	re = regexp.MustCompile(`\s*{\s*`)
-	result = re.ReplaceAllString(result, "{")
-	re = regexp.MustCompile(`\s*}\s*`)
-	result = re.ReplaceAllString(result, "}")
-	re = regexp.MustCompile(`\s*\[\s*`)
-	result = re.ReplaceAllString(result, "[")
-	re = regexp.MustCompile(`\s*\]\s*`)
-	result = re.ReplaceAllString(result, "]")
-	re = regexp.MustCompile(`\s*\(\s*`)
-	result = re.ReplaceAllString(result, "(")
-	re = regexp.MustCompile(`\s*\)\s*`)
-	result = re.ReplaceAllString(result, ")")
-	debugLog("After removing bracket spaces: %s", result)
-
-	if m.shortenVars {
-		result = m.shortenVariableNames(result)
-		debugLog("After shortening variables: %s", result)
-	}
-
-	if m.preserveLicense && licenseComment != "" {
+	if m.opts.FoldStrings {
+		start = time.Now()
+		result = foldStrings(result, literals)
+		m.recordPass("fold strings", start)
+		debugLog("After folding strings: %s", result)
+	}
+
+	if m.opts.MergeImports {
+		start = time.Now()
+		result = mergeImports(result, literals)
+		m.recordPass("merge imports", start)
+		debugLog("After merging imports: %s", result)
+	}
+
+	if m.opts.ShortenVars {
+		hazards := findMangleHazards(m.input)
+		if hazards.eval >= 0 {
+			m.warn(hazards.eval, evalMessage)
+		} else if m.opts.SafeMangle && hazards.with >= 0 {
+			m.warn(hazards.with, withMessage)
+		} else {
+			start = time.Now()
+			result = m.shortenVariableNames(result, m.opts.SafeMangle && !hazards.module)
+			m.recordPass("shorten variables", start)
+			debugLog("After shortening variables: %s", result)
+		}
+	}
+
+	if m.opts.MangleProps != nil {
+		start = time.Now()
+		result = m.mangleProperties(result)
+		m.recordPass("mangle properties", start)
+		debugLog("After mangling properties: %s", result)
+	}
+
+	if m.opts.Beautify {
+		start = time.Now()
+		result = beautify(result, literals)
+		m.recordPass("beautify", start)
+	} else if m.opts.TopLevelNewlines {
+		start = time.Now()
+		result = topLevelNewlines(result, literals)
+		m.recordPass("top-level newlines", start)
+	}
+	if m.opts.LineWidth > 0 && !m.opts.Beautify {
+		start = time.Now()
+		result = wrapLines(result, literals, m.opts.LineWidth)
+		m.recordPass("wrap lines", start)
+	}
+
+	// Restore literals and kept comments
+	start = time.Now()
+	result = restoreLiterals(result, literals)
+	m.recordPass("restore literals", start)
+
+	if m.opts.Banner {
+		// The percentage describes the code itself; the few bytes of the
+		// banner are still counted by the size statistics
+		result = bannerComment(len(m.input), len(shebang)+len(licenseComment)+len(result)) + result
+	}
+
+	if m.opts.PreserveLicense && licenseComment != "" {
 		result = licenseComment + result
 	}
+	result = shebang + result
+	if m.opts.FinalNewline {
+		result = withFinalNewline(result)
+	}
 
 	debugLog("Final result: %s", result)
 	return result
 }
 
+// MinifyBytes minifies the JavaScript in src, like Minify does for a
+// string, for callers that hold the code as bytes, such as an HTTP body.
+// src is not copied but read in place, so it must not change during the
+// call; the result is a new slice the caller owns. A NUL byte in src is
+// reported as an error, since it could not be told apart from the markers
+// the minifier puts in place of literals.
+func MinifyBytes(src []byte, opts Options) ([]byte, error) {
+	if i := bytes.IndexByte(src, placeholderMark); i >= 0 {
+		return nil, newMinifyError(string(src), i, "unsupported NUL byte")
+	}
+	// The string shares the memory of src, which is only read, and no
+	// reference to it outlives the call
+	input := unsafe.String(unsafe.SliceData(src), len(src))
+	// The result may share memory with input or with a constant when a
+	// pass returns its input unchanged, so it is copied before the
+	// caller gets to write to it
+	return []byte(NewMinifierWithOptions(input, opts).Minify()), nil
+}
+
+// withFinalNewline returns code ending with exactly one newline, or empty
+// code unchanged
+func withFinalNewline(code string) string {
+	code = strings.TrimRight(code, "\r\n")
+	if code == "" {
+		return code
+	}
+	return code + "\n"
+}
+
 // processFile minifies a single JavaScript file
-func processFile(inputPath, outputPath string, preserveLicense, shortenVars bool, stats chan<- MinificationStats) {
+func processFile(inputPath, outputPath string, opts Options, stats chan<- MinificationStats) error {
+	return processFileWith(inputPath, outputPath, opts, nil, stats)
+}
+
+// processFileWith minifies a single file like processFile. JavaScript is
+// minified by inc when it is not nil, reusing its output for statements
+// that are unchanged since the file was last processed.
+func processFileWith(inputPath, outputPath string, opts Options, inc *IncrementalMinifier, stats chan<- MinificationStats) (err error) {
 	debugLog("DEBUG: Processing file: %s", inputPath)
-	
 	start := time.Now()
+	var content []byte
+	defer func() {
+		if err != nil {
+			processMetrics.recordError()
+			// A failed file is reported too, so that the summary of a
+			// batch accounts for every file. Nothing was written, so
+			// only the size of the source is known.
+			stats <- MinificationStats{
+				InputFile:    inputPath,
+				OriginalSize: len(content),
+				ProcessTime:  float64(time.Since(start).Microseconds()) / 1000.0,
+				Error:        err.Error(),
+			}
+		}
+	}()
 
 	// Read input file
-	content, err := ioutil.ReadFile(inputPath)
+	content, err = readSourceFileRetrying(inputPath, opts)
 	if err != nil {
 		debugLog("Error reading input file: %v", err)
-		return
+		if errors.Is(err, errFileTooLarge) {
+			userOutput.Println(err)
+		} else if opts.ReadRetries > 0 {
+			warnf("skipping %s after %d attempts: %v", inputPath, opts.ReadRetries+1, err)
+		}
+		return err
 	}
 	debugLog("File content: %s", string(content))
 
-	minifier := NewMinifier(string(content), preserveLicense, shortenVars)
-	minified := minifier.Minify()
+	if err = checkText(inputPath, content); err != nil {
+		debugLog("Error reading input file: %v", err)
+		userOutput.Println(err)
+		return err
+	}
+
+	if looksMinified(string(content)) {
+		// Renaming is the pass most easily confused by dense code, so
+		// already-minified input is only compacted further
+		if opts.ShortenVars || opts.MangleProps != nil {
+			warnf("%s looks already minified; skipping variable and property renaming", inputPath)
+			opts.ShortenVars = false
+			opts.MangleProps = nil
+			inc = nil
+		} else {
+			warnf("%s looks already minified", inputPath)
+		}
+	}
+
+	var minified string
+	var names map[string]string
+	if hasNoMinifyPragma(string(content)) {
+		debugLog("Skipping %s: marked %s", inputPath, noMinifyPragma)
+		minified = string(content)
+	} else if opts.HTML && isHTMLFile(inputPath) {
+		var warnings []Warning
+		minified, warnings = minifyHTMLScripts(string(content), opts)
+		reportWarnings(inputPath, warnings)
+	} else if at := findTypeScript(string(content)); at >= 0 {
+		err = newFileError(inputPath, string(content), at, typeScriptMessage)
+		userOutput.Println(err)
+		return err
+	} else if inc != nil && inc.incremental() && !opts.Profile {
+		var warnings []Warning
+		minified, warnings = inc.MinifyWithWarnings(string(content))
+		reportWarnings(inputPath, warnings)
+	} else {
+		// Profiling times the passes of a full run, which the
+		// incremental minifier would mostly skip
+		minifier := NewMinifierWithOptions(string(content), opts)
+		var warnings []Warning
+		minified, warnings = minifier.MinifyWithWarnings()
+		reportWarnings(inputPath, warnings)
+		names = minifier.VarMap()
+		if opts.Profile {
+			writeProfile(profileOutput, inputPath, minifier.timings)
+		}
+	}
+
+	if opts.StatsOnly {
+		outputPath = ""
+	} else {
+		if opts.InPlace {
+			outputPath = inputPath
+		} else if outputPath == "" {
+			ext := filepath.Ext(inputPath)
+			outputPath = strings.TrimSuffix(inputPath, ext) + ".min" + ext
+		} else if samePath(inputPath, outputPath) {
+			err = fmt.Errorf("refusing to overwrite input file %s, use -inplace to minify it in place", inputPath)
+			debugLog("Error writing output file: %v", err)
+			return err
+		}
+		if opts.HashNames && !opts.InPlace {
+			// A file already at the hashed path has the same content, so
+			// replacing it needs no -force
+			outputPath = hashedPath(outputPath, minified)
+		} else if err = checkOverwrite(outputPath, opts); err != nil {
+			userOutput.Println(err)
+			return err
+		}
+
+		if opts.InPlace {
+			// The source is about to be replaced, so make sure the result
+			// is at least structurally sound and swap it in atomically. An
+			// unbalanced source is reported at its own position, which is
+			// more useful than one in the minified output.
+			if !isHTMLFile(inputPath) || !opts.HTML {
+				if err = validateOutput(inputPath, string(content), minified); err != nil {
+					debugLog("Error validating output: %v", err)
+					return err
+				}
+			}
+			err = writeFileAtomic(outputPath, []byte(minified))
+		} else {
+			err = ioutil.WriteFile(outputPath, []byte(minified), 0644)
+		}
+		if err == nil && opts.NamesMap && opts.ShortenVars && names != nil {
+			err = writeNamesMap(outputPath, names)
+		}
+		if err != nil {
+			debugLog("Error writing output file: %v", err)
+			return err
+		}
+	}
 
-	if outputPath == "" {
-		ext := filepath.Ext(inputPath)
-		outputPath = strings.TrimSuffix(inputPath, ext) + ".min" + ext
+	stat := MinificationStats{
+		InputFile:    inputPath,
+		OutputFile:   outputPath,
+		OriginalSize: len(content),
+		MinifiedSize: len(minified),
+		ProcessTime:  float64(time.Since(start).Microseconds()) / 1000.0,
+		VarsMangled:  len(names),
 	}
+	if len(content) > 0 {
+		// An empty file would make the reduction NaN, which cannot even
+		// be encoded as JSON
+		stat.Reduction = float64(len(content)-len(minified)) / float64(len(content)) * 100
+	}
+	processMetrics.record(stat)
+	stats <- stat
+	return nil
+}
 
-	err = ioutil.WriteFile(outputPath, []byte(minified), 0644)
+// namesMapPath returns the path of the sidecar file listing the variables
+// renamed in the minified file at outputPath: app.min.js has its names in
+// app.min.names.json
+func namesMapPath(outputPath string) string {
+	return strings.TrimSuffix(outputPath, filepath.Ext(outputPath)) + ".names.json"
+}
+
+// writeNamesMap writes names, mapping original variable names to their
+// shortened replacements, as JSON next to the minified file at outputPath
+func writeNamesMap(outputPath string, names map[string]string) error {
+	data, err := json.MarshalIndent(names, "", "  ")
 	if err != nil {
-		debugLog("Error writing output file: %v", err)
-		return
+		return err
+	}
+	return ioutil.WriteFile(namesMapPath(outputPath), append(data, '\n'), 0644)
+}
+
+// errFileTooLarge is returned for files above the MaxFileSize limit
+var errFileTooLarge = errors.New("file too large")
+
+// readSourceFile reads the file at path, refusing files larger than
+// maxSize bytes before reading them. Every pass copies the whole input, so
+// a huge generated file could otherwise exhaust memory. A maxSize of zero
+// disables the check.
+func readSourceFile(path string, maxSize int64) ([]byte, error) {
+	if maxSize > 0 {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if info.Size() > maxSize {
+			return nil, fmt.Errorf("%s: %w: %d bytes exceeds the limit of %d bytes set by -max-file-size",
+				path, errFileTooLarge, info.Size(), maxSize)
+		}
+	}
+	return readFile(path)
+}
+
+// readFile reads a whole file; tests replace it to simulate read failures
+var readFile = ioutil.ReadFile
+
+// readBackoff is the delay before the first retry of a failed read, which
+// doubles with every further attempt
+var readBackoff = 50 * time.Millisecond
+
+// readSourceFileRetrying reads the file at path like readSourceFile,
+// trying again up to opts.ReadRetries times with a growing delay when
+// reading fails. A file over the size limit is refused immediately.
+func readSourceFileRetrying(path string, opts Options) ([]byte, error) {
+	delay := readBackoff
+	for attempt := 0; ; attempt++ {
+		content, err := readSourceFile(path, opts.MaxFileSize)
+		if err == nil || attempt == opts.ReadRetries || errors.Is(err, errFileTooLarge) {
+			return content, err
+		}
+		debugLog("Retrying %s in %v: %v", path, delay, err)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// checkText reports content read from path that is not source text the
+// minifier can work on: binary data, recognised by a NUL byte, or text in
+// an encoding other than UTF-8, such as Latin-1 or UTF-16. Rewriting such
+// bytes as JavaScript would only produce garbage.
+func checkText(path string, content []byte) error {
+	if i := bytes.IndexByte(content, 0); i >= 0 {
+		return newFileError(path, string(content), i, "binary file: unexpected NUL byte")
+	}
+	if !utf8.Valid(content) {
+		i := 0
+		for i < len(content) {
+			r, size := utf8.DecodeRune(content[i:])
+			if r == utf8.RuneError && size == 1 {
+				break
+			}
+			i += size
+		}
+		return newFileError(path, string(content), i, "invalid UTF-8; source files must be encoded as UTF-8")
+	}
+	return nil
+}
+
+// Thresholds above which input is considered to be minified already
+const (
+	minifiedMinSize    = 512 // bytes; small files are never flagged
+	minifiedLineLength = 500 // average bytes per line
+)
+
+// looksMinified reports whether code appears to be the output of a
+// minifier: a sizeable file whose lines are on average very long
+func looksMinified(code string) bool {
+	if len(code) < minifiedMinSize {
+		return false
+	}
+	lines := strings.Count(strings.TrimRight(code, "\n"), "\n") + 1
+	return len(code)/lines > minifiedLineLength
+}
+
+// Messages for the source files the minifier refuses to minify
+const (
+	jsxMessage            = "JSX is not supported; copying the file unchanged"
+	typeScriptMessage     = "TypeScript is not supported; compile to JS first"
+	bundleJSXMessage      = "JSX is not supported; compile to JS before bundling"
+	bundleNoMinifyMessage = "marked " + noMinifyPragma + ", which a minified bundle cannot keep unchanged"
+)
+
+// noMinifyPragma, in a comment at the top of a file, opts the file out of
+// minification
+const noMinifyPragma = "@no-minify"
+
+// hasNoMinifyPragma reports whether one of the comments that start code,
+// after any byte order mark and #! line, is `// @no-minify` or
+// `/* @no-minify */`
+func hasNoMinifyPragma(code string) bool {
+	code = strings.TrimPrefix(code, byteOrderMark)
+	if strings.HasPrefix(code, "#!") {
+		end := strings.IndexByte(code, '\n')
+		if end < 0 {
+			return false
+		}
+		code = code[end:]
+	}
+	for {
+		code = strings.TrimLeft(code, " \t\r\n")
+		var text string
+		switch {
+		case strings.HasPrefix(code, "//"):
+			end := strings.IndexByte(code, '\n')
+			if end < 0 {
+				end = len(code)
+			}
+			text, code = code[2:end], code[end:]
+		case strings.HasPrefix(code, "/*"):
+			end := strings.Index(code, "*/")
+			if end < 0 {
+				return false
+			}
+			text, code = code[2:end], code[end+2:]
+		default:
+			return false
+		}
+		if strings.TrimSpace(text) == noMinifyPragma {
+			return true
+		}
+	}
+}
+
+// userOutput writes the warnings and errors meant for the user to stderr.
+// The goroutines minifying a directory share it, and a log.Logger writes
+// each message in one piece, so their lines never run into each other.
+var userOutput = log.New(os.Stderr, "", 0)
+
+// warnf prints a warning for the user
+func warnf(format string, args ...interface{}) {
+	userOutput.Printf("warning: "+format, args...)
+}
+
+// reportWarnings prints the warnings from minifying the file at path
+func reportWarnings(path string, warnings []Warning) {
+	for _, w := range warnings {
+		warnf("%s:%v", path, w)
+	}
+}
+
+// minifySource minifies content read from path the way an entry of an
+// archive or a generated Go file is minified: files with the no-minify
+// pragma and JSX files, with a warning, are kept as they are, HTML pages
+// have their inline scripts minified and TypeScript is refused. It returns
+// the number of variable names shortened along with the output.
+func minifySource(path string, content []byte, opts Options) (string, int, error) {
+	if err := checkText(path, content); err != nil {
+		return "", 0, err
+	}
+	code := string(content)
+	if hasNoMinifyPragma(code) {
+		return code, 0, nil
+	} else if isHTMLFile(path) {
+		minified, warnings := minifyHTMLScripts(code, opts)
+		reportWarnings(path, warnings)
+		return minified, 0, nil
+	} else if at := findTypeScript(code); at >= 0 {
+		return "", 0, newFileError(path, code, at, typeScriptMessage)
+	}
+	minifier := NewMinifierWithOptions(code, opts)
+	minified, warnings := minifier.MinifyWithWarnings()
+	reportWarnings(path, warnings)
+	return minified, len(minifier.varMap), nil
+}
+
+// validateOutput checks that the minified output of the file at path, and
+// the source it came from, have balanced brackets and terminated literals.
+// Problems are returned as a *MinifyError naming the file.
+func validateOutput(path, source, minified string) error {
+	if err := checkBalance(source); err != nil {
+		err.File = path
+		return err
+	}
+	if err := checkBalance(minified); err != nil {
+		err.File = path
+		err.Msg = "minified output failed validation: " + err.Msg
+		return err
+	}
+	return nil
+}
+
+// checkOverwrite returns an error when a file already exists at outputPath
+// and opts do not allow replacing it
+func checkOverwrite(outputPath string, opts Options) error {
+	if opts.Force || opts.InPlace {
+		return nil
+	}
+	if _, err := os.Stat(outputPath); err == nil {
+		return fmt.Errorf("output file %s already exists, use -force to overwrite it", outputPath)
+	}
+	return nil
+}
+
+// samePath reports whether two paths refer to the same file
+func samePath(a, b string) bool {
+	absA, errA := filepath.Abs(a)
+	absB, errB := filepath.Abs(b)
+	if errA != nil || errB != nil {
+		return a == b
+	}
+	return absA == absB
+}
+
+// writeFileAtomic replaces the file at path with data by writing a
+// temporary file in the same directory and renaming it over the original,
+// so readers never observe a partially written file. The original file
+// mode is kept.
+func writeFileAtomic(path string, data []byte) error {
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(path); err == nil {
+		mode = info.Mode().Perm()
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), mode); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// listSourceFiles returns the files in dir that should be minified, skipping
+// outputs of previous runs. HTML pages are included when opts.HTML is set,
+// and files matched by the .gitignore in dir are left out when
+// opts.Gitignore is.
+func listSourceFiles(dir string, opts Options) ([]string, error) {
+	patterns := []string{"*.js"}
+	if opts.HTML {
+		patterns = append(patterns, "*.html", "*.htm")
+	}
+	ignore := &gitignore{}
+	if opts.Gitignore {
+		var err error
+		if ignore, err = loadGitignore(dir); err != nil {
+			return nil, err
+		}
 	}
 
-	stats <- MinificationStats{
-		InputFile:     inputPath,
-		OutputFile:    outputPath,
-		OriginalSize:  len(content),
-		MinifiedSize:  len(minified),
-		Reduction:     float64(len(content)-len(minified)) / float64(len(content)) * 100,
-		ProcessTime:   float64(time.Since(start).Microseconds()) / 1000.0,
+	var files []string
+	for _, pattern := range patterns {
+		matches, err := filepath.Glob(filepath.Join(dir, pattern))
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range matches {
+			if isMinifiedName(file) || ignore.ignored(filepath.Base(file), false) {
+				continue
+			}
+			files = append(files, file)
+		}
 	}
+	return files, nil
 }
 
-// watchDirectory monitors a directory for changes and minifies modified files
-func watchDirectory(dir string, preserveLicense, shortenVars bool) {
+// watchDirectory monitors a directory for changes and minifies modified
+// files until stop is closed. Every file counts as modified on the first
+// scan, so the files already in the directory are minified at startup.
+func watchDirectory(dir string, opts Options, stop <-chan struct{}) {
 	fileModTimes := make(map[string]time.Time)
-	
+	minifiers := make(map[string]*IncrementalMinifier)
+	// Rewriting the output of a file each time it changes is the point
+	opts.Force = true
+
 	for {
-		files, err := filepath.Glob(filepath.Join(dir, "*.js"))
+		files, err := listSourceFiles(dir, opts)
 		if err != nil {
 			debugLog("Error scanning directory: %v", err)
-			continue
 		}
 
 		for _, file := range files {
-			if strings.HasSuffix(file, ".min.js") {
-				continue
-			}
-
 			info, err := os.Stat(file)
 			if err != nil {
 				continue
@@ -270,30 +1626,184 @@ func watchDirectory(dir string, preserveLicense, shortenVars bool) {
 			lastMod := fileModTimes[file]
 			if info.ModTime().After(lastMod) {
 				debugLog("Processing modified file: %s", file)
+				if minifiers[file] == nil {
+					minifiers[file] = NewIncrementalMinifier(opts)
+				}
 				stats := make(chan MinificationStats, 1)
-				processFile(file, "", preserveLicense, shortenVars, stats)
+				if err := processFileWith(file, "", opts, minifiers[file], stats); err != nil {
+					fileModTimes[file] = info.ModTime()
+					continue
+				}
 				stat := <-stats
-				debugLog("Reduced by %.2f%% (%d → %d bytes)", 
+				debugLog("Reduced by %.2f%% (%d → %d bytes)",
 					stat.Reduction, stat.OriginalSize, stat.MinifiedSize)
 				fileModTimes[file] = info.ModTime()
 			}
 		}
 
-		time.Sleep(1 * time.Second)
+		select {
+		case <-stop:
+			return
+		case <-time.After(1 * time.Second):
+		}
 	}
 }
 
 func main() {
+	os.Exit(run(os.Args[1:]))
+}
+
+// reportStats logs the statistics of a single processed file
+func reportStats(stat MinificationStats) {
+	if stat.Error != "" {
+		debugLog("Skipped %s: %s", stat.InputFile, stat.Error)
+		return
+	}
+	// The report is logged as one message, so that the lines other files
+	// log meanwhile cannot end up in the middle of it
+	var report strings.Builder
+	fmt.Fprintf(&report, "Processed %s:\n", stat.InputFile)
+	if stat.OutputFile != "" {
+		fmt.Fprintf(&report, "  Output: %s\n", stat.OutputFile)
+	}
+	fmt.Fprintf(&report, "  Reduction: %.2f%% (%d → %d bytes)\n",
+		stat.Reduction, stat.OriginalSize, stat.MinifiedSize)
+	fmt.Fprintf(&report, "  Process time: %.2f ms", stat.ProcessTime)
+	if stat.VarsMangled > 0 {
+		fmt.Fprintf(&report, "\n  Variables shortened: %d", stat.VarsMangled)
+	}
+	debugLog("%s", report.String())
+}
+
+// overBudget returns the files whose minified size exceeds maxSize bytes.
+// A maxSize of zero disables the check.
+func overBudget(stats []MinificationStats, maxSize int) []MinificationStats {
+	if maxSize <= 0 {
+		return nil
+	}
+	var over []MinificationStats
+	for _, stat := range stats {
+		if stat.MinifiedSize > maxSize {
+			over = append(over, stat)
+		}
+	}
+	return over
+}
+
+// batchReadRetries is ReadRetries for directory, watch and -files-from runs
+const batchReadRetries = 2
+
+// run executes the command line tool with the given arguments and returns
+// the process exit code
+func run(args []string) int {
 	// Explicitly write to stderr
 	debugLog("DEBUG: Minification process started")
-	
-	input := flag.String("input", "", "Input JavaScript file or directory")
-	output := flag.String("output", "", "Output file or directory")
-	preserveLicense := flag.Bool("preserve-license", false, "Preserve license comments")
-	shortenVars := flag.Bool("shorten-vars", false, "Shorten variable names")
-	jsonOutput := flag.Bool("json", false, "Output statistics in JSON format")
-	watchMode := flag.Bool("watch", false, "Watch directory for changes")
-	flag.Parse()
+
+	// `js-minifier generate ...` writes a Go file instead of minified
+	// JavaScript, and otherwise takes the same flags
+	generate := len(args) > 0 && args[0] == "generate"
+	if generate {
+		args = args[1:]
+	}
+
+	flags := flag.NewFlagSet("js-minifier", flag.ContinueOnError)
+	input := flags.String("input", "", "Input JavaScript file or directory")
+	output := flags.String("output", "", "Output file or directory")
+	preserveLicense := flags.Bool("preserve-license", false, "Preserve license comments")
+	shortenVars := flags.Bool("shorten-vars", false, "Shorten variable names")
+	jsonOutput := flags.Bool("json", false, "Output statistics in JSON format")
+	watchMode := flags.Bool("watch", false, "Watch directory for changes")
+	keepLineComments := flags.Bool("keep-line-comments", false, "Keep single-line (//) comments")
+	keepBlockComments := flags.Bool("keep-block-comments", false, "Keep multi-line (/* */) comments")
+	preserveJSDoc := flags.Bool("preserve-jsdoc", false, "Preserve /** */ JSDoc comments that precede declarations")
+	keepSpacesAround := flags.String("keep-spaces-around", "", "Operator characters whose surrounding spaces are kept, e.g. \"+-\"")
+	banner := flags.Bool("banner", false, "Prepend a comment stating the size reduction")
+	html := flags.Bool("html", false, "Also process .html files, minifying their inline <script> blocks")
+	statsOnly := flags.Bool("stats-only", false, "Report size reduction without writing minified files")
+	inPlace := flags.Bool("inplace", false, "Overwrite source files with their minified output")
+	maxSize := flags.Int("max-size", 0, "Exit non-zero if any minified file exceeds this many bytes")
+	preset := flags.String("preset", "balanced", "Option preset: conservative, balanced, aggressive or terser-like")
+	comments := flags.String("comments", "", "Comment policy: all, some (license comments only) or none; overrides the other comment flags")
+	maxFileSize := flags.Int64("max-file-size", 0, "Refuse input files larger than this many bytes (0 for no limit)")
+	mergeImports := flags.Bool("merge-imports", false, "Combine import declarations that load the same module")
+	bundle := flags.String("bundle", "", "Concatenate the input files given as arguments and minify them into this file")
+	mangleProps := flags.String("mangle-props", "", "Rename object properties whose names match this regular expression, e.g. \"^_\"")
+	serve := flags.String("serve", "", "Keep running and minify the JavaScript POSTed over HTTP to this address, e.g. \"127.0.0.1:9200\"")
+	metricsAddr := flags.String("metrics-addr", "", "Serve processing metrics over HTTP at this address, e.g. \":9100\"")
+	profile := flags.Bool("profile", false, "Print how long each minification pass takes to stderr")
+	filesFrom := flags.String("files-from", "", "Minify the files listed, one per line, in this file (\"-\" for standard input)")
+	outputFormat := flags.String("output-format", "min", "Output layout: min, or beautify for indented code with one statement per line")
+	namesMap := flags.Bool("names-map", false, "With -shorten-vars, write the original and shortened variable names to a .names.json file next to each output")
+	keepPure := flags.Bool("keep-pure", false, "Keep /*#__PURE__*/ and /*#__NO_SIDE_EFFECTS__*/ annotations for a later bundler")
+	orderedOutput := flags.Bool("concurrency-safe-output", false, "Report the files of a directory in the order they are listed, not the order they finish")
+	frequencyNames := flags.Bool("frequency-names", false, "With -shorten-vars, give the shortest names to the most used variables")
+	finalNewline := flags.Bool("final-newline", false, "End the minified output with a single newline")
+	useGitignore := flags.Bool("gitignore", false, "Skip files matched by the .gitignore of the input directory; those of parent directories are not read")
+	quotes := flags.String("quotes", "keep", "Quotes for string literals: keep, or single or double wherever that adds no escapes")
+	topLevelNewlines := flags.Bool("top-level-newlines", false, "Put each top-level statement on its own line")
+	manifest := flags.String("manifest", "", "Put a hash of the content in output file names, as in app.min.3f2a9c1e.js, and write a JSON manifest mapping each input to its output to this path")
+	emitReport := flags.String("emit-report", "", "Write an HTML report of the original, minified and gzip sizes of each file to this path")
+	lineWidth := flags.Int("line-width", 0, "Break lines of minified output longer than this many bytes at safe places (default 0, no limit)")
+	foldStrings := flags.Bool("fold-strings", false, "Join string literals added to each other, e.g. \"a\" + \"b\" becomes \"ab\"")
+	force := flags.Bool("force", false, "Overwrite output files that already exist")
+	goOutput := flags.String("out", "", "With generate, the Go file to write the minified code to as string constants")
+	goPackage := flags.String("package", os.Getenv("GOPACKAGE"), "With generate, the package of the Go file (default $GOPACKAGE, set by go generate, or main)")
+	requiredSpaces := flags.Bool("required-spaces", false, "Remove every space the grammar does not need, including those next to literals")
+	safeMangle := flags.Bool("safe-mangle", false, "Shorten only the variables that cannot be seen outside the file, skipping files where that is uncertain")
+	removeEmpty := flags.Bool("remove-empty", false, "Remove empty statements and empty blocks, such as if(x){} becoming if(x);")
+	keepSourceMap := flags.Bool("keep-source-map-url", false, "Keep existing //# sourceMappingURL= comments")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	// The preset comes first and the flags given on the command line,
+	// which flags.Visit lists, are applied over it, so that a flag can
+	// turn off what the preset turned on
+	opts := DefaultOptions()
+	if err := applyPreset(&opts, *preset); err != nil {
+		debugLog("Invalid -preset value: %v", err)
+		return 1
+	}
+	flagOptions := map[string]func(){
+		"preserve-license":        func() { opts.PreserveLicense = *preserveLicense },
+		"shorten-vars":            func() { opts.ShortenVars = *shortenVars },
+		"keep-line-comments":      func() { opts.StripLineComments = !*keepLineComments },
+		"keep-block-comments":     func() { opts.StripBlockComments = !*keepBlockComments },
+		"preserve-jsdoc":          func() { opts.PreserveJSDoc = *preserveJSDoc },
+		"keep-spaces-around":      func() { opts.KeepSpacesAround = *keepSpacesAround },
+		"banner":                  func() { opts.Banner = *banner },
+		"html":                    func() { opts.HTML = *html },
+		"stats-only":              func() { opts.StatsOnly = *statsOnly },
+		"inplace":                 func() { opts.InPlace = *inPlace },
+		"merge-imports":           func() { opts.MergeImports = *mergeImports },
+		"max-file-size":           func() { opts.MaxFileSize = *maxFileSize },
+		"profile":                 func() { opts.Profile = *profile },
+		"keep-source-map-url":     func() { opts.KeepSourceMappingURL = *keepSourceMap },
+		"top-level-newlines":      func() { opts.TopLevelNewlines = *topLevelNewlines },
+		"remove-empty":            func() { opts.RemoveEmpty = *removeEmpty },
+		"required-spaces":         func() { opts.RequiredSpaces = *requiredSpaces },
+		"force":                   func() { opts.Force = *force },
+		"fold-strings":            func() { opts.FoldStrings = *foldStrings },
+		"line-width":              func() { opts.LineWidth = *lineWidth },
+		"names-map":               func() { opts.NamesMap = *namesMap },
+		"gitignore":               func() { opts.Gitignore = *useGitignore },
+		"final-newline":           func() { opts.FinalNewline = *finalNewline },
+		"frequency-names":         func() { opts.FrequencyNames = *frequencyNames },
+		"concurrency-safe-output": func() { opts.OrderedOutput = *orderedOutput },
+		"keep-pure":               func() { opts.KeepPureAnnotations = *keepPure },
+		"safe-mangle": func() {
+			opts.SafeMangle = *safeMangle
+			if *safeMangle {
+				opts.ShortenVars = true
+			}
+		},
+	}
+	flags.Visit(func(f *flag.Flag) {
+		if apply, ok := flagOptions[f.Name]; ok {
+			apply()
+		}
+	})
+	opts.HashNames = *manifest != ""
 
 	// Debug: Print all flags and their values directly to stderr
 	debugLog("DEBUG: Input: %s", *input)
@@ -302,80 +1812,395 @@ func main() {
 	debugLog("DEBUG: Shorten Vars: %v", *shortenVars)
 	debugLog("DEBUG: JSON Output: %v", *jsonOutput)
 	debugLog("DEBUG: Watch Mode: %v", *watchMode)
+	debugLog("DEBUG: Keep Line Comments: %v", *keepLineComments)
+	debugLog("DEBUG: Keep Block Comments: %v", *keepBlockComments)
+	debugLog("DEBUG: Preserve JSDoc: %v", *preserveJSDoc)
+	debugLog("DEBUG: Keep Spaces Around: %s", *keepSpacesAround)
+	debugLog("DEBUG: Banner: %v", *banner)
+	debugLog("DEBUG: HTML: %v", *html)
+	debugLog("DEBUG: Stats Only: %v", *statsOnly)
+	debugLog("DEBUG: In Place: %v", *inPlace)
+	debugLog("DEBUG: Max Size: %d", *maxSize)
+	debugLog("DEBUG: Preset: %s", *preset)
+	debugLog("DEBUG: Comments: %s", *comments)
+	debugLog("DEBUG: Max File Size: %d", *maxFileSize)
+	debugLog("DEBUG: Merge Imports: %v", *mergeImports)
+	debugLog("DEBUG: Bundle: %s", *bundle)
+	debugLog("DEBUG: Mangle Props: %s", *mangleProps)
+	debugLog("DEBUG: Metrics Address: %s", *metricsAddr)
+	debugLog("DEBUG: Serve: %s", *serve)
+	debugLog("DEBUG: Profile: %v", *profile)
+	debugLog("DEBUG: Keep Source Map URL: %v", *keepSourceMap)
+	debugLog("DEBUG: Output Format: %s", *outputFormat)
+	debugLog("DEBUG: Files From: %s", *filesFrom)
+	debugLog("DEBUG: Top-Level Newlines: %v", *topLevelNewlines)
+	debugLog("DEBUG: Names Map: %v", *namesMap)
+	debugLog("DEBUG: Quotes: %s", *quotes)
+	debugLog("DEBUG: Gitignore: %v", *useGitignore)
+	debugLog("DEBUG: Final Newline: %v", *finalNewline)
+	debugLog("DEBUG: Frequency Names: %v", *frequencyNames)
+	debugLog("DEBUG: Keep Pure: %v", *keepPure)
+	debugLog("DEBUG: Ordered Output: %v", *orderedOutput)
+	debugLog("DEBUG: Emit Report: %s", *emitReport)
+	debugLog("DEBUG: Manifest: %s", *manifest)
+	debugLog("DEBUG: Remove Empty: %v", *removeEmpty)
+	debugLog("DEBUG: Safe Mangle: %v", *safeMangle)
+	debugLog("DEBUG: Required Spaces: %v", *requiredSpaces)
+	debugLog("DEBUG: Generate: %v", generate)
+	debugLog("DEBUG: Force: %v", *force)
+	debugLog("DEBUG: Fold Strings: %v", *foldStrings)
+	debugLog("DEBUG: Line Width: %d", *lineWidth)
+
+	switch *outputFormat {
+	case "min":
+	case "beautify":
+		opts.Beautify = true
+	default:
+		debugLog("Invalid -output-format value %q, expected min or beautify", *outputFormat)
+		return 1
+	}
+
+	quote, err := parseQuoteStyle(*quotes)
+	if err != nil {
+		debugLog("Invalid -quotes value: %v", err)
+		return 1
+	}
+	opts.Quote = quote
+
+	if *comments != "" {
+		if err := applyCommentPolicy(&opts, *comments); err != nil {
+			debugLog("Invalid -comments value: %v", err)
+			return 1
+		}
+	}
+
+	if *mangleProps != "" {
+		filter, err := regexp.Compile(*mangleProps)
+		if err != nil {
+			debugLog("Invalid -mangle-props filter: %v", err)
+			return 1
+		}
+		opts.MangleProps = filter
+	}
+
+	if generate {
+		pkg := *goPackage
+		if pkg == "" {
+			pkg = "main"
+		}
+		return runGenerate(*input, *goOutput, pkg, opts, *jsonOutput, *maxSize)
+	}
+
+	if *bundle != "" {
+		return runBundle(*bundle, flags.Args(), opts, *jsonOutput, *maxSize)
+	}
+
+	if *serve != "" {
+		if *input != "" || *filesFrom != "" || *watchMode || *inPlace {
+			debugLog("The -serve flag cannot be combined with -input, -files-from, -watch or -inplace")
+			return 1
+		}
+		return runServe(*serve, opts, nil)
+	}
 
-	if *input == "" {
+	if *input == "" && *filesFrom == "" {
 		debugLog("Please provide an input file or directory using -input flag")
-		return
+		return 1
+	}
+
+	if *inPlace && (*watchMode || *output != "") {
+		debugLog("The -inplace flag cannot be combined with -watch or -output")
+		return 1
+	}
+
+	if *manifest != "" && (*inPlace || *watchMode || archiveExt(*input) != "") {
+		debugLog("The -manifest flag cannot be combined with -inplace, -watch or an archive")
+		return 1
+	}
+
+	if *filesFrom != "" && (*input != "" || *output != "" || *watchMode) {
+		debugLog("The -files-from flag cannot be combined with -input, -output or -watch")
+		return 1
+	}
+
+	if *metricsAddr != "" {
+		ln, err := startMetricsServer(*metricsAddr)
+		if err != nil {
+			debugLog("Error starting metrics server: %v", err)
+			return 1
+		}
+		defer ln.Close()
+		debugLog("Serving metrics on http://%s/metrics", ln.Addr())
+	}
+
+	// Files in a batch may be in the middle of being saved, so reads are
+	// retried before a file is skipped
+	opts.ReadRetries = batchReadRetries
+
+	if *filesFrom != "" {
+		files, err := readFileList(*filesFrom)
+		if err != nil {
+			debugLog("Error reading file list: %v", err)
+			return 1
+		}
+		return finishRun(processFiles(files, opts, *jsonOutput), *maxSize, *emitReport, *manifest)
 	}
 
 	fileInfo, err := os.Stat(*input)
 	if err != nil {
 		debugLog("Error accessing input path: %v", err)
-		return
+		return 1
 	}
 
+	var allStats []MinificationStats
 	if fileInfo.IsDir() {
 		if *watchMode {
 			debugLog("Watching directory: %s", *input)
-			watchDirectory(*input, *preserveLicense, *shortenVars)
-		} else {
-			files, err := filepath.Glob(filepath.Join(*input, "*.js"))
-			if err != nil {
-				debugLog("Error scanning directory: %v", err)
-				return
-			}
-
-			var wg sync.WaitGroup
-			stats := make(chan MinificationStats, len(files))
-
-			for _, file := range files {
-				if strings.HasSuffix(file, ".min.js") {
-					continue
-				}
-
-				wg.Add(1)
-				go func(file string) {
-					defer wg.Done()
-					processFile(file, "", *preserveLicense, *shortenVars, stats)
-				}(file)
-			}
-
-			go func() {
-				wg.Wait()
-				close(stats)
-			}()
-
-			var allStats []MinificationStats
-			for stat := range stats {
-				allStats = append(allStats, stat)
-				if !*jsonOutput {
-					debugLog("Processed %s:", stat.InputFile)
-					debugLog("  Output: %s", stat.OutputFile)
-					debugLog("  Reduction: %.2f%% (%d → %d bytes)", 
-						stat.Reduction, stat.OriginalSize, stat.MinifiedSize)
-					debugLog("  Process time: %.2f ms", stat.ProcessTime)
-				}
-			}
+			watchDirectory(*input, opts, nil)
+			return 0
+		}
 
-			if *jsonOutput {
-				jsonStats, _ := json.MarshalIndent(allStats, "", "  ")
-				debugLog("%s", string(jsonStats))
-			}
+		files, err := listSourceFiles(*input, opts)
+		if err != nil {
+			debugLog("Error scanning directory: %v", err)
+			return 1
 		}
+		allStats = processFiles(files, opts, *jsonOutput)
+	} else if archiveExt(*input) != "" {
+		return runArchive(*input, *output, opts, *jsonOutput, *maxSize)
 	} else {
+		opts.ReadRetries = 0
 		stats := make(chan MinificationStats, 1)
-		processFile(*input, *output, *preserveLicense, *shortenVars, stats)
+		if err := processFile(*input, *output, opts, stats); err != nil {
+			return 1
+		}
 		stat := <-stats
+		allStats = append(allStats, stat)
 
 		if *jsonOutput {
 			jsonStats, _ := json.MarshalIndent(stat, "", "  ")
 			debugLog("%s", string(jsonStats))
 		} else {
-			debugLog("Processed %s:", stat.InputFile)
-			debugLog("  Output: %s", stat.OutputFile)
-			debugLog("  Reduction: %.2f%% (%d → %d bytes)", 
-				stat.Reduction, stat.OriginalSize, stat.MinifiedSize)
-			debugLog("  Process time: %.2f ms", stat.ProcessTime)
+			reportStats(stat)
+		}
+	}
+
+	return finishRun(allStats, *maxSize, *emitReport, *manifest)
+}
+
+// finishRun writes the HTML report of stats to reportPath and their
+// manifest to manifestPath, unless those are empty, and returns the exit
+// code for the run, which fails when a file could not be minified or is
+// over budget
+func finishRun(stats []MinificationStats, maxSize int, reportPath, manifestPath string) int {
+	if reportPath != "" {
+		if err := writeHTMLReport(reportPath, stats); err != nil {
+			userOutput.Printf("writing report: %v", err)
+			return 1
+		}
+	}
+	if manifestPath != "" {
+		if err := writeManifest(manifestPath, stats); err != nil {
+			userOutput.Printf("writing manifest: %v", err)
+			return 1
+		}
+	}
+	code := reportFailures(stats)
+	if checkBudget(stats, maxSize) != 0 {
+		code = 1
+	}
+	return code
+}
+
+// reportFailures lists the files of stats that could not be minified, with
+// the reasons, after a line counting them, and returns the exit code for
+// the run
+func reportFailures(stats []MinificationStats) int {
+	var failed []MinificationStats
+	for _, stat := range stats {
+		if stat.Error != "" {
+			failed = append(failed, stat)
+		}
+	}
+	if len(failed) == 0 {
+		return 0
+	}
+	var summary strings.Builder
+	fmt.Fprintf(&summary, "%d of %d files failed:", len(failed), len(stats))
+	for _, stat := range failed {
+		if strings.Contains(stat.Error, stat.InputFile) {
+			// Most errors name the file already
+			fmt.Fprintf(&summary, "\n  %s", stat.Error)
+		} else {
+			fmt.Fprintf(&summary, "\n  %s: %s", stat.InputFile, stat.Error)
+		}
+	}
+	userOutput.Println(summary.String())
+	return 1
+}
+
+// processWorkers is the number of files processFiles minifies at a time
+var processWorkers = runtime.NumCPU()
+
+// indexedStat is the statistics of the file at index in the list given to
+// processFiles
+type indexedStat struct {
+	index int
+	stat  MinificationStats
+}
+
+// processFiles minifies files concurrently, next to their sources, and
+// reports their statistics
+func processFiles(files []string, opts Options, jsonOutput bool) []MinificationStats {
+	// A fixed number of workers minify the files and report to a channel
+	// no larger than the pool, so that neither the goroutines nor the
+	// buffered statistics grow with the number of files
+	jobs := make(chan int)
+	stats := make(chan indexedStat, processWorkers)
+	var wg sync.WaitGroup
+	for w := 0; w < processWorkers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results := make(chan MinificationStats, 1)
+			for i := range jobs {
+				processFile(files[i], "", opts, results)
+				stats <- indexedStat{i, <-results}
+			}
+		}()
+	}
+	go func() {
+		for i := range files {
+			jobs <- i
+		}
+		close(jobs)
+		wg.Wait()
+		close(stats)
+	}()
+
+	var allStats []MinificationStats
+	var original, minified, failed int
+	report := func(stat MinificationStats) {
+		allStats = append(allStats, stat)
+		if stat.Error != "" {
+			failed++
+		} else {
+			original += stat.OriginalSize
+			minified += stat.MinifiedSize
+		}
+		if !jsonOutput {
+			reportStats(stat)
+		}
+	}
+
+	// With OrderedOutput a file is reported once all the files listed
+	// before it are; until then it waits in pending
+	pending := make(map[int]MinificationStats)
+	next := 0
+	for s := range stats {
+		if !opts.OrderedOutput {
+			report(s.stat)
+			continue
+		}
+		pending[s.index] = s.stat
+		for stat, ok := pending[next]; ok; stat, ok = pending[next] {
+			delete(pending, next)
+			report(stat)
+			next++
+		}
+	}
+
+	if jsonOutput {
+		jsonStats, _ := json.MarshalIndent(allStats, "", "  ")
+		debugLog("%s", string(jsonStats))
+	} else if opts.StatsOnly && original > 0 {
+		debugLog("Total: %.2f%% (%d → %d bytes) across %d files, %d failed",
+			float64(original-minified)/float64(original)*100, original, minified, len(allStats)-failed, failed)
+	}
+	return allStats
+}
+
+// readFileList reads the newline-separated paths listed in the file at
+// path, or on standard input if path is "-". Blank lines are skipped.
+func readFileList(path string) ([]string, error) {
+	var content []byte
+	var err error
+	if path == "-" {
+		content, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		content, err = ioutil.ReadFile(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, line := range strings.Split(string(content), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			files = append(files, line)
+		}
+	}
+	return files, nil
+}
+
+// checkBudget reports the files whose minified size exceeds maxSize and
+// returns the exit code for the run
+func checkBudget(stats []MinificationStats, maxSize int) int {
+	if over := overBudget(stats, maxSize); len(over) > 0 {
+		for _, stat := range over {
+			userOutput.Printf("%s: minified size %d bytes exceeds budget of %d bytes",
+				stat.InputFile, stat.MinifiedSize, maxSize)
+		}
+		return 1
+	}
+	return 0
+}
+
+// runArchive handles a .zip or .tar.gz archive given as -input
+func runArchive(inputPath, outputPath string, opts Options, jsonOutput bool, maxSize int) int {
+	if opts.InPlace {
+		debugLog("The -inplace flag cannot be used with an archive")
+		return 1
+	}
+	stat, err := minifyArchive(inputPath, outputPath, opts)
+	if err != nil {
+		userOutput.Println(err)
+		return 1
+	}
+	if jsonOutput {
+		jsonStats, _ := json.MarshalIndent(stat, "", "  ")
+		debugLog("%s", string(jsonStats))
+	} else {
+		reportStats(stat)
+	}
+	return checkBudget([]MinificationStats{stat}, maxSize)
+}
+
+// runBundle handles the -bundle mode of run
+func runBundle(outputPath string, inputPaths []string, opts Options, jsonOutput bool, maxSize int) int {
+	if len(inputPaths) == 0 {
+		debugLog("Please list the files to bundle after the flags")
+		return 1
+	}
+	if opts.InPlace {
+		debugLog("The -inplace flag cannot be combined with -bundle")
+		return 1
+	}
+	for _, path := range inputPaths {
+		if samePath(path, outputPath) {
+			debugLog("refusing to overwrite input file %s with the bundle", path)
+			return 1
 		}
 	}
+
+	stat, err := bundleFiles(inputPaths, outputPath, opts)
+	if err != nil {
+		return 1
+	}
+	if jsonOutput {
+		jsonStats, _ := json.MarshalIndent(stat, "", "  ")
+		debugLog("%s", string(jsonStats))
+	} else {
+		reportStats(stat)
+	}
+	return checkBudget([]MinificationStats{stat}, maxSize)
 }
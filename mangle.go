@@ -0,0 +1,906 @@
+package main
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// jsKeywords lists reserved words, which are never renamed or generated
+var jsKeywords = map[string]bool{
+	"await": true, "break": true, "case": true, "catch": true, "class": true,
+	"const": true, "continue": true, "debugger": true, "default": true,
+	"delete": true, "do": true, "else": true, "enum": true, "export": true,
+	"extends": true, "false": true, "finally": true, "for": true,
+	"function": true, "if": true, "import": true, "in": true,
+	"instanceof": true, "let": true, "new": true, "null": true, "of": true,
+	"return": true, "super": true, "switch": true, "this": true,
+	"throw": true, "true": true, "try": true, "typeof": true, "var": true,
+	"void": true, "while": true, "with": true, "yield": true,
+	"undefined": true, "arguments": true, "eval": true,
+}
+
+// Kinds of token produced by tokenize
+const (
+	tokSpace   = iota // run of whitespace
+	tokWord           // identifier, keyword or number
+	tokLiteral        // placeholder for a protected literal or comment
+	tokPunct          // punctuator
+)
+
+// token is a lexical unit of code whose literals have been protected
+type token struct {
+	kind int
+	text string
+}
+
+// tokenize splits protected code into tokens. Punctuators are single
+// bytes apart from `...`, `=>` and `?.`, which the mangler needs to tell
+// apart from their one-byte prefixes. A numeric literal, such as `1.5e-3`,
+// `.5`, `0xFF` or `123n`, is a single word token.
+func tokenize(code string) []token {
+	var tokens []token
+	for i := 0; i < len(code); {
+		start := i
+		c := code[i]
+		kind := tokPunct
+		switch {
+		case isSpace(c):
+			kind = tokSpace
+			for i < len(code) && isSpace(code[i]) {
+				i++
+			}
+		case c == placeholderMark:
+			kind = tokLiteral
+			if end := strings.IndexByte(code[i+1:], placeholderMark); end >= 0 {
+				i += end + 2
+			} else {
+				i = len(code)
+			}
+		case c >= '0' && c <= '9' || c == '.' && i+1 < len(code) && code[i+1] >= '0' && code[i+1] <= '9':
+			kind = tokWord
+			i = numberEnd(code, i)
+		case isWordByte(c):
+			kind = tokWord
+			for i < len(code) && isWordByte(code[i]) {
+				i++
+			}
+		case strings.HasPrefix(code[i:], "..."):
+			i += 3
+		case strings.HasPrefix(code[i:], "=>"):
+			i += 2
+		case strings.HasPrefix(code[i:], "?.") && (i+2 >= len(code) || code[i+2] < '0' || code[i+2] > '9'):
+			i += 2
+		default:
+			i++
+		}
+		tokens = append(tokens, token{kind: kind, text: code[start:i]})
+	}
+	return tokens
+}
+
+// numberEnd returns the offset just past the numeric literal starting at i.
+// Decimal literals may have a fraction and a signed exponent; the digits of
+// hexadecimal, octal and binary literals and the n of a BigInt are word
+// bytes like any other.
+func numberEnd(code string, i int) int {
+	decimal := !(code[i] == '0' && i+1 < len(code) && strings.IndexByte("xXoObB", code[i+1]) >= 0)
+	dot, exponent := false, false
+	for i < len(code) {
+		c := code[i]
+		switch {
+		case decimal && !exponent && (c == 'e' || c == 'E'):
+			exponent = true
+			i++
+			if i < len(code) && (code[i] == '+' || code[i] == '-') {
+				i++
+			}
+		case isWordByte(c):
+			i++
+		case c == '.' && decimal && !dot && !exponent:
+			dot = true
+			i++
+		default:
+			return i
+		}
+	}
+	return i
+}
+
+// isNumber reports whether a word token is a numeric literal
+func isNumber(word string) bool {
+	return word[0] >= '0' && word[0] <= '9' || word[0] == '.'
+}
+
+// Roles an identifier token can play, as far as renaming is concerned
+const (
+	roleReference  = iota // binding or reference: renamed
+	roleProperty          // property name after `.`, object key or class member: kept
+	roleShorthand         // shorthand property `{name}`: expanded to `{name:short}`
+	roleModifier          // get, set, async or static before a member name: kept
+	roleModuleName        // name in an import or export clause: kept
+)
+
+// Kinds of bracket tracked while classifying identifiers
+const (
+	ctxParen = iota
+	ctxBracket
+	ctxBlock
+	ctxObject
+	ctxClass
+	ctxModuleList // braces of an import or export clause
+)
+
+// bracketContext is an open bracket together with the number of `?` of
+// ternaries inside it that still await their `:`
+type bracketContext struct {
+	kind     int
+	ternary  int
+	modifier bool // a member modifier such as `get` or `static` precedes
+}
+
+// span is a range of significant token positions, both ends included
+type span struct{ from, to int }
+
+// contains reports whether position p lies within the span
+func (s span) contains(p int) bool {
+	return s.from <= p && p <= s.to
+}
+
+// mangler renames declared variables and parameters consistently across a
+// piece of protected code. Every occurrence of a name is renamed the same
+// way regardless of scope, which preserves meaning as long as the new names
+// never clash with any identifier already in the code, and as long as each
+// occurrence lies within the scope of one of the name's declarations.
+type mangler struct {
+	tokens []token
+	sig    []int // indexes of the non-space tokens
+
+	declared []string        // names to rename, in order of first declaration
+	seen     map[string]bool // names already added to declared
+	excluded map[string]bool // names that must keep their original spelling
+
+	// scopes holds, for each name to rename, the spans in which its
+	// declarations are visible; scope is that of the declarations being
+	// collected
+	scopes map[string][]span
+	scope  span
+
+	roleCache map[int]int // roles, once computed
+	matches   []int       // closing bracket positions, once computed
+
+	// expressionEnds holds, for each position skipExpression has passed,
+	// one more than the position it returned
+	expressionEnds []int
+
+	// colonEndsTernary records whether the last `:` separated the branches
+	// of a conditional expression, after which a `{` opens an object
+	colonEndsTernary bool
+}
+
+// newMangler tokenizes code and collects the names declared in it
+func newMangler(code string) *mangler {
+	mg := &mangler{
+		tokens:   tokenize(code),
+		seen:     make(map[string]bool),
+		excluded: make(map[string]bool),
+		scopes:   make(map[string][]span),
+	}
+	for i, t := range mg.tokens {
+		if t.kind != tokSpace {
+			mg.sig = append(mg.sig, i)
+		}
+	}
+	mg.collect()
+	mg.excludeOutOfScope()
+	return mg
+}
+
+// excludeOutOfScope excludes every name that also occurs outside the scopes
+// of its declarations. Such an occurrence refers to another variable, most
+// likely a global, such as a use of `i` after a block declaring `let i`.
+func (mg *mangler) excludeOutOfScope() {
+	roles := mg.roles()
+	for p, i := range mg.sig {
+		t := mg.tokens[i]
+		if t.kind != tokWord || mg.excluded[t.text] || !mg.seen[t.text] {
+			continue
+		}
+		if role := roles[i]; role != roleReference && role != roleShorthand {
+			continue
+		}
+		inScope := false
+		for _, s := range mg.scopes[t.text] {
+			if s.contains(p) {
+				inScope = true
+				break
+			}
+		}
+		if !inScope {
+			mg.excluded[t.text] = true
+		}
+	}
+}
+
+// excludeTopLevel excludes the names declared at the top level of the
+// code, which in a script are global variables
+func (mg *mangler) excludeTopLevel() {
+	program := span{0, len(mg.sig) - 1}
+	for name, scopes := range mg.scopes {
+		for _, s := range scopes {
+			if s == program {
+				mg.excluded[name] = true
+			}
+		}
+	}
+}
+
+// tok returns the significant token at position p, or an empty token past
+// either end
+func (mg *mangler) tok(p int) token {
+	if p < 0 || p >= len(mg.sig) {
+		return token{kind: tokSpace}
+	}
+	return mg.tokens[mg.sig[p]]
+}
+
+// is reports whether the significant token at p is the punctuator or word s
+func (mg *mangler) is(p int, s string) bool {
+	t := mg.tok(p)
+	return t.kind != tokSpace && t.text == s
+}
+
+// isName reports whether the significant token at p is an identifier that
+// could be a binding
+func (mg *mangler) isName(p int) bool {
+	t := mg.tok(p)
+	return t.kind == tokWord && !jsKeywords[t.text] && !isNumber(t.text)
+}
+
+// newlineBefore reports whether a line break separates the significant
+// token at p from the one before it
+func (mg *mangler) newlineBefore(p int) bool {
+	if p <= 0 || p >= len(mg.sig) {
+		return false
+	}
+	for i := mg.sig[p-1] + 1; i < mg.sig[p]; i++ {
+		if strings.Contains(mg.tokens[i].text, "\n") {
+			return true
+		}
+	}
+	return false
+}
+
+// matching returns the position of the bracket closing the one at p, or
+// the end of the code when it is never closed. The positions are found in
+// one pass the first time, since looking for them from each bracket again
+// would take quadratic time on deeply nested code.
+func (mg *mangler) matching(p int) int {
+	if mg.matches == nil {
+		mg.matches = mg.closingBrackets(len(mg.sig))
+	}
+	return mg.matches[p]
+}
+
+// opening returns the position of the bracket opening the one closed at p
+func (mg *mangler) opening(p int) int {
+	depth := 0
+	for ; p >= 0; p-- {
+		switch mg.tok(p).text {
+		case ")", "]", "}":
+			depth++
+		case "(", "[", "{":
+			depth--
+			if depth == 0 {
+				return p
+			}
+		}
+	}
+	return -1
+}
+
+// endsDecorator reports whether the significant token at p ends a
+// decorator such as `@sealed`, `@ns.log` or `@enumerable(false)`
+func (mg *mangler) endsDecorator(p int) bool {
+	if mg.is(p, ")") {
+		p = mg.opening(p) - 1
+	}
+	for mg.tok(p).kind == tokWord {
+		if mg.is(p-1, "@") {
+			return true
+		}
+		if !mg.is(p-1, ".") {
+			return false
+		}
+		p -= 2
+	}
+	return false
+}
+
+// skipExpression returns the position of the first `,`, `;` or unmatched
+// closing bracket at or after p, skipping over nested brackets. Every
+// position passed on the way ends at the same place, which is remembered
+// so that a chain of arrow functions such as `a=>b=>c=>d` is not scanned
+// to its end again for each arrow.
+func (mg *mangler) skipExpression(p int) int {
+	if mg.expressionEnds == nil {
+		mg.expressionEnds = make([]int, len(mg.sig))
+	}
+	var passed []int
+scan:
+	for ; p < len(mg.sig); p++ {
+		if end := mg.expressionEnds[p]; end > 0 {
+			p = end - 1
+			break
+		}
+		passed = append(passed, p)
+		switch mg.tok(p).text {
+		case "(", "[", "{":
+			p = mg.matching(p)
+		case ",", ";", ")", "]", "}":
+			break scan
+		}
+	}
+	for _, q := range passed {
+		mg.expressionEnds[q] = p + 1
+	}
+	return p
+}
+
+// declare records name as a binding to rename, or as one to keep when
+// exclude is set
+func (mg *mangler) declare(name string, exclude bool) {
+	if exclude {
+		mg.excluded[name] = true
+		return
+	}
+	if !mg.seen[name] {
+		mg.seen[name] = true
+		mg.declared = append(mg.declared, name)
+	}
+	mg.scopes[name] = append(mg.scopes[name], mg.scope)
+}
+
+// pattern collects the names bound by the binding target at p, which is an
+// identifier or a destructuring pattern, and returns the position after it.
+// Default values are skipped; declarations inside them are found by collect.
+func (mg *mangler) pattern(p int, exclude bool) int {
+	switch {
+	case mg.isName(p):
+		mg.declare(mg.tok(p).text, exclude)
+		return p + 1
+	case mg.is(p, "{"):
+		p++
+		for p < len(mg.sig) && !mg.is(p, "}") {
+			if mg.is(p, "...") {
+				p = mg.pattern(p+1, exclude)
+			} else {
+				key := p
+				if mg.is(p, "[") {
+					p = mg.matching(p)
+				}
+				p++
+				if mg.is(p, ":") {
+					p = mg.pattern(p+1, exclude)
+				} else if mg.isName(key) {
+					mg.declare(mg.tok(key).text, exclude)
+				}
+			}
+			if mg.is(p, "=") {
+				p = mg.skipExpression(p + 1)
+			}
+			if !mg.is(p, ",") {
+				break
+			}
+			p++
+		}
+		return p + 1
+	case mg.is(p, "["):
+		p++
+		for p < len(mg.sig) && !mg.is(p, "]") {
+			if mg.is(p, ",") {
+				p++
+				continue
+			}
+			if mg.is(p, "...") {
+				p++
+			}
+			p = mg.pattern(p, exclude)
+			if mg.is(p, "=") {
+				p = mg.skipExpression(p + 1)
+			}
+			if !mg.is(p, ",") {
+				break
+			}
+			p++
+		}
+		return p + 1
+	}
+	return p + 1
+}
+
+// params collects the names bound by the parameter list opening at p
+func (mg *mangler) params(p int) {
+	end := mg.matching(p)
+	for p++; p < end; {
+		if mg.is(p, "...") {
+			p++
+		}
+		p = mg.pattern(p, false)
+		if mg.is(p, "=") {
+			p = mg.skipExpression(p + 1)
+		}
+		if !mg.is(p, ",") {
+			break
+		}
+		p++
+	}
+}
+
+// openBracket is a bracket that collect has not yet seen closed
+type openBracket struct {
+	p        int
+	function bool // the brace opens a function body
+}
+
+// collect finds every declared name. Names bound by var, let and const,
+// function, arrow and method parameters and catch clauses are renamed; names that are
+// visible outside the file (exports, imports, function and class names)
+// are excluded, and so is any name that is also bound by one of them.
+// The scope of each binding is recorded: the enclosing function for var,
+// the enclosing block or for statement for let and const, and the
+// function or catch clause for parameters.
+func (mg *mangler) collect() {
+	// Declarations whose declarator list is still open, keyed by the
+	// bracket depth at which they started
+	pending := map[int]bool{}
+	exported := map[int]bool{}
+	pendingScope := map[int]span{}
+	depth := 0
+
+	closes := mg.closingBrackets(len(mg.sig) - 1)
+	program := span{0, len(mg.sig) - 1}
+	var stack []openBracket
+	lastClosed := -1 // the opening bracket of the last one closed
+
+	// enclosing returns the scope of the innermost brace around the
+	// current position, or of the innermost function body
+	enclosing := func(function bool) span {
+		for i := len(stack) - 1; i >= 0; i-- {
+			if mg.is(stack[i].p, "{") && (stack[i].function || !function) {
+				return span{stack[i].p, closes[stack[i].p]}
+			}
+		}
+		return program
+	}
+	// bodyScope returns the scope of parameters whose function body
+	// starts at q, or, for an arrow function with an expression body,
+	// ends with that expression
+	bodyScope := func(from, q int) span {
+		if mg.is(q, "{") {
+			return span{from, closes[q]}
+		}
+		return span{from, mg.skipExpression(q)}
+	}
+
+	for p := 0; p < len(mg.sig); p++ {
+		t := mg.tok(p)
+		if pending[depth] && mg.newlineBefore(p) && !mg.is(p-1, ",") && t.text != "," && t.text != "=" {
+			pending[depth] = false
+		}
+
+		switch t.text {
+		case "(", "[", "{":
+			if t.text == "(" && mg.is(closes[p]+1, "=>") {
+				mg.scope = bodyScope(p, closes[p]+2)
+				mg.params(p)
+			}
+			function := false
+			if t.text == "{" {
+				switch {
+				case mg.is(p-1, "=>"):
+					function = true
+				case mg.is(p-1, ")") && lastClosed >= 0:
+					switch mg.tok(lastClosed - 1).text {
+					case "if", "for", "while", "switch", "catch", "with":
+					default:
+						function = true
+					}
+				}
+			}
+			stack = append(stack, openBracket{p, function})
+			depth++
+			continue
+		case ")", "]", "}":
+			if len(stack) > 0 {
+				lastClosed = stack[len(stack)-1].p
+				stack = stack[:len(stack)-1]
+			}
+			pending[depth] = false
+			depth--
+			continue
+		case ";":
+			pending[depth] = false
+			continue
+		case ",":
+			if pending[depth] {
+				mg.scope = pendingScope[depth]
+				mg.pattern(p+1, exported[depth])
+			}
+			continue
+		}
+
+		if t.kind != tokWord || mg.is(p-1, ".") || mg.is(p-1, "?.") {
+			continue
+		}
+		switch t.text {
+		case "var", "let", "const":
+			exported[depth] = mg.is(p-1, "export")
+			pending[depth] = true
+			switch {
+			case t.text == "var":
+				mg.scope = enclosing(true)
+			case len(stack) > 0 && mg.is(stack[len(stack)-1].p, "(") && mg.is(stack[len(stack)-1].p-1, "for"):
+				// for (let i ...) binds i in the loop alone
+				mg.scope = bodyScope(stack[len(stack)-1].p, closes[stack[len(stack)-1].p]+1)
+			default:
+				mg.scope = enclosing(false)
+			}
+			pendingScope[depth] = mg.scope
+			mg.pattern(p+1, exported[depth])
+		case "in", "of":
+			pending[depth] = false
+		case "catch":
+			// The binding is optional: try {} catch {} has none
+			if mg.is(p+1, "(") {
+				mg.scope = bodyScope(p+1, closes[p+1]+1)
+				mg.pattern(p+2, false)
+			}
+		case "function", "class":
+			q := p + 1
+			if mg.is(q, "*") {
+				q++
+			}
+			if mg.isName(q) {
+				mg.declare(mg.tok(q).text, true)
+			}
+		case "import":
+			if mg.is(p+1, "(") || mg.is(p+1, ".") {
+				// Dynamic import() and import.meta are expressions
+				continue
+			}
+			for q := p + 1; q < len(mg.sig) && !mg.is(q, "from") && !mg.is(q, ";") && mg.tok(q).kind != tokLiteral; q++ {
+				if mg.isName(q) {
+					mg.declare(mg.tok(q).text, true)
+				}
+			}
+		case "export":
+			if mg.is(p+1, "{") {
+				for q := p + 2; q < len(mg.sig) && !mg.is(q, "}"); q++ {
+					if mg.isName(q) {
+						mg.declare(mg.tok(q).text, true)
+					}
+				}
+			}
+		default:
+			if !mg.isName(p) {
+				continue
+			}
+			if mg.is(p+1, "=>") {
+				mg.scope = bodyScope(p, p+2)
+				mg.declare(t.text, false)
+			} else if mg.is(p+1, "(") && mg.is(closes[p+1]+1, "{") && mg.definesFunction(p) {
+				// Function and method definitions: name(params) { body }
+				mg.scope = bodyScope(p+1, closes[p+1]+1)
+				mg.params(p + 1)
+			}
+		}
+	}
+}
+
+// definesFunction reports whether the name at p, followed by a parameter
+// list and a brace, names a function or method being defined. That is so
+// for the members of class bodies and object literals and for names after
+// function, get, set, async or `*`; anywhere else, as in `init(config)`
+// followed by a block on the next line, the name is called.
+func (mg *mangler) definesFunction(p int) bool {
+	if mg.roles()[mg.sig[p]] == roleProperty {
+		return true
+	}
+	switch mg.tok(p - 1).text {
+	case "function", "get", "set", "async", "*":
+		return true
+	}
+	return false
+}
+
+// closingBrackets returns, for each position holding an opening bracket,
+// the position of the bracket closing it. Unclosed brackets extend to
+// position end.
+func (mg *mangler) closingBrackets(end int) []int {
+	closes := make([]int, len(mg.sig))
+	var open []int
+	for p := range mg.sig {
+		switch mg.tok(p).text {
+		case "(", "[", "{":
+			open = append(open, p)
+		case ")", "]", "}":
+			if len(open) > 0 {
+				closes[open[len(open)-1]] = p
+				open = open[:len(open)-1]
+			}
+		}
+	}
+	for _, p := range open {
+		closes[p] = end
+	}
+	return closes
+}
+
+// openContext returns the kind of the bracket opened by the significant
+// token at p, judging braces by the token before them
+func (mg *mangler) openContext(p int, pendingClass bool, stack []bracketContext) int {
+	switch mg.tok(p).text {
+	case "(":
+		return ctxParen
+	case "[":
+		return ctxBracket
+	}
+	if pendingClass {
+		return ctxClass
+	}
+
+	prev := mg.tok(p - 1)
+	switch prev.kind {
+	case tokSpace:
+		return ctxBlock
+	case tokWord:
+		switch prev.text {
+		case "import", "export":
+			return ctxModuleList
+		case "var", "let", "const", "return", "typeof", "void", "in", "of", "new", "delete", "throw", "yield", "await", "case":
+			return ctxObject
+		}
+		return ctxBlock
+	case tokLiteral:
+		return ctxBlock
+	}
+
+	switch prev.text {
+	case ")", "]", "}", ";", "{", "=>":
+		return ctxBlock
+	case ":":
+		// Only a colon ending an object key or a ternary branch is
+		// followed by a value; case and label colons start statements
+		if len(stack) > 0 && stack[len(stack)-1].kind == ctxObject || mg.colonEndsTernary {
+			return ctxObject
+		}
+		return ctxBlock
+	}
+	return ctxObject
+}
+
+// roles classifies every identifier token by index
+func (mg *mangler) roles() map[int]int {
+	if mg.roleCache != nil {
+		return mg.roleCache
+	}
+	roles := make(map[int]int)
+	mg.roleCache = roles
+	var stack []bracketContext
+	pendingClass := false
+
+	for p := 0; p < len(mg.sig); p++ {
+		t := mg.tok(p)
+		var top *bracketContext
+		if len(stack) > 0 {
+			top = &stack[len(stack)-1]
+		}
+
+		switch t.text {
+		case "(", "[", "{":
+			kind := mg.openContext(p, pendingClass, stack)
+			if t.text == "{" {
+				pendingClass = false
+			}
+			stack = append(stack, bracketContext{kind: kind})
+			mg.colonEndsTernary = false
+			continue
+		case ")", "]", "}":
+			if top != nil {
+				stack = stack[:len(stack)-1]
+			}
+			continue
+		case "?":
+			if top != nil {
+				top.ternary++
+			}
+			continue
+		case ":":
+			mg.colonEndsTernary = top != nil && top.ternary > 0
+			if mg.colonEndsTernary {
+				top.ternary--
+			}
+			continue
+		}
+		mg.colonEndsTernary = false
+
+		if t.kind != tokWord {
+			if top != nil && t.text == "*" && mg.startsGeneratorMember(p, top.kind) {
+				top.modifier = true
+			} else if top != nil && t.text != "*" {
+				top.modifier = false
+			}
+			continue
+		}
+		if t.text == "class" {
+			pendingClass = true
+		}
+
+		prev := mg.tok(p - 1)
+		if prev.text == "." || prev.text == "?." || prev.text == "#" {
+			roles[mg.sig[p]] = roleProperty
+			continue
+		}
+		if top == nil {
+			continue
+		}
+
+		switch top.kind {
+		case ctxModuleList:
+			roles[mg.sig[p]] = roleModuleName
+		case ctxObject:
+			if prev.text != "{" && prev.text != "," && !top.modifier {
+				continue
+			}
+			next := mg.tok(p + 1)
+			switch {
+			case next.text == ":" || next.text == "(":
+				roles[mg.sig[p]] = roleProperty
+			case next.text == "," || next.text == "}" || next.text == "=":
+				roles[mg.sig[p]] = roleShorthand
+			case isMemberModifier(t.text) && next.kind != tokPunct || next.text == "[" || next.text == "*":
+				roles[mg.sig[p]] = roleModifier
+				top.modifier = true
+				continue
+			}
+			top.modifier = false
+		case ctxClass:
+			memberStart := prev.text == "{" || prev.text == ";" || prev.text == "}" || mg.newlineBefore(p) || mg.endsDecorator(p-1)
+			if !memberStart && !top.modifier {
+				continue
+			}
+			next := mg.tok(p + 1)
+			top.modifier = (isMemberModifier(t.text) || t.text == "static") &&
+				(next.kind != tokPunct || next.text == "[" || next.text == "*" || next.text == "#")
+			if top.modifier {
+				roles[mg.sig[p]] = roleModifier
+			} else {
+				roles[mg.sig[p]] = roleProperty
+			}
+		}
+	}
+	return roles
+}
+
+// startsGeneratorMember reports whether the `*` at p starts a member of
+// the class body or object literal of kind, as in `*items() {}`, so that
+// the name after it is a member name like the one after `get`
+func (mg *mangler) startsGeneratorMember(p, kind int) bool {
+	prev, next := mg.tok(p-1), mg.tok(p+1)
+	switch kind {
+	case ctxObject:
+		if prev.text != "{" && prev.text != "," {
+			return false
+		}
+	case ctxClass:
+		if prev.text != "{" && prev.text != ";" && prev.text != "}" && !mg.newlineBefore(p) && !mg.endsDecorator(p-1) {
+			return false
+		}
+	default:
+		return false
+	}
+	return next.text == "[" || next.text == "#" || next.kind == tokWord && mg.is(p+2, "(")
+}
+
+// isMemberModifier reports whether word can prefix an object or class
+// member name
+func isMemberModifier(word string) bool {
+	return word == "get" || word == "set" || word == "async"
+}
+
+// rename rewrites the code with every binding in names and every property
+// in props replaced. Either map may be nil.
+func (mg *mangler) rename(names, props map[string]string) string {
+	roles := mg.roles()
+	var b strings.Builder
+	for i, t := range mg.tokens {
+		if t.kind != tokWord {
+			b.WriteString(t.text)
+			continue
+		}
+		switch roles[i] {
+		case roleProperty:
+			b.WriteString(lookup(props, t.text))
+		case roleShorthand:
+			key, value := lookup(props, t.text), lookup(names, t.text)
+			if key == t.text && value == t.text {
+				b.WriteString(t.text)
+			} else {
+				b.WriteString(key + ":" + value)
+			}
+		case roleModifier, roleModuleName:
+			b.WriteString(t.text)
+		default:
+			b.WriteString(lookup(names, t.text))
+		}
+	}
+	return b.String()
+}
+
+// lookup returns the replacement for name in renames, or name itself
+func lookup(renames map[string]string, name string) string {
+	if short, ok := renames[name]; ok {
+		return short
+	}
+	return name
+}
+
+// byFrequency returns names ordered by how often they occur as variables in
+// the code, most often first. Names used equally often keep their order.
+func (mg *mangler) byFrequency(names []string) []string {
+	counts := make(map[string]int, len(names))
+	roles := mg.roles()
+	for i, t := range mg.tokens {
+		if t.kind == tokWord && (roles[i] == roleReference || roles[i] == roleShorthand) {
+			counts[t.text]++
+		}
+	}
+	sorted := append([]string(nil), names...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return counts[sorted[i]] > counts[sorted[j]]
+	})
+	return sorted
+}
+
+// properties returns, in order of first appearance, the names used as
+// properties, object keys or class members that match filter
+func (mg *mangler) properties(filter *regexp.Regexp) []string {
+	var names []string
+	seen := make(map[string]bool)
+	roles := mg.roles()
+	for i, t := range mg.tokens {
+		if t.kind != tokWord || seen[t.text] {
+			continue
+		}
+		if role := roles[i]; role != roleProperty && role != roleShorthand {
+			continue
+		}
+		if reservedProperties[t.text] || jsKeywords[t.text] || !filter.MatchString(t.text) {
+			continue
+		}
+		seen[t.text] = true
+		names = append(names, t.text)
+	}
+	return names
+}
+
+// reservedProperties lists property names with a meaning to the language,
+// which property mangling never renames even when they match the filter
+var reservedProperties = map[string]bool{
+	"constructor": true, "prototype": true, "__proto__": true,
+	"length": true, "toString": true, "valueOf": true, "then": true,
+}
+
+// reserved returns every word in the code that keeps its spelling, none of
+// which may be generated as a new name. Names that are renamed themselves
+// are free to be reused, since all of their occurrences change.
+func (mg *mangler) reserved() map[string]bool {
+	words := make(map[string]bool)
+	for _, t := range mg.tokens {
+		if t.kind == tokWord && (!mg.seen[t.text] || mg.excluded[t.text]) {
+			words[t.text] = true
+		}
+	}
+	return words
+}
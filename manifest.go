@@ -0,0 +1,66 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+// contentHashLength is the number of hexadecimal digits of the SHA-256 of
+// the minified code put in hashed output names
+const contentHashLength = 8
+
+// contentHash returns the hash of content used in hashed output names
+func contentHash(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])[:contentHashLength]
+}
+
+// hashedPath inserts the content hash of minified before the extension of
+// outputPath, so that app.min.js becomes app.min.3f2a9c1e.js and a changed
+// file gets a name no cache has seen
+func hashedPath(outputPath, minified string) string {
+	ext := filepath.Ext(outputPath)
+	return strings.TrimSuffix(outputPath, ext) + "." + contentHash(minified) + ext
+}
+
+// isMinifiedName reports whether the file name, with its extension, is one
+// the minifier writes: app.min.js, or app.min.3f2a9c1e.js with HashNames.
+// Such files are not sources to minify again.
+func isMinifiedName(name string) bool {
+	name = strings.TrimSuffix(name, filepath.Ext(name))
+	if ext := filepath.Ext(name); len(ext) == contentHashLength+1 {
+		if _, err := hex.DecodeString(ext[1:]); err == nil {
+			name = strings.TrimSuffix(name, ext)
+		}
+	}
+	return strings.HasSuffix(name, ".min")
+}
+
+// writeManifest writes a JSON object to path that maps the input file of
+// every minified file in stats to its output file, both relative to the
+// directory of the manifest, for a deployment to find the hashed names.
+// Files that failed or were not written are left out.
+func writeManifest(path string, stats []MinificationStats) error {
+	dir := filepath.Dir(path)
+	relative := func(file string) string {
+		if rel, err := filepath.Rel(dir, file); err == nil {
+			file = rel
+		}
+		return filepath.ToSlash(file)
+	}
+	manifest := make(map[string]string)
+	for _, stat := range stats {
+		if stat.Error == "" && stat.OutputFile != "" {
+			manifest[relative(stat.InputFile)] = relative(stat.OutputFile)
+		}
+	}
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(data, '\n'), 0644)
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sync/atomic"
+)
+
+// processMetrics counts the work done by processFile over the lifetime of
+// the process, for long-running watch deployments to be monitored
+var processMetrics metrics
+
+// metrics holds counters that are safe to update from concurrent goroutines
+type metrics struct {
+	filesProcessed atomic.Int64
+	bytesSaved     atomic.Int64
+	errors         atomic.Int64
+}
+
+// record counts a successfully processed file
+func (m *metrics) record(stat MinificationStats) {
+	m.filesProcessed.Add(1)
+	m.bytesSaved.Add(int64(stat.OriginalSize - stat.MinifiedSize))
+}
+
+// recordError counts a file that could not be processed
+func (m *metrics) recordError() {
+	m.errors.Add(1)
+}
+
+// ServeHTTP writes the counters in the Prometheus text exposition format
+func (m *metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	writeCounter(w, "jsminifier_files_processed_total", "Files minified successfully.", m.filesProcessed.Load())
+	writeCounter(w, "jsminifier_bytes_saved_total", "Bytes removed by minification.", m.bytesSaved.Load())
+	writeCounter(w, "jsminifier_errors_total", "Files that failed to minify.", m.errors.Load())
+}
+
+// writeCounter writes a single counter with its help and type lines
+func writeCounter(w http.ResponseWriter, name, help string, value int64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", name, help, name, name, value)
+}
+
+// startMetricsServer serves processMetrics on /metrics at addr in the
+// background. It returns once the address is being listened on, so that
+// an unusable address is reported straight away.
+func startMetricsServer(addr string) (net.Listener, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", &processMetrics)
+	go func() {
+		if err := http.Serve(ln, mux); err != nil {
+			debugLog("Metrics server stopped: %v", err)
+		}
+	}()
+	return ln, nil
+}
@@ -1,10 +1,30 @@
 package main
 
 import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/constant"
+	"go/parser"
+	gotoken "go/token"
+	"go/types"
 	"io/ioutil"
+	"net/http"
+	"os"
 	"path/filepath"
+	"reflect"
+	"regexp"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 // TestCase represents a single minification test case
@@ -64,6 +84,87 @@ function test() {}`
 	}
 }
 
+// TestMultiLineLicense tests that kept comments spanning several lines
+// come out byte for byte, with their line breaks and indentation
+func TestMultiLineLicense(t *testing.T) {
+	license := "/*!\n * MyLib v1.0.0\n *   (c) 2024 The MyLib Authors\n *\n * Released under the MIT License\n */"
+	input := license + "\nfunction add(first, second) {\n\treturn first + second;\n}\n"
+
+	result := NewMinifier(input, true, true).Minify()
+	if expected := license + "\nfunction add(a,b){return a+b;}"; result != expected {
+		t.Errorf("Expected %q, got %q", expected, result)
+	}
+	lines := strings.Split(result, "\n")
+	for i, line := range strings.Split(license, "\n") {
+		if i >= len(lines) || lines[i] != line {
+			t.Errorf("License line %d changed: expected %q", i+1, line)
+		}
+	}
+
+	opts := DefaultOptions()
+	opts.KeepLegalComments = true
+	legal := "/*! Bundled dependency\n    keeps its indentation\n\n    and blank lines */"
+	result = NewMinifierWithOptions("const a = 1;\n"+legal+"\nconst b = 2;", opts).Minify()
+	if !strings.Contains(result, legal) {
+		t.Errorf("Legal comment was reformatted: %q", result)
+	}
+}
+
+// TestMinifierByteOrderMark tests that a leading BOM is stripped
+func TestMinifierByteOrderMark(t *testing.T) {
+	input := "\uFEFF/*! License */\nconst total = 1;\n"
+	expected := "/*! License */\nconst total=1;"
+
+	result := NewMinifier(input, true, false).Minify()
+	if result != expected {
+		t.Errorf("BOM-prefixed input was not minified cleanly.\nExpected: %q\nGot: %q", expected, result)
+	}
+
+	result = NewMinifier("\uFEFFconst total = 1;", false, true).Minify()
+	if result != "const a=1;" {
+		t.Errorf("BOM interfered with the first statement.\nGot: %q", result)
+	}
+}
+
+// TestDirectivePrologue tests that 'use strict' directives and a #! line
+// stay first
+func TestDirectivePrologue(t *testing.T) {
+	testCases := []TestCase{
+		{
+			Name:           "Use Strict First",
+			Input:          "'use strict';\n\nconst total = 1;",
+			ExpectedOutput: "'use strict';const total=1;",
+		},
+		{
+			Name:           "Function Directive",
+			Input:          "function f() {\n\t\"use strict\";\n\treturn this;\n}",
+			ExpectedOutput: "function f(){\"use strict\";return this;}",
+		},
+		{
+			Name:           "Shebang Line",
+			Input:          "#!/usr/bin/env node\n'use strict';\nconst total = 1;\n",
+			ExpectedOutput: "#!/usr/bin/env node\n'use strict';const total=1;",
+		},
+		{
+			Name:           "Shebang Before License",
+			Input:          "#!/usr/bin/env node\n/*! License */\n'use strict';\n",
+			ExpectedOutput: "#!/usr/bin/env node\n/*! License */\n'use strict';",
+			Options:        MinificationOptions{PreserveLicense: true},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			minifier := NewMinifier(tc.Input, tc.Options.PreserveLicense, tc.Options.ShortenVars)
+			result := minifier.Minify()
+			checkIncremental(t, tc)
+			if result != tc.ExpectedOutput {
+				t.Errorf("%s failed.\nExpected: %q\nGot: %q", tc.Name, tc.ExpectedOutput, result)
+			}
+		})
+	}
+}
+
 // TestMinifierVariableShortening tests variable name shortening
 func TestMinifierVariableShortening(t *testing.T) {
 	input := `const longVariableName = 42;
@@ -72,9 +173,3502 @@ func TestMinifierVariableShortening(t *testing.T) {
 	minifier := NewMinifier(input, false, true)
 	result := minifier.Minify()
 
-	// Check if variables were shortened
-	if strings.Contains(result, "longVariableName") || strings.Contains(result, "anotherLongName") {
-		t.Error("Variable shortening failed, original names still present")
+	// Check if variables were shortened
+	if strings.Contains(result, "longVariableName") || strings.Contains(result, "anotherLongName") {
+		t.Error("Variable shortening failed, original names still present")
+	}
+}
+
+// TestMinifierReset tests that a reset minifier behaves like a fresh one
+func TestMinifierReset(t *testing.T) {
+	first := "const firstName = 1;\nconst lastName = firstName;"
+	second := "let total = 2;\nlet count = total;"
+
+	minifier := NewMinifier(first, false, true)
+	minifier.Minify()
+	minifier.Reset(second)
+	result := minifier.Minify()
+
+	expected := NewMinifier(second, false, true).Minify()
+	if result != expected {
+		t.Errorf("Reset minifier output differs.\nExpected: %s\nGot: %s", expected, result)
+	}
+	if strings.Contains(result, "firstName") || strings.Contains(result, "total") {
+		t.Errorf("Reset minifier kept state from the previous input: %s", result)
+	}
+}
+
+// TestShortenDeclarationOrder tests that short names are handed out in the
+// order in which variables are first declared, in every run
+func TestShortenDeclarationOrder(t *testing.T) {
+	input := "const first = (p1, {key: p2}) => p1 + p2;\nlet second = v => v, third;\n" +
+		"function f(fp, ...rest) { var inner = fp; try { use(rest) } catch ({message}) { log(message); } }\n" +
+		"second = first; third = second;"
+	expected := map[string]string{
+		"first": "a", "p1": "b", "p2": "c", "second": "d", "v": "e", "third": "g",
+		"fp": "h", "rest": "i", "inner": "j", "message": "k",
+	}
+
+	var output string
+	for run := 0; run < 20; run++ {
+		minifier := NewMinifier(input, false, true)
+		result := minifier.Minify()
+		if run == 0 {
+			output = result
+		} else if result != output {
+			t.Fatalf("Run %d gave different output:\n%s\nthen:\n%s", run, output, result)
+		}
+		if names := minifier.VarMap(); !reflect.DeepEqual(names, expected) {
+			t.Fatalf("Expected names %v, got %v", expected, names)
+		}
+	}
+}
+
+// TestFrequencyNames tests that FrequencyNames gives the shortest name to
+// the most used variable, which otherwise goes to the first declared one
+func TestFrequencyNames(t *testing.T) {
+	// Enough variables, each used more often than rare, for the last
+	// ones to get two-character names
+	var b strings.Builder
+	b.WriteString("let rare = 1")
+	for i := 0; i < 30; i++ {
+		fmt.Fprintf(&b, ", filler%d = %d", i, i)
+	}
+	b.WriteString(";\nlet frequent = 0;\nuse(filler0")
+	for i := 1; i < 30; i++ {
+		fmt.Fprintf(&b, ", filler%d", i)
+	}
+	b.WriteString(");\n")
+	for i := 0; i < 100; i++ {
+		b.WriteString("frequent += 2;\n")
+	}
+	input := b.String()
+
+	for _, frequency := range []bool{false, true} {
+		opts := DefaultOptions()
+		opts.ShortenVars = true
+		opts.FrequencyNames = frequency
+		minifier := NewMinifierWithOptions(input, opts)
+		minifier.Minify()
+		names := minifier.VarMap()
+
+		short, long := names["frequent"], names["rare"]
+		if !frequency {
+			short, long = long, short
+		}
+		if short != "a" || len(long) < 2 {
+			t.Errorf("With FrequencyNames %v, got frequent=%s and rare=%s", frequency, names["frequent"], names["rare"])
+		}
+	}
+}
+
+// TestShortenDestructuredParams tests shortening of names bound by
+// destructured parameters with defaults
+func TestShortenDestructuredParams(t *testing.T) {
+	testCases := []TestCase{
+		{
+			Name:           "Defaults And Nesting",
+			Input:          "function f({count = 1, inner: {path} = {}} = {}) {\n\treturn count + path;\n}",
+			ExpectedOutput: "function f({count:a=1,inner:{path:b}={}}={}){return a+b;}",
+		},
+		{
+			Name:           "Array Pattern With Defaults",
+			Input:          "const pick = ([first = 0, , ...others] = []) => first + others.length;",
+			ExpectedOutput: "const a=([b=0,,...c]=[])=>b+c.length;",
+		},
+		{
+			Name:           "Default Referencing Earlier Param",
+			Input:          "function size(width, {height = width * 2} = {}) { return width * height; }",
+			ExpectedOutput: "function size(a,{height:b=a*2}={}){return a*b;}",
+		},
+		{
+			Name:           "Keys And Members Kept",
+			Input:          "let count = 0;\nconst counter = { count: count, get value() { return this.count; } };",
+			ExpectedOutput: "let a=0;const b={count:a,get value(){return this.count;}};",
+		},
+		{
+			Name:           "Shorthand Expanded",
+			Input:          "function total(price, tax) { const sum = price + tax; return {sum, tax}; }",
+			ExpectedOutput: "function total(a,b){const c=a+b;return{sum:c,tax:b};}",
+		},
+		{
+			Name:           "No Clash With Existing Names",
+			Input:          "function g(a, b) { const result = a + b; return result; }",
+			ExpectedOutput: "function g(a,b){const c=a+b;return c;}",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			minifier := NewMinifier(tc.Input, false, true)
+			result := minifier.Minify()
+			if result != tc.ExpectedOutput {
+				t.Errorf("%s failed.\nExpected: %s\nGot: %s", tc.Name, tc.ExpectedOutput, result)
+			}
+		})
+	}
+}
+
+// TestShortenCatchBinding tests that catch clause bindings are shortened
+// like other local names
+func TestShortenCatchBinding(t *testing.T) {
+	testCases := []TestCase{
+		{
+			Name:           "Catch Binding",
+			Input:          "try { f() } catch (err) { log(err) }",
+			ExpectedOutput: "try{f()}catch(a){log(a)}",
+		},
+		{
+			Name:           "Destructured Catch Binding",
+			Input:          "try { f() } catch ({message}) { log(message) }",
+			ExpectedOutput: "try{f()}catch({message:a}){log(a)}",
+		},
+		{
+			Name:           "Optional Catch Binding",
+			Input:          "try {\n\tf();\n} catch {\n\tg();\n} finally {\n\th();\n}",
+			ExpectedOutput: "try{f();}catch{g();}finally{h();}",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			minifier := NewMinifier(tc.Input, false, true)
+			result := minifier.Minify()
+			if result != tc.ExpectedOutput {
+				t.Errorf("%s failed.\nExpected: %s\nGot: %s", tc.Name, tc.ExpectedOutput, result)
+			}
+		})
+	}
+}
+
+// TestShortenBlockScopes tests that var is treated as function-scoped and
+// let and const as block-scoped when deciding whether a name may be renamed.
+// A use outside every scope declaring the name refers to a global, so the
+// name keeps its spelling.
+func TestShortenBlockScopes(t *testing.T) {
+	testCases := []TestCase{
+		{
+			Name:           "Var Hoisted Out Of Block",
+			Input:          "function f(on) { if (on) { var count = 1; } return count; }",
+			ExpectedOutput: "function f(a){if(a){var b=1;}return b;}",
+		},
+		{
+			Name:           "Let Confined To Block",
+			Input:          "function f(on) { if (on) { let count = 1; } return count; }",
+			ExpectedOutput: "function f(a){if(a){let count=1;}return count;}",
+		},
+		{
+			Name:           "Loop Counters",
+			Input:          "for (let i = 0; i < 2; i++) { a(i); }\nfor (let i = 0; i < 3; i++) { b(i); }",
+			ExpectedOutput: "for(let c=0;c<2;c++){a(c);}for(let c=0;c<3;c++){b(c);}",
+		},
+		{
+			Name:           "Loop Counter Used After Loop",
+			Input:          "for (let i = 0; i < 2; i++) { a(i); }\nlog(i)",
+			ExpectedOutput: "for(let i=0;i<2;i++){a(i);}log(i)",
+		},
+		{
+			Name:           "Var Loop Counter Used After Loop",
+			Input:          "function f() { for (var i = 0; i < 2; i++) { a(i); } return i; }",
+			ExpectedOutput: "function f(){for(var b=0;b<2;b++){a(b);}return b;}",
+		},
+		{
+			Name:           "Parameter Used In Default",
+			Input:          "function f(first, last = first) { return last; }",
+			ExpectedOutput: "function f(a,b=a){return b;}",
+		},
+		{
+			Name:           "Closure Over Block Binding",
+			Input:          "{ const total = 1; run(() => total); }",
+			ExpectedOutput: "{const a=1;run(()=>a);}",
+		},
+		{
+			Name:           "Call Followed By Block",
+			Input:          "init(config)\n{ let local = 1; use(local) }",
+			ExpectedOutput: "init(config)\n{let a=1;use(a)}",
+		},
+		{
+			Name:           "Method Parameters",
+			Input:          "class A { run(config) { return config } }\nconst o = { run(config) { return config } }",
+			ExpectedOutput: "class A{run(a){return a}}const b={run(a){return a}}",
+		},
+		{
+			Name:           "Generator Members",
+			Input:          "const items = [1, 2]\nclass List {\n\t*items() { yield* items }\n\tstatic *all() { yield* items }\n\tasync *each() { yield items }\n}\nconst o = { *items() { yield* items }, async *each() { yield items } }\nnew List().items(), o.items()",
+			ExpectedOutput: "const a=[1,2]\nclass List{*items(){yield*a}static*all(){yield*a}async*each(){yield a}}const b={*items(){yield*a},async*each(){yield a}}\nnew List().items(),b.items()",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			minifier := NewMinifier(tc.Input, false, true)
+			result := minifier.Minify()
+			if result != tc.ExpectedOutput {
+				t.Errorf("%s failed.\nExpected: %s\nGot: %s", tc.Name, tc.ExpectedOutput, result)
+			}
+		})
+	}
+}
+
+// TestDecorators tests that decorators stay separated from the class or
+// member they decorate, and that decorated members keep their names when
+// variables of the same name are shortened
+func TestDecorators(t *testing.T) {
+	testCases := []TestCase{
+		{
+			Name:           "Decorated Class",
+			Input:          "@sealed\nclass Greeter {}\n@Component({ selector: 'app' }) export class App {}",
+			ExpectedOutput: "@sealed\nclass Greeter{}@Component({selector:'app'})export class App{}",
+		},
+		{
+			Name:           "Decorated Members",
+			Input:          "const name = 'n', log = console.log;\nclass A {\n  @log method() {}\n  @readonly @enumerable(false) name = 1;\n  @ns.track static update() {}\n}",
+			ExpectedOutput: "const a='n',b=console.log;class A{@b method(){}@readonly @enumerable(false)name=1;@ns.track static update(){}}",
+			Options:        MinificationOptions{ShortenVars: true},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			minifier := NewMinifier(tc.Input, false, tc.Options.ShortenVars)
+			result := minifier.Minify()
+			checkIncremental(t, tc)
+			if result != tc.ExpectedOutput {
+				t.Errorf("%s failed.\nExpected: %s\nGot: %s", tc.Name, tc.ExpectedOutput, result)
+			}
+		})
+	}
+}
+
+// TestFinalNewline tests that FinalNewline ends the output with exactly one
+// newline, whether or not the input had any, and that the output has none
+// by default
+func TestFinalNewline(t *testing.T) {
+	inputs := []string{"const a = 1;", "const a = 1;\n\n\n", "let a = 1 // one\r\n"}
+	for _, input := range inputs {
+		for _, final := range []bool{false, true} {
+			opts := DefaultOptions()
+			opts.FinalNewline = final
+			result := NewMinifierWithOptions(input, opts).Minify()
+			code := strings.TrimRight(result, "\n")
+			if result != code+"\n" && final || result != code && !final {
+				t.Errorf("With FinalNewline %v, %q minified to %q", final, input, result)
+			}
+			if inc := NewIncrementalMinifier(opts).Minify(input); inc != result {
+				t.Errorf("Incremental minification gave %q instead of %q", inc, result)
+			}
+		}
+	}
+
+	opts := DefaultOptions()
+	opts.FinalNewline = true
+	if result := NewMinifierWithOptions("// nothing\n", opts).Minify(); result != "" {
+		t.Errorf("Expected empty output to stay empty, got %q", result)
+	}
+}
+
+// TestNumericLiterals tests that hexadecimal, octal, binary, BigInt and
+// exponent literals survive renaming and property mangling unchanged
+func TestNumericLiterals(t *testing.T) {
+	input := "const nums = [0xFF, 0o17, 0b1010, 123n, 0x1Fn, 1_000_000, 1.5e-3, .5, 0B11, 0XAB, 2e+10, 1E5];\nconst box = {a: 1};\nlog(box.a, nums.length, 5..toString());"
+	expected := "const b=[0xFF,0o17,0b1010,123n,0x1Fn,1_000_000,1.5e-3,.5,0B11,0XAB,2e+10,1E5];const c={b:1};log(c.b,b.length,5..toString());"
+
+	opts := DefaultOptions()
+	opts.ShortenVars = true
+	opts.MangleProps = regexp.MustCompile("^[a-z0-9]+$")
+	result := NewMinifierWithOptions(input, opts).Minify()
+	if result != expected {
+		t.Errorf("Expected: %s\nGot: %s", expected, result)
+	}
+}
+
+// TestExponentLiterals tests that numbers in exponent notation stay whole,
+// and that the sign operators next to them never merge into ++ or --
+func TestExponentLiterals(t *testing.T) {
+	testCases := []TestCase{
+		{
+			Name:           "Negative Exponent",
+			Input:          "const x = 1.5e-10;",
+			ExpectedOutput: "const x=1.5e-10;",
+		},
+		{
+			Name:           "Positive Exponent",
+			Input:          "const y = 2E+3;",
+			ExpectedOutput: "const y=2E+3;",
+		},
+		{
+			Name:           "Signs Around Exponents",
+			Input:          "const z = x - 1e-5 - -2, w = 1E+3 + +y, v = .5e+2 / 2e-1;",
+			ExpectedOutput: "const z=x-1e-5- -2,w=1E+3+ +y,v=.5e+2/2e-1;",
+		},
+		{
+			Name:           "Signs Before Increments",
+			Input:          "const p = a + ++b, q = a++ + b, r = a - --b, s = a - -b;",
+			ExpectedOutput: "const p=a+ ++b,q=a++ +b,r=a- --b,s=a- -b;",
+		},
+		{
+			Name:           "Shortened",
+			Input:          "const small = 1e-5;\nconst big = 2E+3 - -small;",
+			ExpectedOutput: "const a=1e-5;const b=2E+3- -a;",
+			Options:        MinificationOptions{ShortenVars: true},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			minifier := NewMinifier(tc.Input, tc.Options.PreserveLicense, tc.Options.ShortenVars)
+			result := minifier.Minify()
+			checkIncremental(t, tc)
+			if result != tc.ExpectedOutput {
+				t.Errorf("%s failed.\nExpected: %s\nGot: %s", tc.Name, tc.ExpectedOutput, result)
+			}
+		})
+	}
+}
+
+// TestNumberMemberAccess tests that a member access on an integer literal
+// keeps what separates the number from the dot, in compact and beautified
+// output alike, since `5.toString()` does not parse
+func TestNumberMemberAccess(t *testing.T) {
+	testCases := []struct {
+		Name     string
+		Input    string
+		Compact  string
+		Beautify string
+	}{
+		{"Space", "const s = 5 .toString();", "const s=5 .toString();", "const s = 5 .toString();\n"},
+		{"Parentheses", "const s = (5).toFixed(2);", "const s=(5).toFixed(2);", "const s = (5).toFixed(2);\n"},
+		{"Double Dot", "const s = 5..toString();", "const s=5..toString();", "const s = 5..toString();\n"},
+		{"Line Break", "const s = 5\n\t.toString();", "const s=5 .toString();", "const s = 5 .toString();\n"},
+		{"Decimal", "const s = 1.5.toFixed(1);", "const s=1.5.toFixed(1);", "const s = 1.5.toFixed(1);\n"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			opts := DefaultOptions()
+			if result := NewMinifierWithOptions(tc.Input, opts).Minify(); result != tc.Compact {
+				t.Errorf("Expected: %q\nGot: %q", tc.Compact, result)
+			}
+			opts.Beautify = true
+			if result := NewMinifierWithOptions(tc.Input, opts).Minify(); result != tc.Beautify {
+				t.Errorf("Beautified.\nExpected: %q\nGot: %q", tc.Beautify, result)
+			}
+		})
+	}
+}
+
+// TestMinifyBytes tests that the byte API gives the same output as the
+// string API, that its result does not share memory with the input, even
+// for input that is minified already, and that a NUL byte is reported
+func TestMinifyBytes(t *testing.T) {
+	opts := DefaultOptions()
+	opts.PreserveLicense = true
+	opts.ShortenVars = true
+	inputs := []string{
+		"",
+		"const answer = 42;",
+		"#!/usr/bin/env node\n/*! MIT */\nfunction add(first, second) { return first + second; }\n",
+		"\uFEFFlet text = 'unchanged';",
+		"const a=1;",
+	}
+	for _, input := range inputs {
+		expected := NewMinifierWithOptions(input, opts).Minify()
+		src := []byte(input)
+		result, err := MinifyBytes(src, opts)
+		if err != nil {
+			t.Fatalf("MinifyBytes(%q) failed: %v", input, err)
+		}
+		if string(result) != expected {
+			t.Errorf("MinifyBytes(%q) = %q, want %q", input, result, expected)
+		}
+		for i := range result {
+			result[i] = ' '
+		}
+		if string(src) != input {
+			t.Errorf("Writing to the result of MinifyBytes(%q) changed the input to %q", input, src)
+		}
+		for i := range src {
+			src[i] = ' '
+		}
+		if string(result) != strings.Repeat(" ", len(result)) {
+			t.Errorf("Writing to the input of MinifyBytes(%q) changed the result to %q", input, result)
+		}
+	}
+
+	_, err := MinifyBytes([]byte("let a = 1;\nlet b\x00 = 2;"), opts)
+	if err == nil || err.Error() != "2:6: unsupported NUL byte" {
+		t.Errorf("Expected an error at the NUL byte, got %v", err)
+	}
+}
+
+// TestMangleProperties tests that only properties matching the filter are
+// renamed, consistently across accesses, keys and class members
+func TestMangleProperties(t *testing.T) {
+	input := `class Store {
+	constructor() { this._items = []; this.size = 0; }
+	get _count() { return this._items.length; }
+	add(item) { this._items.push(item); return {_last: item, size: this.size}; }
+}
+const {_last} = new Store().add(1);`
+	expected := "class Store{constructor(){this.a=[];this.size=0;}get b(){return this.a.length;}" +
+		"add(item){this.a.push(item);return{c:item,size:this.size};}}const{c:_last}=new Store().add(1);"
+
+	opts := DefaultOptions()
+	opts.MangleProps = regexp.MustCompile("^_")
+	result := NewMinifierWithOptions(input, opts).Minify()
+	if result != expected {
+		t.Errorf("Property mangling failed.\nExpected: %s\nGot: %s", expected, result)
+	}
+
+	// Generator methods are renamed along with their calls
+	input = "o = { *_gen() { yield 1 } };\nclass C { static *_all() {} *_each() {} }\no._gen(); C._all(); new C()._each();"
+	expected = "o={*a(){yield 1}};class C{static*b(){}*c(){}}o.a();C.b();new C().c();"
+	if result := NewMinifierWithOptions(input, opts).Minify(); result != expected {
+		t.Errorf("Generator methods were not renamed consistently.\nExpected: %s\nGot: %s", expected, result)
+	}
+
+	if code := run([]string{"-input", "app.js", "-mangle-props", "("}); code != 1 {
+		t.Errorf("Expected exit code 1 for an invalid filter, got %d", code)
+	}
+}
+
+// TestComputedMemberStrings tests that string subscripts are preserved
+// exactly, including when variables and properties are renamed
+func TestComputedMemberStrings(t *testing.T) {
+	input := "const table = {};\ntable[\"a b\"] = table [ 'x + y' ];\ntable._size = table[\"_size\"];"
+
+	result := NewMinifier(input, false, false).Minify()
+	expected := "const table={};table[\"a b\"]=table['x + y'];table._size=table[\"_size\"];"
+	if result != expected {
+		t.Errorf("Computed member strings changed.\nExpected: %s\nGot: %s", expected, result)
+	}
+
+	opts := DefaultOptions()
+	opts.ShortenVars = true
+	opts.MangleProps = regexp.MustCompile("^_")
+	result = NewMinifierWithOptions(input, opts).Minify()
+	expected = "const a={};a[\"a b\"]=a['x + y'];a.a=a[\"_size\"];"
+	if result != expected {
+		t.Errorf("Computed member strings changed while renaming.\nExpected: %s\nGot: %s", expected, result)
+	}
+}
+
+// TestQuotes tests that string literals are rewritten to the chosen quote
+// only when that adds no escapes, and that -quotes keeps them by default
+func TestQuotes(t *testing.T) {
+	testCases := []struct {
+		name     string
+		quote    byte
+		input    string
+		expected string
+	}{
+		{"Keep", 0, `say("no quotes", 'single');`, `say("no quotes",'single');`},
+		{"Single", '\'', `say("no quotes", "it's", 'kept');`, `say('no quotes',"it's",'kept');`},
+		{"Dropped Escapes", '\'', `say("a \"quoted\" word", "back\\slash");`, `say('a "quoted" word','back\\slash');`},
+		{"Double", '"', `import {a} from 'm'; say('it\'s', 'say "hi"');`, `import{a}from "m";say("it's",'say "hi"');`},
+		{"Templates And Regexes", '\'', "say(`\"x\"`, /\"/g);", "say(`\"x\"`,/\"/g);"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			opts := DefaultOptions()
+			opts.Quote = tc.quote
+			if result := NewMinifierWithOptions(tc.input, opts).Minify(); result != tc.expected {
+				t.Errorf("Expected: %s\nGot: %s", tc.expected, result)
+			}
+		})
+	}
+
+	if code := run([]string{"-input", "missing.js", "-quotes", "backtick"}); code != 1 {
+		t.Errorf("Expected exit code 1 for an unknown quote style, got %d", code)
+	}
+}
+
+// TestMinifierKeepBlockComments tests stripping line comments while keeping block comments
+func TestMinifierKeepBlockComments(t *testing.T) {
+	input := `/* block comment */
+function test() {
+	// line comment
+	return 1;
+}`
+
+	opts := DefaultOptions()
+	opts.StripBlockComments = false
+	minifier := NewMinifierWithOptions(input, opts)
+	result := minifier.Minify()
+
+	if !strings.Contains(result, "/* block comment */") {
+		t.Errorf("Block comment was not kept.\nGot: %s", result)
+	}
+	if strings.Contains(result, "line comment") {
+		t.Errorf("Line comment was not stripped.\nGot: %s", result)
+	}
+}
+
+// TestMinifierKeepLineComments tests stripping block comments while keeping line comments
+func TestMinifierKeepLineComments(t *testing.T) {
+	input := `/* block comment */
+function test() {
+	// line comment
+	return 1;
+}`
+
+	opts := DefaultOptions()
+	opts.StripLineComments = false
+	minifier := NewMinifierWithOptions(input, opts)
+	result := minifier.Minify()
+
+	if !strings.Contains(result, "// line comment\n") {
+		t.Errorf("Line comment was not kept on its own line.\nGot: %s", result)
+	}
+	if strings.Contains(result, "block comment") {
+		t.Errorf("Block comment was not stripped.\nGot: %s", result)
+	}
+	if !strings.Contains(result, "return 1;") {
+		t.Errorf("Code following the kept line comment was lost.\nGot: %s", result)
+	}
+}
+
+// TestHTMLLikeComments tests that `<!--` starts a line comment anywhere and
+// `-->` only at the start of a line, as in scripts, while the `-->` of
+// `a-- > 0` is still code
+func TestHTMLLikeComments(t *testing.T) {
+	input := "<!-- hide from old browsers\nvar count = 1; <!-- trailing note\nwhile (count --> 0) { step(); }\n  --> end of hiding\nx = y-->z;"
+
+	if result := NewMinifier(input, false, false).Minify(); result != "var count=1;while(count-->0){step();}x=y-->z;" {
+		t.Errorf("HTML-like comments were not stripped.\nGot: %s", result)
+	}
+
+	// A kept `-->` comment becomes a `//` comment, which needs no line of
+	// its own
+	opts := DefaultOptions()
+	opts.StripLineComments = false
+	expected := "<!-- hide from old browsers\nvar count=1;<!-- trailing note\nwhile(count-->0){step();}//--> end of hiding\nx=y-->z;"
+	if result := NewMinifierWithOptions(input, opts).Minify(); result != expected {
+		t.Errorf("HTML-like comments were not kept.\nExpected: %q\nGot: %q", expected, result)
+	}
+}
+
+// TestCommentPolicy tests the all, some and none comment policies
+func TestCommentPolicy(t *testing.T) {
+	input := "/*! Lib v1 */\n// setup\nconst a = 1; /* note */\n/** @license MIT */\nfunction f() { return a; }\n"
+	testCases := []struct {
+		policy   string
+		expected string
+	}{
+		{"none", "const a=1;function f(){return a;}"},
+		{"some", "/*! Lib v1 */\nconst a=1;/** @license MIT */function f(){return a;}"},
+		{"all", "/*! Lib v1 */\n// setup\nconst a=1;/* note *//** @license MIT */function f(){return a;}"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.policy, func(t *testing.T) {
+			opts := DefaultOptions()
+			opts.PreserveJSDoc = true
+			if err := applyCommentPolicy(&opts, tc.policy); err != nil {
+				t.Fatalf("Failed to apply policy: %v", err)
+			}
+			result := NewMinifierWithOptions(input, opts).Minify()
+			if result != tc.expected {
+				t.Errorf("Policy %s failed.\nExpected: %q\nGot: %q", tc.policy, tc.expected, result)
+			}
+		})
+	}
+
+	if code := run([]string{"-input", "app.js", "-comments", "most"}); code != 1 {
+		t.Errorf("Expected exit code 1 for an unknown policy, got %d", code)
+	}
+}
+
+// TestPresets tests the options each preset turns on, and that flags add
+// to a preset or turn off what it turned on
+func TestPresets(t *testing.T) {
+	conservative := DefaultOptions()
+	conservative.PreserveLicense = true
+	conservative.StripLineComments = false
+	conservative.StripBlockComments = false
+
+	aggressive := DefaultOptions()
+	aggressive.ShortenVars = true
+	aggressive.FrequencyNames = true
+	aggressive.MergeImports = true
+
+	terserLike := aggressive
+	terserLike.PreserveLicense = true
+	terserLike.KeepLegalComments = true
+
+	testCases := []struct {
+		preset   string
+		expected Options
+	}{
+		{"conservative", conservative},
+		{"balanced", DefaultOptions()},
+		{"aggressive", aggressive},
+		{"terser-like", terserLike},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.preset, func(t *testing.T) {
+			opts := DefaultOptions()
+			if err := applyPreset(&opts, tc.preset); err != nil {
+				t.Fatalf("Failed to apply preset: %v", err)
+			}
+			if !reflect.DeepEqual(opts, tc.expected) {
+				t.Errorf("Preset %s.\nExpected: %+v\nGot: %+v", tc.preset, tc.expected, opts)
+			}
+		})
+	}
+
+	dir := t.TempDir()
+	inputPath := filepath.Join(dir, "app.js")
+	input := "/*! MIT */\n// note\nconst total = 1;\n"
+	if err := ioutil.WriteFile(inputPath, []byte(input), 0644); err != nil {
+		t.Fatalf("Failed to write input file: %v", err)
+	}
+	if code := run([]string{"-input", inputPath, "-preset", "conservative", "-shorten-vars"}); code != 0 {
+		t.Fatalf("Expected exit code 0, got %d", code)
+	}
+	content, err := ioutil.ReadFile(filepath.Join(dir, "app.min.js"))
+	if err != nil {
+		t.Fatalf("Failed to read output file: %v", err)
+	}
+	if expected := "/*! MIT */\n// note\nconst a=1;"; string(content) != expected {
+		t.Errorf("Expected %q, got %q", expected, string(content))
+	}
+
+	if err := os.Remove(filepath.Join(dir, "app.min.js")); err != nil {
+		t.Fatalf("Failed to remove output file: %v", err)
+	}
+	if code := run([]string{"-input", inputPath, "-preset", "aggressive", "-shorten-vars=false"}); code != 0 {
+		t.Fatalf("Expected exit code 0, got %d", code)
+	}
+	content, err = ioutil.ReadFile(filepath.Join(dir, "app.min.js"))
+	if err != nil {
+		t.Fatalf("Failed to read output file: %v", err)
+	}
+	if expected := "const total=1;"; string(content) != expected {
+		t.Errorf("Expected %q, got %q", expected, string(content))
+	}
+
+	if code := run([]string{"-input", inputPath, "-preset", "reckless"}); code != 1 {
+		t.Errorf("Expected exit code 1 for an unknown preset, got %d", code)
+	}
+}
+
+// TestSourceMappingURL tests that an existing sourceMappingURL comment is
+// stripped unless it is explicitly kept
+func TestSourceMappingURL(t *testing.T) {
+	input := "function f() {\n  return 1; // one\n}\n//# sourceMappingURL=app.js.map\n"
+	testCases := []struct {
+		name     string
+		keepLine bool
+		keepURL  bool
+		expected string
+	}{
+		{"Stripped", false, false, "function f(){return 1;}"},
+		{"Stripped With Line Comments", true, false, "function f(){return 1;// one\n}"},
+		{"Kept", false, true, "function f(){return 1;}//# sourceMappingURL=app.js.map\n"},
+		{"Kept With Line Comments", true, true, "function f(){return 1;// one\n}//# sourceMappingURL=app.js.map\n"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			opts := DefaultOptions()
+			opts.StripLineComments = !tc.keepLine
+			opts.KeepSourceMappingURL = tc.keepURL
+			result := NewMinifierWithOptions(input, opts).Minify()
+			if result != tc.expected {
+				t.Errorf("Expected: %q\nGot: %q", tc.expected, result)
+			}
+		})
+	}
+}
+
+// TestPureAnnotations tests that PURE and NO_SIDE_EFFECTS annotations are
+// stripped by default, even when block comments are kept, and kept on
+// request
+func TestPureAnnotations(t *testing.T) {
+	input := "/* note */\nconst app = /*#__PURE__*/ createApp(config);\nconst store = /* @__PURE__ */ new Store();\n" +
+		"/*#__NO_SIDE_EFFECTS__*/\nfunction make() { return {}; }"
+	testCases := []struct {
+		name      string
+		keepBlock bool
+		keepPure  bool
+		expected  string
+	}{
+		{"Stripped", false, false, "const app=createApp(config);const store=new Store();function make(){return{};}"},
+		{"Stripped With Block Comments", true, false, "/* note */const app=createApp(config);const store=new Store();function make(){return{};}"},
+		{"Kept", false, true, "const app=/*#__PURE__*/createApp(config);const store=/* @__PURE__ */new Store();/*#__NO_SIDE_EFFECTS__*/function make(){return{};}"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			opts := DefaultOptions()
+			opts.StripBlockComments = !tc.keepBlock
+			opts.KeepPureAnnotations = tc.keepPure
+			result := NewMinifierWithOptions(input, opts).Minify()
+			if result != tc.expected {
+				t.Errorf("Expected: %q\nGot: %q", tc.expected, result)
+			}
+		})
+	}
+}
+
+// TestMinifierPreserveJSDoc tests that JSDoc blocks before declarations can be kept
+func TestMinifierPreserveJSDoc(t *testing.T) {
+	input := `/**
+ * Adds two numbers.
+ * @param {number} a
+ */
+export function add(a, b) {
+	/** not attached to a declaration */
+	return a + b;
+}`
+
+	opts := DefaultOptions()
+	opts.PreserveJSDoc = true
+	result := NewMinifierWithOptions(input, opts).Minify()
+
+	if !strings.Contains(result, "/**\n * Adds two numbers.\n * @param {number} a\n */export function add(a,b){") {
+		t.Errorf("JSDoc before export function was not preserved.\nGot: %s", result)
+	}
+	if strings.Contains(result, "not attached") {
+		t.Errorf("JSDoc not preceding a declaration was kept.\nGot: %s", result)
+	}
+
+	result = NewMinifier(input, false, false).Minify()
+	if strings.Contains(result, "Adds two numbers") {
+		t.Errorf("JSDoc was kept without the option.\nGot: %s", result)
+	}
+}
+
+// TestMinifierKeepSpacesAround tests disabling whitespace collapse for specific operators
+func TestMinifierKeepSpacesAround(t *testing.T) {
+	input := `function calc(a, b) {
+	return a + b - 1;
+}`
+	expected := "function calc(a,b){return a + b - 1;}"
+
+	opts := DefaultOptions()
+	opts.KeepSpacesAround = "+-"
+	result := NewMinifierWithOptions(input, opts).Minify()
+
+	if result != expected {
+		t.Errorf("Spaces around + and - were not kept.\nExpected: %s\nGot: %s", expected, result)
+	}
+}
+
+// TestRegexDivisionHeuristic tests telling regular expression literals from division
+func TestRegexDivisionHeuristic(t *testing.T) {
+	testCases := []TestCase{
+		{
+			Name:           "Division After Identifier",
+			Input:          "return a / b;",
+			ExpectedOutput: "return a/b;",
+		},
+		{
+			Name:           "Regex After Assignment",
+			Input:          "x = /re/.exec(s);",
+			ExpectedOutput: "x=/re/.exec(s);",
+		},
+		{
+			Name:           "Division Across Newline",
+			Input:          "a = b\n/re/g;",
+			ExpectedOutput: "a=b/re/g;",
+		},
+		{
+			Name:           "Chained Division",
+			Input:          "x = a / b / c;",
+			ExpectedOutput: "x=a/b/c;",
+		},
+		{
+			Name:           "Division After Call",
+			Input:          "half = total() / 2;",
+			ExpectedOutput: "half=total()/2;",
+		},
+		{
+			Name:           "Division After Postfix Increment",
+			Input:          "y = i++ / 2;",
+			ExpectedOutput: "y=i++/2;",
+		},
+		{
+			Name:           "Regex After Paren",
+			Input:          "if (/^a b/.test(s)) { go(); }",
+			ExpectedOutput: "if(/^a b/.test(s)){go();}",
+		},
+		{
+			Name:           "Regex After Keyword",
+			Input:          "return /a, b/.test(s);",
+			ExpectedOutput: "return /a, b/.test(s);",
+		},
+		{
+			Name:           "Regex After Return In Function",
+			Input:          "function isNumber(s) {\n\treturn /\\d+/.test(s);\n}",
+			ExpectedOutput: "function isNumber(s){return /\\d+/.test(s);}",
+		},
+		{
+			Name:           "Regex Directly After Return",
+			Input:          "if (s) return/x/g.exec(s);",
+			ExpectedOutput: "if(s)return/x/g.exec(s);",
+		},
+		{
+			Name:           "Regex After Typeof",
+			Input:          "kind = typeof /a/;",
+			ExpectedOutput: "kind=typeof /a/;",
+		},
+		{
+			Name:           "Regex After Void And Delete",
+			Input:          "a = void / +/g, b = delete / x /.y;",
+			ExpectedOutput: "a=void / +/g,b=delete / x /.y;",
+		},
+		{
+			Name:           "Regex After Unary Operators",
+			Input:          "if (!/ +/.test(s) && ~/ x /.exec(s)) f(-/ 1 /.lastIndex);",
+			ExpectedOutput: "if(!/ +/.test(s)&&~/ x /.exec(s))f(-/ 1 /.lastIndex);",
+		},
+		{
+			Name:           "Regex With Slash In Class",
+			Input:          "const r = /[/ ]+/g;",
+			ExpectedOutput: "const r=/[/ ]+/g;",
+		},
+		{
+			Name:           "Regex With Escaped Slash",
+			Input:          "s.replace(/\\/ +/g, \"/\");",
+			ExpectedOutput: "s.replace(/\\/ +/g,\"/\");",
+		},
+		{
+			Name:           "Regex After Block",
+			Input:          "function f() {}\n/ x /.test(s);",
+			ExpectedOutput: "function f(){}/ x /.test(s);",
+		},
+		{
+			Name:           "Division Of Literal",
+			Input:          "ratio = \"6\" / 3 / 1;",
+			ExpectedOutput: "ratio=\"6\"/3/1;",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			minifier := NewMinifier(tc.Input, false, false)
+			result := minifier.Minify()
+			checkIncremental(t, tc)
+			if result != tc.ExpectedOutput {
+				t.Errorf("%s failed.\nExpected: %s\nGot: %s", tc.Name, tc.ExpectedOutput, result)
+			}
+		})
+	}
+}
+
+// TestRegexQuantifierBraces tests that braces and commas inside regex quantifiers are untouched
+func TestRegexQuantifierBraces(t *testing.T) {
+	testCases := []TestCase{
+		{
+			Name:           "Range Quantifier",
+			Input:          "const re = /a{2,3}/;",
+			ExpectedOutput: "const re=/a{2,3}/;",
+		},
+		{
+			Name:           "Quantifier With Space",
+			Input:          "const re = /x{1, 2}/g;",
+			ExpectedOutput: "const re=/x{1, 2}/g;",
+		},
+		{
+			Name:           "Quantifier Inside Block",
+			Input:          "if (ok) {\n\tmatch(/^\\d{ 3 }$/);\n}",
+			ExpectedOutput: "if(ok){match(/^\\d{ 3 }$/);}",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			minifier := NewMinifier(tc.Input, false, false)
+			result := minifier.Minify()
+			checkIncremental(t, tc)
+			if result != tc.ExpectedOutput {
+				t.Errorf("%s failed.\nExpected: %s\nGot: %s", tc.Name, tc.ExpectedOutput, result)
+			}
+		})
+	}
+}
+
+// TestRegexFlags tests that the flags after a regular expression literal
+// stay part of it, so that they are neither renamed nor separated from it,
+// and that a word after the flags keeps its space
+func TestRegexFlags(t *testing.T) {
+	testCases := []TestCase{
+		{
+			Name:           "All Flags",
+			Input:          "const words = /\\w+/gimsuy;\nconst has = /b/d.hasIndices;",
+			ExpectedOutput: "const words=/\\w+/gimsuy;const has=/b/d.hasIndices;",
+		},
+		{
+			Name:           "Flags Before Keyword",
+			Input:          "const ok = /a/g instanceof RegExp;",
+			ExpectedOutput: "const ok=/a/g instanceof RegExp;",
+		},
+		{
+			// Not a valid regular expression, but the flags still end
+			// where the word does, just as JavaScript reads them
+			Name:           "Invalid Flag",
+			Input:          "const re = /x/gq, n = 1;",
+			ExpectedOutput: "const re=/x/gq,n=1;",
+		},
+		{
+			Name:           "Parameters Named Like Flags",
+			Input:          "function f(g, i) { return /\\w+/gi.test(g + i); }",
+			ExpectedOutput: "function f(a,b){return /\\w+/gi.test(a+b);}",
+			Options:        MinificationOptions{ShortenVars: true},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			minifier := NewMinifier(tc.Input, tc.Options.PreserveLicense, tc.Options.ShortenVars)
+			result := minifier.Minify()
+			checkIncremental(t, tc)
+			if result != tc.ExpectedOutput {
+				t.Errorf("%s failed.\nExpected: %s\nGot: %s", tc.Name, tc.ExpectedOutput, result)
+			}
+		})
+	}
+}
+
+// TestMinifierBanner tests that the banner follows the license and states the reduction
+func TestMinifierBanner(t *testing.T) {
+	input := `/*! MIT License */
+function add(first, second) {
+	// Add both values
+	return first + second;
+}`
+
+	opts := DefaultOptions()
+	opts.PreserveLicense = true
+	opts.Banner = true
+	result := NewMinifierWithOptions(input, opts).Minify()
+
+	code := "function add(first,second){return first+second;}"
+	license := "/*! MIT License */\n"
+	banner := bannerComment(len(input), len(license)+len(code))
+	expected := license + banner + code
+	if result != expected {
+		t.Errorf("Banner was not placed after the license.\nExpected: %s\nGot: %s", expected, result)
+	}
+
+	reduction := float64(len(input)-len(license)-len(code)) / float64(len(input)) * 100
+	if !strings.Contains(banner, fmt.Sprintf("minified: %.0f%% smaller", reduction)) {
+		t.Errorf("Banner does not state the reduction of %.0f%%: %s", reduction, banner)
+	}
+}
+
+// TestTrailingLineComments tests that statements ending in a line comment
+// without a semicolon are kept apart after the comment is removed
+func TestTrailingLineComments(t *testing.T) {
+	testCases := []TestCase{
+		{
+			Name:           "Consecutive Declarations",
+			Input:          "let x = 1 // first\nlet y = 2 // second\nlet z = x + y",
+			ExpectedOutput: "let x=1\nlet y=2\nlet z=x+y",
+		},
+		{
+			Name:           "Call After Comment",
+			Input:          "count++ // bump\nrender()",
+			ExpectedOutput: "count++\nrender()",
+		},
+		{
+			Name:           "String After Comment",
+			Input:          "const a = b // note\n'use'.length",
+			ExpectedOutput: "const a=b\n'use'.length",
+		},
+		{
+			Name:           "Return Before Parenthesis",
+			Input:          "function f() {\n\treturn // nothing\n\t(value)\n}",
+			ExpectedOutput: "function f(){return\n(value)}",
+		},
+		{
+			Name:           "Prefix Increment On Next Line",
+			Input:          "total = base // copy\n++count",
+			ExpectedOutput: "total=base\n++count",
+		},
+		{
+			Name:           "Block Comment Spanning Lines",
+			Input:          "let x = 1/* first\n second */let y = 2",
+			ExpectedOutput: "let x=1\nlet y=2",
+		},
+		{
+			Name:           "Semicolons Need No Separator",
+			Input:          "let x = 1; // first\nlet y = 2; // second",
+			ExpectedOutput: "let x=1;let y=2;",
+		},
+		{
+			Name:           "Chained Call On Next Line",
+			Input:          "list // items\n\t.map(f)",
+			ExpectedOutput: "list.map(f)",
+		},
+		{
+			Name:           "Block After Declaration",
+			Input:          "var x = 1 // one\n{ foo() }\nlet s = 'a'\n{ bar() }",
+			ExpectedOutput: "var x=1\n{foo()}\nlet s='a'\n{bar()}",
+		},
+		{
+			Name:           "Block After Expression",
+			Input:          "x = y\n{ z() }\nlist = [1]\n{ h() }",
+			ExpectedOutput: "x=y\n{z()}\nlist=[1]\n{h()}",
+		},
+		{
+			Name:           "Brace After Keyword",
+			Input:          "if (a)\n{\n  b()\n}\nelse\n{\n  c()\n}\ntry\n{\n  d()\n}\nfinally\n{\n  e()\n}",
+			ExpectedOutput: "if(a){b()}else{c()}try{d()}finally{e()}",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			minifier := NewMinifier(tc.Input, false, false)
+			result := minifier.Minify()
+			checkIncremental(t, tc)
+			if result != tc.ExpectedOutput {
+				t.Errorf("%s failed.\nExpected: %q\nGot: %q", tc.Name, tc.ExpectedOutput, result)
+			}
+		})
+	}
+}
+
+// TestCommentsInLiterals tests that comment-like text inside strings,
+// templates and regular expressions is kept, while the real comments
+// around it are removed
+func TestCommentsInLiterals(t *testing.T) {
+	testCases := []TestCase{
+		{
+			Name:           "Block Comment In String",
+			Input:          "const s = \"a /* not a comment */ b\"; /* real */",
+			ExpectedOutput: "const s=\"a /* not a comment */ b\";",
+		},
+		{
+			Name:           "Line Comment In String",
+			Input:          "const t = 'x // not a comment'; // real\nrun(t);",
+			ExpectedOutput: "const t='x // not a comment';run(t);",
+		},
+		{
+			Name:           "Comment Delimiters Split Across Strings",
+			Input:          "const open = \"/*\", close = \"*/\"; /* real */ const mid = 1;",
+			ExpectedOutput: "const open=\"/*\",close=\"*/\";const mid=1;",
+		},
+		{
+			Name:           "Template With Real Comment In Substitution",
+			Input:          "const u = `tpl /* ${s /* real */} */ end`;",
+			ExpectedOutput: "const u=`tpl /* ${s} */ end`;",
+		},
+		{
+			Name:           "Regular Expression",
+			Input:          "const r = /a\\/*b/g; // real",
+			ExpectedOutput: "const r=/a\\/*b/g;",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			minifier := NewMinifier(tc.Input, tc.Options.PreserveLicense, tc.Options.ShortenVars)
+			result := minifier.Minify()
+			checkIncremental(t, tc)
+			if result != tc.ExpectedOutput {
+				t.Errorf("%s failed.\nExpected: %s\nGot: %s", tc.Name, tc.ExpectedOutput, result)
+			}
+		})
+	}
+}
+
+// TestLineContinuations tests string literals continued on the next line
+// by a backslash before the line break, which are one literal whose
+// contents, including the indentation after the break, are kept as they are
+func TestLineContinuations(t *testing.T) {
+	testCases := []TestCase{
+		{
+			Name:           "Continued String",
+			Input:          "var s = \"abc\\\ndef\";\nrun(s);",
+			ExpectedOutput: "var s=\"abc\\\ndef\";run(s);",
+		},
+		{
+			Name:           "Indented Continuation",
+			Input:          "var s = 'one \\\n    two';",
+			ExpectedOutput: "var s='one \\\n    two';",
+		},
+		{
+			Name:           "CRLF Continuation",
+			Input:          "var s = \"a\\\r\n// b\";\r\nrun(s);",
+			ExpectedOutput: "var s=\"a\\\r\n// b\";run(s);",
+		},
+		{
+			Name:           "Repeated Continuations",
+			Input:          "var s = \"x\\\n\\\ny\" ;",
+			ExpectedOutput: "var s=\"x\\\n\\\ny\";",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			minifier := NewMinifier(tc.Input, tc.Options.PreserveLicense, tc.Options.ShortenVars)
+			result := minifier.Minify()
+			checkIncremental(t, tc)
+			if result != tc.ExpectedOutput {
+				t.Errorf("%s failed.\nExpected: %q\nGot: %q", tc.Name, tc.ExpectedOutput, result)
+			}
+		})
+	}
+}
+
+// TestStatementStartHazards tests lines starting with `(`, `[` or a template
+// literal after a statement without a semicolon. JavaScript does not insert
+// a semicolon there, so the line continues the statement, and joining the
+// lines keeps that meaning; a protective semicolon written in the source is
+// kept, and so is the line break where a semicolon is inserted, as after
+// the body of an arrow function
+func TestStatementStartHazards(t *testing.T) {
+	testCases := []TestCase{
+		{
+			Name:           "Parenthesis Continues The Call",
+			Input:          "a = b\n(c)",
+			ExpectedOutput: "a=b(c)",
+		},
+		{
+			Name:           "Bracket Continues The Member Access",
+			Input:          "const x = y\n[0, 1].forEach(f)",
+			ExpectedOutput: "const x=y[0,1].forEach(f)",
+		},
+		{
+			Name:           "Template Continues As A Tagged Template",
+			Input:          "t = tag\n`text`",
+			ExpectedOutput: "t=tag\n`text`",
+		},
+		{
+			Name:           "Protective Semicolons",
+			Input:          "let v = 1\n;(function () {})()\nlet w = 2\n;[1, 2].map(g)",
+			ExpectedOutput: "let v=1;(function(){})()\nlet w=2;[1,2].map(g)",
+		},
+		{
+			Name:           "Block Before Parenthesis",
+			Input:          "if (ok) { run() }\n(cleanup || noop)()",
+			ExpectedOutput: "if(ok){run()}(cleanup||noop)()",
+		},
+		{
+			Name:           "Arrow Body Ends The Statement",
+			Input:          "const handler = (e) => { e.preventDefault() }\n(function(){ init() })()\nconst f = () => {}\n[a, b] = c\nconst g = () => {}\n`t`\nconst h = x => {}\n, k = 1",
+			ExpectedOutput: "const handler=(e)=>{e.preventDefault()}\n(function(){init()})()\nconst f=()=>{}\n[a,b]=c\nconst g=()=>{}\n`t`\nconst h=x=>{},k=1",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			minifier := NewMinifier(tc.Input, tc.Options.PreserveLicense, tc.Options.ShortenVars)
+			result := minifier.Minify()
+			checkIncremental(t, tc)
+			if result != tc.ExpectedOutput {
+				t.Errorf("%s failed.\nExpected: %s\nGot: %s", tc.Name, tc.ExpectedOutput, result)
+			}
+		})
+	}
+}
+
+// TestWordOperatorSpacing tests that the spaces separating the instanceof,
+// in, delete and void operators from their operands survive minification
+func TestWordOperatorSpacing(t *testing.T) {
+	testCases := []TestCase{
+		{
+			Name:           "Instanceof",
+			Input:          "if (x instanceof Array) {\n\treturn x;\n}",
+			ExpectedOutput: "if(x instanceof Array){return x;}",
+		},
+		{
+			Name:           "In After String",
+			Input:          "const found = \"key\" in obj;",
+			ExpectedOutput: "const found=\"key\" in obj;",
+		},
+		{
+			Name:           "For In",
+			Input:          "for (const key in obj) {\n\tcount++;\n}",
+			ExpectedOutput: "for(const key in obj){count++;}",
+		},
+		{
+			Name:           "Delete",
+			Input:          "delete a.b;\ndelete  cache[key];\nif (x) delete a.c\nelse delete a.d",
+			ExpectedOutput: "delete a.b;delete cache[key];if(x)delete a.c\nelse delete a.d",
+		},
+		{
+			Name:           "Void",
+			Input:          "const nothing = void 0, call = void run(), paren = void (0), re = void /x/.test(s);",
+			ExpectedOutput: "const nothing=void 0,call=void run(),paren=void(0),re=void /x/.test(s);",
+		},
+		{
+			Name:           "Keywords As Property Names",
+			Input:          "const half = stats.delete / 2, third = obj.void / 3 / 4;",
+			ExpectedOutput: "const half=stats.delete/2,third=obj.void/3/4;",
+		},
+		{
+			Name:           "Shortened Operands",
+			Input:          "const items = [];\nconst ok = items instanceof Array && \"length\" in items;",
+			ExpectedOutput: "const a=[];const b=a instanceof Array&&\"length\" in a;",
+			Options:        MinificationOptions{ShortenVars: true},
+		},
+		{
+			Name:           "In With Ternary",
+			Input:          "const pick = key in obj ? a : b;",
+			ExpectedOutput: "const pick=key in obj?a:b;",
+		},
+		{
+			Name:           "In In Ternary Branches",
+			Input:          "const pick = \"k\" in obj ? x in y : z instanceof W;",
+			ExpectedOutput: "const pick=\"k\" in obj?x in y:z instanceof W;",
+		},
+		{
+			Name:           "In With Ternary In For Body",
+			Input:          "for (const key in source) {\n\tcopy(key in target ? target : source);\n}",
+			ExpectedOutput: "for(const a in source){copy(a in target?target:source);}",
+			Options:        MinificationOptions{ShortenVars: true},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			minifier := NewMinifier(tc.Input, tc.Options.PreserveLicense, tc.Options.ShortenVars)
+			result := minifier.Minify()
+			checkIncremental(t, tc)
+			if result != tc.ExpectedOutput {
+				t.Errorf("%s failed.\nExpected: %s\nGot: %s", tc.Name, tc.ExpectedOutput, result)
+			}
+		})
+	}
+}
+
+// TestRequiredSpaces tests, for each pair of tokens that may be separated
+// by a space, whether the space survives: by default the spaces the
+// grammar needs are kept along with those next to literals, and with
+// RequiredSpaces only the spaces the grammar needs are
+func TestRequiredSpaces(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected string // by default
+		required string // with RequiredSpaces
+		keep     string // KeepSpacesAround
+	}{
+		{"Word Word", "x = a in b;", "x=a in b;", "x=a in b;", ""},
+		{"Keyword Name", "let value = typeof item;", "let value=typeof item;", "let value=typeof item;", ""},
+		{"Number Word", "x = 1 in list;", "x=1 in list;", "x=1 in list;", ""},
+		{"Number Member", "x = 1 .toString();", "x=1 .toString();", "x=1 .toString();", ""},
+		{"Word Unicode Escape", "x = typeof \\u0061;", "x=typeof \\u0061;", "x=typeof \\u0061;", ""},
+		{"Regex Flags Word", "x = /a/g in o;", "x=/a/g in o;", "x=/a/g in o;", ""},
+		{"Plus Plus", "x = a + +b;", "x=a+ +b;", "x=a+ +b;", ""},
+		{"Plus Increment", "x = a + ++b;", "x=a+ ++b;", "x=a+ ++b;", ""},
+		{"Minus Minus", "x = a - -b;", "x=a- -b;", "x=a- -b;", ""},
+		{"Minus Decrement", "x = a - --b;", "x=a- --b;", "x=a- --b;", ""},
+		{"Plus Minus", "x = a + -b;", "x=a+-b;", "x=a+-b;", ""},
+		{"Division Regex", "x = a / /re/.source;", "x=a/ /re/.source;", "x=a/ /re/.source;", ""},
+		{"Division Kept Comment", "x = a / /*! note */ b;", "x=a/ /*! note */b;", "x=a/ /*! note */b;", ""},
+		{"Comment Comment", "x = 1 /*! a */ /*! b */;", "x=1/*! a *//*! b */;", "x=1/*! a *//*! b */;", ""},
+		{"Less Than Not Decrement", "x = a < !--b;", "x=a< !--b;", "x=a< !--b;", ""},
+		{"Decrement Greater Than", "x = a-- > b;", "x=a-- >b;", "x=a-- >b;", ""},
+		{"Ternary Fraction", "x = a ? .5 : b;", "x=a?.5:b;", "x=a?.5:b;", ""},
+		{"Keyword Fraction", "function f() { return .5; }", "function f(){return .5;}", "function f(){return.5;}", ""},
+		{"String Word", "x = \"k\" in o;", "x=\"k\" in o;", "x=\"k\"in o;", ""},
+		{"Word String", "function f() { return \"x\"; }", "function f(){return \"x\";}", "function f(){return\"x\";}", ""},
+		{"Case String", "switch (a) { case \"a\": break; }", "switch(a){case \"a\":break;}", "switch(a){case\"a\":break;}", ""},
+		{"Word Template", "void `x`;", "void `x`;", "void`x`;", ""},
+		{"Template Word", "x = `t` instanceof T;", "x=`t` instanceof T;", "x=`t`instanceof T;", ""},
+		{"Regex Word", "x = /a/ in o;", "x=/a/ in o;", "x=/a/ in o;", ""},
+		{"Regex Operator", "x = /a/ + b;", "x=/a/+b;", "x=/a/+b;", ""},
+		{"Regex Division", "x = /a/ / 2;", "x=/a/ /2;", "x=/a/ /2;", ""},
+		{"Regex Multiplication", "x = /a/ * 2;", "x=/a/ *2;", "x=/a/ *2;", ""},
+		{"Regex Flags Division", "x = /a/g / 2;", "x=/a/g/2;", "x=/a/g/2;", ""},
+		{"Comment Word", "x = a /*! a */ in o;", "x=a /*! a */ in o;", "x=a/*! a */in o;", ""},
+		{"Modulo", "x = a % b;", "x=a % b;", "x=a%b;", ""},
+		{"Xor Not", "x = a ^ ~ b;", "x=a ^ ~ b;", "x=a^~b;", ""},
+		{"Private Name", "class C { static #p = 1; }", "class C{static #p=1;}", "class C{static#p=1;}", ""},
+		{"Kept Operator", "x = \"a\" + b;", "x=\"a\" + b;", "x=\"a\" + b;", "+"},
+		{"Line Break Kept", "let a = 1\nlet b = \"x\"\n", "let a=1\nlet b=\"x\"", "let a=1\nlet b=\"x\"", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := DefaultOptions()
+			opts.KeepLegalComments = true
+			opts.KeepSpacesAround = tt.keep
+			if result := NewMinifierWithOptions(tt.input, opts).Minify(); result != tt.expected {
+				t.Errorf("Expected: %s\nGot: %s", tt.expected, result)
+			}
+			opts.RequiredSpaces = true
+			if result := NewMinifierWithOptions(tt.input, opts).Minify(); result != tt.required {
+				t.Errorf("With RequiredSpaces expected: %s\nGot: %s", tt.required, result)
+			}
+		})
+	}
+}
+
+// TestYieldContext tests that yield is a keyword inside generators and an
+// ordinary name in sloppy-mode code outside them
+func TestYieldContext(t *testing.T) {
+	testCases := []TestCase{
+		{
+			Name:           "Yield In Generator",
+			Input:          "function* gen(value) {\n\tyield value;\n\tyield* other();\n}",
+			ExpectedOutput: "function*gen(value){yield value;yield*other();}",
+		},
+		{
+			Name:           "Regex After Yield",
+			Input:          "function* gen(s) {\n\tyield /a/g.test(s);\n}",
+			ExpectedOutput: "function*gen(s){yield /a/g.test(s);}",
+		},
+		{
+			Name:           "Generator Methods",
+			Input:          "class K {\n\tstatic *[Symbol.iterator]() { yield /a/.source; }\n\tplain() { return yield / 2 / 1; }\n}",
+			ExpectedOutput: "class K{static*[Symbol.iterator](){yield /a/.source;}plain(){return yield/2/1;}}",
+		},
+		{
+			Name:           "Yield As Name",
+			Input:          "var yield = 1;\nvar half = yield / 2 / 1;",
+			ExpectedOutput: "var yield=1;var half=yield/2/1;",
+		},
+		{
+			Name:           "Yield As Name After Generator",
+			Input:          "function* gen() { yield 1; }\nvar yield = 4, half = yield / 2 / 1;",
+			ExpectedOutput: "function*gen(){yield 1;}var yield=4,half=yield/2/1;",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			minifier := NewMinifier(tc.Input, tc.Options.PreserveLicense, tc.Options.ShortenVars)
+			result := minifier.Minify()
+			checkIncremental(t, tc)
+			if result != tc.ExpectedOutput {
+				t.Errorf("%s failed.\nExpected: %s\nGot: %s", tc.Name, tc.ExpectedOutput, result)
+			}
+		})
+	}
+}
+
+// TestLogicalAssignment tests that the ES2021 logical assignment operators
+// stay single operators, including when their targets are renamed
+func TestLogicalAssignment(t *testing.T) {
+	testCases := []TestCase{
+		{
+			Name:           "Or Assignment",
+			Input:          "x ||= getDefault();",
+			ExpectedOutput: "x||=getDefault();",
+		},
+		{
+			Name:           "And Assignment",
+			Input:          "options.enabled &&= check(options);",
+			ExpectedOutput: "options.enabled&&=check(options);",
+		},
+		{
+			Name:           "Nullish Assignment",
+			Input:          "cache[key] ??= { hits: 0 } ;",
+			ExpectedOutput: "cache[key]??={hits:0};",
+		},
+		{
+			Name:           "Shortened Targets",
+			Input:          "let first, second = 1, third;\nfirst ||= second ? third : 0;\nsecond &&= first;\nthird ??= second;",
+			ExpectedOutput: "let a,b=1,c;a||=b?c:0;b&&=a;c??=b;",
+			Options:        MinificationOptions{ShortenVars: true},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			minifier := NewMinifier(tc.Input, tc.Options.PreserveLicense, tc.Options.ShortenVars)
+			result := minifier.Minify()
+			checkIncremental(t, tc)
+			if result != tc.ExpectedOutput {
+				t.Errorf("%s failed.\nExpected: %s\nGot: %s", tc.Name, tc.ExpectedOutput, result)
+			}
+		})
+	}
+}
+
+// TestImportExpressions tests import.meta and dynamic import(), where
+// import is used as an expression rather than a declaration
+func TestImportExpressions(t *testing.T) {
+	testCases := []TestCase{
+		{
+			Name:           "Import Meta",
+			Input:          "const base = new URL('.', import.meta.url);",
+			ExpectedOutput: "const base=new URL('.',import.meta.url);",
+		},
+		{
+			Name:           "Dynamic Import",
+			Input:          "async function load() {\n\tconst mod = await import('./mod.js');\n\treturn mod.default;\n}",
+			ExpectedOutput: "async function load(){const mod=await import('./mod.js');return mod.default;}",
+		},
+		{
+			Name:           "Shortened Around Import Expressions",
+			Input:          "const base = import.meta.url;\nasync function load(modulePath) {\n\tconst mod = await import(modulePath), other = modulePath;\n\treturn mod.default + other + base;\n}",
+			ExpectedOutput: "const a=import.meta.url;async function load(b){const c=await import(b),d=b;return c.default+d+a;}",
+			Options:        MinificationOptions{ShortenVars: true},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			minifier := NewMinifier(tc.Input, tc.Options.PreserveLicense, tc.Options.ShortenVars)
+			result := minifier.Minify()
+			checkIncremental(t, tc)
+			if result != tc.ExpectedOutput {
+				t.Errorf("%s failed.\nExpected: %s\nGot: %s", tc.Name, tc.ExpectedOutput, result)
+			}
+		})
+	}
+}
+
+// TestOptionalChaining tests that `?.` and `??` next to each other stay
+// two operators in every optional chaining form
+func TestOptionalChaining(t *testing.T) {
+	testCases := []TestCase{
+		{
+			Name:           "Chain Then Nullish",
+			Input:          "const r = a?.b?.c ?? d;",
+			ExpectedOutput: "const r=a?.b?.c??d;",
+		},
+		{
+			Name:           "Index And Call",
+			Input:          "const r = a?.[i] ?? b?.();",
+			ExpectedOutput: "const r=a?.[i]??b?.();",
+		},
+		{
+			Name:           "Nullish Assignment",
+			Input:          "a?.b ??= c;\nconst r = a ?? (b ? c : d);",
+			ExpectedOutput: "a?.b??=c;const r=a??(b?c:d);",
+		},
+		{
+			Name:           "Ternary Before Decimal",
+			Input:          "const r = x ? .5 : y;",
+			ExpectedOutput: "const r=x?.5:y;",
+		},
+		{
+			Name:           "Shortened",
+			Input:          "function get(obj, key) { const value = obj?.[key] ?? obj?.fallback?.(key); return value; }",
+			ExpectedOutput: "function get(a,b){const c=a?.[b]??a?.fallback?.(b);return c;}",
+			Options:        MinificationOptions{ShortenVars: true},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			minifier := NewMinifier(tc.Input, tc.Options.PreserveLicense, tc.Options.ShortenVars)
+			result := minifier.Minify()
+			checkIncremental(t, tc)
+			if result != tc.ExpectedOutput {
+				t.Errorf("%s failed.\nExpected: %s\nGot: %s", tc.Name, tc.ExpectedOutput, result)
+			}
+		})
+	}
+}
+
+// TestArrowFunctions tests that `=>` stays one token next to block bodies,
+// expression bodies and parenthesized object literals, and that the
+// parentheses an object literal body needs are kept
+func TestArrowFunctions(t *testing.T) {
+	testCases := []TestCase{
+		{
+			Name:           "Block Body",
+			Input:          "const f = (x) => { return x };",
+			ExpectedOutput: "const f=(x)=>{return x};",
+		},
+		{
+			Name:           "Expression Body",
+			Input:          "const f = (x) => x;\nconst g = x => x >= 1;",
+			ExpectedOutput: "const f=(x)=>x;const g=x=>x>=1;",
+		},
+		{
+			Name:           "Object Literal Body",
+			Input:          "const f = () => ({a: 1});\nconst g = async x => ({ b: x });",
+			ExpectedOutput: "const f=()=>({a:1});const g=async x=>({b:x});",
+		},
+		{
+			Name:           "Curried",
+			Input:          "const f = a => b => { return a => b; };\nconst g = () => {};",
+			ExpectedOutput: "const f=a=>b=>{return a=>b;};const g=()=>{};",
+		},
+		{
+			Name:           "Shortened",
+			Input:          "const make = (key) => ({ [key]: key });\nconst wrap = (value) => { return () => value; };",
+			ExpectedOutput: "const a=(b)=>({[b]:b});const c=(d)=>{return()=>d;};",
+			Options:        MinificationOptions{ShortenVars: true},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			minifier := NewMinifier(tc.Input, tc.Options.PreserveLicense, tc.Options.ShortenVars)
+			result := minifier.Minify()
+			checkIncremental(t, tc)
+			if result != tc.ExpectedOutput {
+				t.Errorf("%s failed.\nExpected: %s\nGot: %s", tc.Name, tc.ExpectedOutput, result)
+			}
+		})
+	}
+}
+
+// TestDefaultParameters tests that default parameter values keep their
+// `=` and that a default referring to an earlier parameter is renamed with
+// it
+func TestDefaultParameters(t *testing.T) {
+	testCases := []TestCase{
+		{
+			Name:           "Earlier Parameter",
+			Input:          "function f(a = 1, b = a + 1) {}",
+			ExpectedOutput: "function f(a=1,b=a+1){}",
+		},
+		{
+			Name:           "Shortened",
+			Input:          "function f(first = 1, second = first + 1) {\n\treturn first * second;\n}",
+			ExpectedOutput: "function f(a=1,b=a+1){return a*b;}",
+			Options:        MinificationOptions{ShortenVars: true},
+		},
+		{
+			Name:           "Destructured Defaults",
+			Input:          "function f(first = 1, { second = first } = {}, [third = second * 2] = []) {\n\treturn third;\n}",
+			ExpectedOutput: "function f(a=1,{second:b=a}={},[c=b*2]=[]){return c;}",
+			Options:        MinificationOptions{ShortenVars: true},
+		},
+		{
+			Name:           "Arrow Function",
+			Input:          "const step = (count = 0, size = count || 1) => count + size;",
+			ExpectedOutput: "const a=(b=0,c=b||1)=>b+c;",
+			Options:        MinificationOptions{ShortenVars: true},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			minifier := NewMinifier(tc.Input, tc.Options.PreserveLicense, tc.Options.ShortenVars)
+			result := minifier.Minify()
+			checkIncremental(t, tc)
+			if result != tc.ExpectedOutput {
+				t.Errorf("%s failed.\nExpected: %s\nGot: %s", tc.Name, tc.ExpectedOutput, result)
+			}
+		})
+	}
+}
+
+// TestSuperCalls tests that super stays a keyword in constructor calls and
+// member accesses, keeping its spelling and joining the tokens after it
+func TestSuperCalls(t *testing.T) {
+	testCases := []TestCase{
+		{
+			Name:           "Constructor Call",
+			Input:          "class Dog extends Animal {\n  constructor(name) {\n    super (name);\n  }\n}",
+			ExpectedOutput: "class Dog extends Animal{constructor(name){super(name);}}",
+		},
+		{
+			Name:           "Member Access",
+			Input:          "class Dog extends Animal {\n  speak() { return super.speak() + super [\"x\"] + super.foo?.(); }\n}",
+			ExpectedOutput: "class Dog extends Animal{speak(){return super.speak()+super[\"x\"]+super.foo?.();}}",
+		},
+		{
+			Name:           "Shortened",
+			Input:          "class Dog extends Animal {\n  constructor(name, sound) {\n    super(name);\n    this.sound = super.foo(sound);\n  }\n}",
+			ExpectedOutput: "class Dog extends Animal{constructor(a,b){super(a);this.sound=super.foo(b);}}",
+			Options:        MinificationOptions{ShortenVars: true},
+		},
+		{
+			Name:           "Object Method",
+			Input:          "const dog = { __proto__: animal, speak() { return super.speak(); } };",
+			ExpectedOutput: "const a={__proto__:animal,speak(){return super.speak();}};",
+			Options:        MinificationOptions{ShortenVars: true},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			minifier := NewMinifier(tc.Input, tc.Options.PreserveLicense, tc.Options.ShortenVars)
+			result := minifier.Minify()
+			checkIncremental(t, tc)
+			if result != tc.ExpectedOutput {
+				t.Errorf("%s failed.\nExpected: %s\nGot: %s", tc.Name, tc.ExpectedOutput, result)
+			}
+		})
+	}
+}
+
+// TestClassModifiers tests that static, async, get and set keep the spaces
+// separating them from each other and from the member name, including where
+// only a stripped comment separated them, and that the line break after
+// async, which makes it a field of its own, is kept
+func TestClassModifiers(t *testing.T) {
+	testCases := []TestCase{
+		{
+			Name:           "Static Async Method",
+			Input:          "class A {\n  static async foo() { return 1; }\n}",
+			ExpectedOutput: "class A{static async foo(){return 1;}}",
+		},
+		{
+			Name:           "Accessors",
+			Input:          "class A {\n  static get x() { return 1; }\n  set x(v) {}\n  get [key]() {}\n}",
+			ExpectedOutput: "class A{static get x(){return 1;}set x(v){}get[key](){}}",
+		},
+		{
+			Name:           "Async Generators And Private Names",
+			Input:          "class A {\n  static async *gen() {}\n  static async #run() {}\n}",
+			ExpectedOutput: "class A{static async*gen(){}static async #run(){}}",
+		},
+		{
+			Name:           "Modifiers As Member Names",
+			Input:          "class A {\n  static static() {}\n  async async() {}\n  get get() {}\n}",
+			ExpectedOutput: "class A{static static(){}async async(){}get get(){}}",
+		},
+		{
+			Name:           "Comments Between Modifiers",
+			Input:          "class A {\n  static/* a */async/* b */foo() {}\n  get/**/x() {}\n}",
+			ExpectedOutput: "class A{static async foo(){}get x(){}}",
+		},
+		{
+			Name:           "Async Field Before Method",
+			Input:          "class A {\n  async\n  foo() {}\n}",
+			ExpectedOutput: "class A{async\nfoo(){}}",
+		},
+		{
+			Name:           "Object Literal Modifiers",
+			Input:          "const o = { async foo() {}, get x() { return 1; }, async *g() {} };",
+			ExpectedOutput: "const o={async foo(){},get x(){return 1;},async*g(){}};",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			minifier := NewMinifier(tc.Input, tc.Options.PreserveLicense, tc.Options.ShortenVars)
+			result := minifier.Minify()
+			checkIncremental(t, tc)
+			if result != tc.ExpectedOutput {
+				t.Errorf("%s failed.\nExpected: %s\nGot: %s", tc.Name, tc.ExpectedOutput, result)
+			}
+		})
+	}
+}
+
+// TestModuleAliases tests that the spaces around `as` in import and export
+// lists survive, with and without variable shortening
+func TestModuleAliases(t *testing.T) {
+	testCases := []TestCase{
+		{
+			Name:           "Named Imports",
+			Input:          "import {a as b, c as d} from 'm';\nuse(b, d);",
+			ExpectedOutput: "import{a as b,c as d}from 'm';use(b,d);",
+		},
+		{
+			Name:           "Namespace Import",
+			Input:          "import * as ns from \"n\";",
+			ExpectedOutput: "import*as ns from \"n\";",
+		},
+		{
+			Name:           "Export List",
+			Input:          "const foo = 1, baz = 2;\nexport { foo as bar, baz as default };",
+			ExpectedOutput: "const foo=1,baz=2;export{foo as bar,baz as default};",
+		},
+		{
+			Name:           "Namespace Re-export",
+			Input:          "export * as util from './util';",
+			ExpectedOutput: "export*as util from './util';",
+		},
+		{
+			Name:           "Shortened Around Aliases",
+			Input:          "import {a as b} from 'm';\nfunction f(value) {\n\tconst as = value;\n\treturn b(as);\n}",
+			ExpectedOutput: "import{a as b}from 'm';function f(c){const as=c;return b(as);}",
+			Options:        MinificationOptions{ShortenVars: true},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			minifier := NewMinifier(tc.Input, tc.Options.PreserveLicense, tc.Options.ShortenVars)
+			result := minifier.Minify()
+			checkIncremental(t, tc)
+			if result != tc.ExpectedOutput {
+				t.Errorf("%s failed.\nExpected: %s\nGot: %s", tc.Name, tc.ExpectedOutput, result)
+			}
+		})
+	}
+}
+
+// TestMergeImports tests combining imports that load the same module
+func TestMergeImports(t *testing.T) {
+	testCases := []TestCase{
+		{
+			Name:           "Two Named Imports",
+			Input:          "import {a} from 'm';\nimport {b} from 'm';\nuse(a, b);",
+			ExpectedOutput: "import{a,b}from 'm';use(a,b);",
+		},
+		{
+			Name:           "Default And Duplicates",
+			Input:          "import {a, b as c} from './lib.js';\nimport lib, {a} from \"./lib.js\";",
+			ExpectedOutput: "import lib,{a,b as c}from './lib.js';",
+		},
+		{
+			Name:           "Namespace And Conflicting Defaults Kept",
+			Input:          "import one from 'm';\nimport * as ns from 'm';\nimport two from 'm';\nimport {x} from 'm';",
+			ExpectedOutput: "import one,{x}from 'm';import*as ns from 'm';import two from 'm';",
+		},
+		{
+			Name:           "Without Semicolons",
+			Input:          "import {a} from 'm'\nimport x from 'n'\nimport {b, a} from 'm'\nuse(a, b, x)\nimport {c} from 'n'",
+			ExpectedOutput: "import{a,b}from 'm'\nimport x,{c}from 'n'\nuse(a,b,x)",
+		},
+		{
+			Name:           "Semicolon After The Merged Import",
+			Input:          "import {a} from 'm'\nimport {b} from 'm'; use(a, b)",
+			ExpectedOutput: "import{a,b}from 'm'\nuse(a,b)",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			opts := DefaultOptions()
+			opts.MergeImports = true
+			result := NewMinifierWithOptions(tc.Input, opts).Minify()
+			if result != tc.ExpectedOutput {
+				t.Errorf("%s failed.\nExpected: %s\nGot: %s", tc.Name, tc.ExpectedOutput, result)
+			}
+		})
+	}
+}
+
+// TestMinifierIIFE tests that immediately-invoked function expressions keep their structure
+func TestMinifierIIFE(t *testing.T) {
+	testCases := []TestCase{
+		{
+			Name:           "Function Expression",
+			Input:          "(function () {\n\treturn 1\n})();",
+			ExpectedOutput: "(function(){return 1})();",
+		},
+		{
+			Name:           "Arrow Function",
+			Input:          "(() => {\n\tinit();\n})();",
+			ExpectedOutput: "(()=>{init();})();",
+		},
+		{
+			Name:           "Invoked Inside Parens",
+			Input:          "(function named(a, b) {\n\treturn a + b;\n}(1, 2));",
+			ExpectedOutput: "(function named(a,b){return a+b;}(1,2));",
+		},
+		{
+			Name:           "Unary Prefix",
+			Input:          "!function () { run(); }();",
+			ExpectedOutput: "!function(){run();}();",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			minifier := NewMinifier(tc.Input, false, false)
+			result := minifier.Minify()
+			checkIncremental(t, tc)
+			if result != tc.ExpectedOutput {
+				t.Errorf("%s failed.\nExpected: %s\nGot: %s", tc.Name, tc.ExpectedOutput, result)
+			}
+		})
+	}
+
+	// The closure testdata wraps a module in an IIFE; its invocation must survive
+	content, err := ioutil.ReadFile(filepath.Join("test", "testdata", "closure.js"))
+	if err != nil {
+		t.Fatalf("Failed to read closure.js: %v", err)
+	}
+	result := NewMinifier(string(content), false, false).Minify()
+	if !strings.Contains(result, "const counterModule=(function(){") || !strings.Contains(result, "})();") {
+		t.Errorf("IIFE in closure.js was not preserved.\nGot: %s", result)
+	}
+}
+
+// TestHTMLInlineScripts tests that only the inline JavaScript of an HTML page is minified
+func TestHTMLInlineScripts(t *testing.T) {
+	page := `<!DOCTYPE html>
+<html>
+<head>
+    <script src="vendor.js"></script>
+    <script type="text/template">
+        <p>  {{ name }}  </p>
+    </script>
+</head>
+<body>
+    <p>Keep   this   text</p>
+    <script>
+        // Greet the user
+        function greet(name) {
+            return "Hello " + name;
+        }
+    </script>
+</body>
+</html>`
+
+	dir := t.TempDir()
+	inputPath := filepath.Join(dir, "page.html")
+	if err := ioutil.WriteFile(inputPath, []byte(page), 0644); err != nil {
+		t.Fatalf("Failed to write HTML file: %v", err)
+	}
+
+	opts := DefaultOptions()
+	opts.HTML = true
+	stats := make(chan MinificationStats, 1)
+	processFile(inputPath, "", opts, stats)
+	stat := <-stats
+
+	if stat.OutputFile != filepath.Join(dir, "page.min.html") {
+		t.Errorf("Unexpected output path: %s", stat.OutputFile)
+	}
+	output, err := ioutil.ReadFile(stat.OutputFile)
+	if err != nil {
+		t.Fatalf("Failed to read output file: %v", err)
+	}
+	result := string(output)
+
+	expectedScript := `<script>function greet(name){return "Hello "+name;}</script>`
+	if !strings.Contains(result, expectedScript) {
+		t.Errorf("Inline script was not minified.\nExpected to contain: %s\nGot: %s", expectedScript, result)
+	}
+
+	// Markup, external scripts and non-JS script types must be untouched
+	untouched := []string{
+		"<!DOCTYPE html>\n<html>\n<head>",
+		`<script src="vendor.js"></script>`,
+		"<script type=\"text/template\">\n        <p>  {{ name }}  </p>\n    </script>",
+		"<p>Keep   this   text</p>",
+	}
+	for _, fragment := range untouched {
+		if !strings.Contains(result, fragment) {
+			t.Errorf("HTML outside inline scripts was modified, missing: %q\nGot: %s", fragment, result)
+		}
+	}
+}
+
+// TestHTMLScriptWarnings tests that the warnings about inline scripts are
+// reported at their positions in the page
+func TestHTMLScriptWarnings(t *testing.T) {
+	page := "<html>\n<body>\n<script>\n  function run(code) { return eval(code) }\n</script>\n<script>const el = <App />;</script>\n</body>\n</html>\n"
+	dir := t.TempDir()
+	inputPath := filepath.Join(dir, "page.html")
+	if err := ioutil.WriteFile(inputPath, []byte(page), 0644); err != nil {
+		t.Fatalf("Failed to write HTML file: %v", err)
+	}
+	var warnings bytes.Buffer
+	userOutput.SetOutput(&warnings)
+	defer userOutput.SetOutput(os.Stderr)
+
+	if code := run([]string{"-input", inputPath, "-html", "-shorten-vars"}); code != 0 {
+		t.Fatalf("Expected exit code 0, got %d", code)
+	}
+	expected := "warning: " + inputPath + ":4:31: " + evalMessage + "\n" +
+		"warning: " + inputPath + ":6:20: " + jsxMessage + "\n"
+	if warnings.String() != expected {
+		t.Errorf("Expected %q, got %q", expected, warnings.String())
+	}
+}
+
+// TestStatsOnlyMaxSize tests that stats-only mode writes nothing and enforces the size budget
+func TestStatsOnlyMaxSize(t *testing.T) {
+	dir := t.TempDir()
+	inputPath := filepath.Join(dir, "app.js")
+	input := "function add(first, second) {\n\treturn first + second;\n}\n"
+	if err := ioutil.WriteFile(inputPath, []byte(input), 0644); err != nil {
+		t.Fatalf("Failed to write input file: %v", err)
+	}
+
+	if code := run([]string{"-input", dir, "-stats-only", "-max-size", "1000"}); code != 0 {
+		t.Errorf("Expected exit code 0 within budget, got %d", code)
+	}
+	if code := run([]string{"-input", dir, "-stats-only", "-max-size", "10"}); code == 0 {
+		t.Error("Expected non-zero exit code when a file exceeds the budget")
+	}
+	if code := run([]string{"-input", inputPath, "-stats-only", "-max-size", "10"}); code == 0 {
+		t.Error("Expected non-zero exit code when a single file exceeds the budget")
+	}
+
+	matches, _ := filepath.Glob(filepath.Join(dir, "*.min.js"))
+	if len(matches) != 0 {
+		t.Errorf("Stats-only mode wrote output files: %v", matches)
+	}
+}
+
+// TestConcurrentDirectoryMinification minifies a directory, which processes
+// its files in parallel goroutines. Run it with `go test -race` to check
+// that they share no unsynchronized state.
+func TestConcurrentDirectoryMinification(t *testing.T) {
+	dir := t.TempDir()
+	inputs := map[string]string{}
+	for i := 0; i < 8; i++ {
+		name := fmt.Sprintf("file%d.js", i)
+		inputs[name] = fmt.Sprintf("const value%d = %d;\nfunction get%d() {\n\treturn value%d;\n}\n", i, i, i, i)
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(inputs[name]), 0644); err != nil {
+			t.Fatalf("Failed to write input file: %v", err)
+		}
+	}
+
+	if code := run([]string{"-input", dir, "-shorten-vars"}); code != 0 {
+		t.Fatalf("Expected exit code 0, got %d", code)
+	}
+
+	for name, input := range inputs {
+		outputPath := filepath.Join(dir, strings.TrimSuffix(name, ".js")+".min.js")
+		output, err := ioutil.ReadFile(outputPath)
+		if err != nil {
+			t.Fatalf("Failed to read output file: %v", err)
+		}
+		expected := NewMinifier(input, false, true).Minify()
+		if string(output) != expected {
+			t.Errorf("%s minified concurrently differs.\nExpected: %s\nGot: %s", name, expected, output)
+		}
+	}
+}
+
+// TestConcurrentDebugLogging processes files concurrently with debug output
+// captured and checks that messages from different goroutines are written
+// whole rather than interleaved. Run it with `go test -race`.
+func TestConcurrentDebugLogging(t *testing.T) {
+	dir := t.TempDir()
+	var inputPaths []string
+	expected := map[string]bool{}
+	for i := 0; i < 16; i++ {
+		input := fmt.Sprintf("let counter%d = %d; counter%d += 1;", i, i, i)
+		expected["Final result: "+NewMinifier(input, false, false).Minify()] = true
+		inputPath := filepath.Join(dir, fmt.Sprintf("file%d.js", i))
+		if err := ioutil.WriteFile(inputPath, []byte(input), 0644); err != nil {
+			t.Fatalf("Failed to write input file: %v", err)
+		}
+		inputPaths = append(inputPaths, inputPath)
+	}
+
+	var buf bytes.Buffer
+	previous := debugLogger.Writer()
+	debugLogger.SetOutput(&buf)
+	defer debugLogger.SetOutput(previous)
+
+	var wg sync.WaitGroup
+	stats := make(chan MinificationStats, len(inputPaths))
+	for _, inputPath := range inputPaths {
+		inputPath := inputPath
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := processFile(inputPath, "", DefaultOptions(), stats); err != nil {
+				t.Errorf("Failed to process %s: %v", inputPath, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	found := 0
+	for _, line := range strings.Split(buf.String(), "\n") {
+		if strings.Contains(line, "Final result: ") {
+			if !expected[line] {
+				t.Errorf("Unexpected or interleaved debug line: %q", line)
+			}
+			found++
+		}
+	}
+	if found != len(expected) {
+		t.Errorf("Expected %d final result lines, got %d", len(expected), found)
+	}
+}
+
+// TestMetricsEndpoint tests that the metrics server reports processed files
+func TestMetricsEndpoint(t *testing.T) {
+	ln, err := startMetricsServer("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to start metrics server: %v", err)
+	}
+	defer ln.Close()
+
+	dir := t.TempDir()
+	inputPath := filepath.Join(dir, "app.js")
+	input := "function add(first, second) {\n\treturn first + second;\n}\n"
+	if err := ioutil.WriteFile(inputPath, []byte(input), 0644); err != nil {
+		t.Fatalf("Failed to write input file: %v", err)
+	}
+
+	processed := processMetrics.filesProcessed.Load()
+	saved := processMetrics.bytesSaved.Load()
+	failed := processMetrics.errors.Load()
+
+	stats := make(chan MinificationStats, 1)
+	if err := processFile(inputPath, "", DefaultOptions(), stats); err != nil {
+		t.Fatalf("Failed to process file: %v", err)
+	}
+	stat := <-stats
+	if err := processFile(filepath.Join(dir, "missing.js"), "", DefaultOptions(), stats); err == nil {
+		t.Fatal("Expected an error for a missing file")
+	}
+
+	resp, err := http.Get("http://" + ln.Addr().String() + "/metrics")
+	if err != nil {
+		t.Fatalf("Failed to fetch metrics: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("Failed to read metrics: %v", err)
+	}
+
+	expected := []string{
+		"# TYPE jsminifier_files_processed_total counter",
+		fmt.Sprintf("jsminifier_files_processed_total %d", processed+1),
+		fmt.Sprintf("jsminifier_bytes_saved_total %d", saved+int64(stat.OriginalSize-stat.MinifiedSize)),
+		fmt.Sprintf("jsminifier_errors_total %d", failed+1),
+	}
+	lines := strings.Split(string(body), "\n")
+	for _, want := range expected {
+		found := false
+		for _, line := range lines {
+			if line == want {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("Metric line %q not served.\nGot:\n%s", want, body)
+		}
+	}
+}
+
+// TestServe tests that code POSTed to the -serve server is answered with
+// its minified output, and that other requests are refused
+func TestServe(t *testing.T) {
+	opts := DefaultOptions()
+	opts.ShortenVars = true
+	opts.MaxFileSize = 100
+	ln, err := startServer("127.0.0.1:0", opts)
+	if err != nil {
+		t.Fatalf("Failed to start server: %v", err)
+	}
+	defer ln.Close()
+	url := "http://" + ln.Addr().String() + "/"
+
+	tests := []struct {
+		name     string
+		method   string
+		query    string
+		input    string
+		status   int
+		expected string // the body, or a part of an error
+	}{
+		{"Minify", http.MethodPost, "", "function add(first, second) {\n\treturn first + second;\n}\n", http.StatusOK, "function add(a,b){return a+b;}"},
+		{"Empty", http.MethodPost, "", "", http.StatusOK, ""},
+		{"TypeScript", http.MethodPost, "?name=src/app.js", "let count: number = 1;", http.StatusUnprocessableEntity, "app.js:1:10: " + typeScriptMessage},
+		{"Too Large", http.MethodPost, "", strings.Repeat("x;", 51), http.StatusRequestEntityTooLarge, "100 bytes"},
+		{"Get", http.MethodGet, "", "", http.StatusMethodNotAllowed, "POST"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(tt.method, url+tt.query, strings.NewReader(tt.input))
+			if err != nil {
+				t.Fatalf("Failed to create request: %v", err)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("Request failed: %v", err)
+			}
+			defer resp.Body.Close()
+			body, err := ioutil.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatalf("Failed to read response: %v", err)
+			}
+			if resp.StatusCode != tt.status {
+				t.Errorf("Expected status %d, got %d: %s", tt.status, resp.StatusCode, body)
+			}
+			if tt.status == http.StatusOK && string(body) != tt.expected {
+				t.Errorf("Expected: %s\nGot: %s", tt.expected, body)
+			} else if !strings.Contains(string(body), tt.expected) {
+				t.Errorf("Expected the response to contain %q, got %q", tt.expected, body)
+			}
+		})
+	}
+
+	// Without -max-file-size the body is still limited
+	ln, err = startServer("127.0.0.1:0", DefaultOptions())
+	if err != nil {
+		t.Fatalf("Failed to start server: %v", err)
+	}
+	defer ln.Close()
+	resp, err := http.Post("http://"+ln.Addr().String()+"/", "text/javascript", strings.NewReader(strings.Repeat(";", serveMaxBodySize+1)))
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected status %d for a body over the default limit, got %d", http.StatusRequestEntityTooLarge, resp.StatusCode)
+	}
+}
+
+// TestAlreadyMinifiedInput tests that minified input is detected and only
+// compacted, without renaming
+func TestAlreadyMinifiedInput(t *testing.T) {
+	content, err := ioutil.ReadFile(filepath.Join("test", "testdata", "complex.js"))
+	if err != nil {
+		t.Fatalf("Failed to read complex.js: %v", err)
+	}
+	if looksMinified(string(content)) {
+		t.Fatal("Readable source was detected as minified")
+	}
+	minified := NewMinifier(strings.Repeat(string(content), 3), false, false).Minify()
+	if !looksMinified(minified) {
+		t.Fatal("Minified source was not detected")
+	}
+
+	dir := t.TempDir()
+	inputPath := filepath.Join(dir, "bundle.js")
+	if err := ioutil.WriteFile(inputPath, []byte(minified), 0644); err != nil {
+		t.Fatalf("Failed to write input file: %v", err)
+	}
+
+	var warnings bytes.Buffer
+	userOutput.SetOutput(&warnings)
+	defer func() { userOutput.SetOutput(os.Stderr) }()
+
+	opts := DefaultOptions()
+	opts.ShortenVars = true
+	stats := make(chan MinificationStats, 1)
+	if err := processFile(inputPath, "", opts, stats); err != nil {
+		t.Fatalf("Failed to process file: %v", err)
+	}
+	stat := <-stats
+
+	if !strings.Contains(warnings.String(), "bundle.js looks already minified") {
+		t.Errorf("Expected an already-minified warning, got %q", warnings.String())
+	}
+	output, err := ioutil.ReadFile(stat.OutputFile)
+	if err != nil {
+		t.Fatalf("Failed to read output file: %v", err)
+	}
+	if expected := NewMinifier(minified, false, false).Minify(); string(output) != expected {
+		t.Errorf("Already-minified input was renamed.\nExpected: %s\nGot: %s", expected, output)
+	}
+}
+
+// TestBundle tests that bundled files are minified into one output without
+// the end of one file merging with the start of the next
+func TestBundle(t *testing.T) {
+	dir := t.TempDir()
+	first := filepath.Join(dir, "first.js")
+	second := filepath.Join(dir, "second.js")
+	outputPath := filepath.Join(dir, "bundle.js")
+	if err := ioutil.WriteFile(first, []byte("const total = 1\n// no trailing newline or semicolon"), 0644); err != nil {
+		t.Fatalf("Failed to write input file: %v", err)
+	}
+	if err := ioutil.WriteFile(second, []byte("(function () {\n\trun(total)\n})()\n"), 0644); err != nil {
+		t.Fatalf("Failed to write input file: %v", err)
+	}
+
+	if code := run([]string{"-bundle", outputPath, first, second}); code != 0 {
+		t.Fatalf("Expected exit code 0, got %d", code)
+	}
+
+	content, err := ioutil.ReadFile(outputPath)
+	if err != nil {
+		t.Fatalf("Failed to read bundle: %v", err)
+	}
+	expected := "const total=1;(function(){run(total)})();"
+	if string(content) != expected {
+		t.Errorf("Bundle differs.\nExpected: %s\nGot: %s", expected, content)
+	}
+
+	if code := run([]string{"-bundle", first, first, second}); code != 1 {
+		t.Errorf("Expected exit code 1 when the bundle would overwrite an input, got %d", code)
+	}
+
+	// Only the first file can keep its #! line, and no byte order mark
+	// ends up inside the bundle
+	if err := ioutil.WriteFile(first, []byte("\ufeff#!/usr/bin/env node\nconst total = 1\n"), 0644); err != nil {
+		t.Fatalf("Failed to write input file: %v", err)
+	}
+	if err := ioutil.WriteFile(second, []byte("\ufeff#!/usr/bin/env node\nrun(total)\n"), 0644); err != nil {
+		t.Fatalf("Failed to write input file: %v", err)
+	}
+	if code := run([]string{"-bundle", outputPath, "-force", first, second}); code != 0 {
+		t.Fatalf("Expected exit code 0, got %d", code)
+	}
+	content, err = ioutil.ReadFile(outputPath)
+	if err != nil {
+		t.Fatalf("Failed to read bundle: %v", err)
+	}
+	expected = "#!/usr/bin/env node\nconst total=1;run(total);"
+	if string(content) != expected {
+		t.Errorf("Bundle differs.\nExpected: %q\nGot: %q", expected, content)
+	}
+}
+
+// TestBundleChecks tests that files a single-file run would refuse or copy
+// unchanged are refused by -bundle, and that no bundle is written then
+func TestBundleChecks(t *testing.T) {
+	testCases := []struct {
+		Name     string
+		Input    string
+		Expected string
+	}{
+		{"Binary", "run()\x00", ":1:6: binary file: unexpected NUL byte"},
+		{"TypeScript", "let count: number = 0", ":1:10: TypeScript is not supported; compile to JS first"},
+		{"JSX", "render(<App />)", ":1:8: JSX is not supported; compile to JS before bundling"},
+		{"No Minify Pragma", "// @no-minify\nrun()", ":1:1: marked @no-minify, which a minified bundle cannot keep unchanged"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			dir := t.TempDir()
+			first := filepath.Join(dir, "first.js")
+			second := filepath.Join(dir, "second.js")
+			outputPath := filepath.Join(dir, "bundle.js")
+			if err := ioutil.WriteFile(first, []byte("const total = 1\n"), 0644); err != nil {
+				t.Fatalf("Failed to write input file: %v", err)
+			}
+			if err := ioutil.WriteFile(second, []byte(tc.Input), 0644); err != nil {
+				t.Fatalf("Failed to write input file: %v", err)
+			}
+
+			_, err := bundleFiles([]string{first, second}, outputPath, DefaultOptions())
+			if err == nil || err.Error() != second+tc.Expected {
+				t.Errorf("Expected error %q, got %v", second+tc.Expected, err)
+			}
+			if _, err := os.Stat(outputPath); err == nil {
+				t.Error("A bundle was written")
+			}
+		})
+	}
+}
+
+// TestBundleWarnings tests that the warnings about a bundle are reported
+// for the file and line they are about
+func TestBundleWarnings(t *testing.T) {
+	dir := t.TempDir()
+	first := filepath.Join(dir, "first.js")
+	second := filepath.Join(dir, "second.js")
+	if err := ioutil.WriteFile(first, []byte("const total = 1\n"), 0644); err != nil {
+		t.Fatalf("Failed to write input file: %v", err)
+	}
+	if err := ioutil.WriteFile(second, []byte("function run(code) {\n\tvar local = 1;\n\treturn eval(code) + local;\n}"), 0644); err != nil {
+		t.Fatalf("Failed to write input file: %v", err)
+	}
+	var warnings bytes.Buffer
+	userOutput.SetOutput(&warnings)
+	defer userOutput.SetOutput(os.Stderr)
+
+	if code := run([]string{"-bundle", filepath.Join(dir, "bundle.js"), "-shorten-vars", first, second}); code != 0 {
+		t.Fatalf("Expected exit code 0, got %d", code)
+	}
+	if expected := "warning: " + second + ":3:9: " + evalMessage + "\n"; warnings.String() != expected {
+		t.Errorf("Expected %q, got %q", expected, warnings.String())
+	}
+}
+
+// TestGenerate tests that the generate subcommand writes a Go file that
+// compiles and holds the minified code of each file as a constant, and
+// that it replaces a file it generated before but no other file
+func TestGenerate(t *testing.T) {
+	dir := t.TempDir()
+	sources := map[string]string{
+		"app.js":       "function greet(name) {\n\treturn `Hello, ${name}`; // wave\n}\n",
+		"date-util.js": "const format = (d) => d.toISOString() + \"\\n\";\n",
+	}
+	for name, source := range sources {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(source), 0644); err != nil {
+			t.Fatalf("Failed to write input file: %v", err)
+		}
+	}
+	outputPath := filepath.Join(t.TempDir(), "assets.go")
+
+	for i := 0; i < 2; i++ {
+		if code := run([]string{"generate", "-input", dir, "-out", outputPath, "-package", "assets"}); code != 0 {
+			t.Fatalf("Run %d: expected exit code 0, got %d", i+1, code)
+		}
+	}
+
+	fset := gotoken.NewFileSet()
+	file, err := parser.ParseFile(fset, outputPath, nil, parser.ParseComments)
+	if err != nil {
+		t.Fatalf("Generated file does not parse: %v", err)
+	}
+	pkg, err := new(types.Config).Check("assets", fset, []*ast.File{file}, nil)
+	if err != nil {
+		t.Fatalf("Generated file does not compile: %v", err)
+	}
+	for name, constName := range map[string]string{"app.js": "AppJs", "date-util.js": "DateUtilJs"} {
+		c, ok := pkg.Scope().Lookup(constName).(*types.Const)
+		if !ok {
+			t.Errorf("No constant %s for %s", constName, name)
+			continue
+		}
+		expected := NewMinifier(sources[name], false, false).Minify()
+		if got := constant.StringVal(c.Val()); got != expected {
+			t.Errorf("%s differs.\nExpected: %s\nGot: %s", constName, expected, got)
+		}
+	}
+
+	handWritten := filepath.Join(t.TempDir(), "assets.go")
+	if err := ioutil.WriteFile(handWritten, []byte("package assets\n"), 0644); err != nil {
+		t.Fatalf("Failed to write output file: %v", err)
+	}
+	var errs bytes.Buffer
+	userOutput.SetOutput(&errs)
+	defer userOutput.SetOutput(os.Stderr)
+	if code := run([]string{"generate", "-input", dir, "-out", handWritten}); code != 1 {
+		t.Errorf("Expected exit code 1 for an existing file that was not generated, got %d", code)
+	}
+}
+
+// TestMaxFileSize tests that files above the size limit are refused
+func TestMaxFileSize(t *testing.T) {
+	dir := t.TempDir()
+	inputPath := filepath.Join(dir, "big.js")
+	input := strings.Repeat("const value = 1;\n", 100)
+	if err := ioutil.WriteFile(inputPath, []byte(input), 0644); err != nil {
+		t.Fatalf("Failed to write input file: %v", err)
+	}
+
+	opts := DefaultOptions()
+	opts.MaxFileSize = int64(len(input)) - 1
+	err := processFile(inputPath, "", opts, make(chan MinificationStats, 1))
+	if !errors.Is(err, errFileTooLarge) {
+		t.Fatalf("Expected the file size guard error, got %v", err)
+	}
+	if _, err := ioutil.ReadFile(filepath.Join(dir, "big.min.js")); err == nil {
+		t.Error("Output was written for a file over the limit")
+	}
+
+	opts.MaxFileSize = int64(len(input))
+	if err := processFile(inputPath, "", opts, make(chan MinificationStats, 1)); err != nil {
+		t.Errorf("File at the limit was refused: %v", err)
+	}
+}
+
+// TestBinaryInput tests that binary and non-UTF-8 files are refused with an
+// error pointing at the offending byte, and that no output is written
+func TestBinaryInput(t *testing.T) {
+	testCases := []struct {
+		Name    string
+		Content []byte
+		Message string
+	}{
+		{
+			Name:    "NUL Byte",
+			Content: []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR"),
+			Message: "bad.js:3:1: binary file: unexpected NUL byte",
+		},
+		{
+			Name:    "Latin-1",
+			Content: []byte("const name = \"caf\xe9\";\n"),
+			Message: "bad.js:1:18: invalid UTF-8; source files must be encoded as UTF-8",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			dir := t.TempDir()
+			inputPath := filepath.Join(dir, "bad.js")
+			if err := ioutil.WriteFile(inputPath, tc.Content, 0644); err != nil {
+				t.Fatalf("Failed to write input file: %v", err)
+			}
+
+			err := processFile(inputPath, "", DefaultOptions(), make(chan MinificationStats, 1))
+			var merr *MinifyError
+			if !errors.As(err, &merr) {
+				t.Fatalf("Expected a *MinifyError, got %v", err)
+			}
+			if got := strings.TrimPrefix(err.Error(), dir+string(filepath.Separator)); got != tc.Message {
+				t.Errorf("Expected error %q, got %q", tc.Message, got)
+			}
+			if _, err := ioutil.ReadFile(filepath.Join(dir, "bad.min.js")); err == nil {
+				t.Error("Output was written for a binary file")
+			}
+		})
+	}
+
+	dir := t.TempDir()
+	inputPath := filepath.Join(dir, "unicode.js")
+	if err := ioutil.WriteFile(inputPath, []byte("const name = \"caf\u00e9\";\n"), 0644); err != nil {
+		t.Fatalf("Failed to write input file: %v", err)
+	}
+	if err := processFile(inputPath, "", DefaultOptions(), make(chan MinificationStats, 1)); err != nil {
+		t.Errorf("Valid UTF-8 file was refused: %v", err)
+	}
+}
+
+// TestJSXGuard tests that files containing JSX are copied unchanged with a
+// warning, while comparisons and strings that look like tags are not
+// mistaken for JSX
+func TestJSXGuard(t *testing.T) {
+	testCases := []struct {
+		Name  string
+		Input string
+		JSX   bool
+	}{
+		{Name: "Element", Input: "const el = <App title=\"x\" />;", JSX: true},
+		{Name: "Returned Element", Input: "function f() {\n\treturn <div>Don't</div>;\n}", JSX: true},
+		{Name: "Fragment", Input: "render((<>text</>));", JSX: true},
+		{Name: "Comparisons", Input: "const a = x < y, b = i<n, c = 1 <2;\nif (a < b) f();\nwhile (i\n<n) i++;"},
+		{Name: "Tag In String", Input: "el.innerHTML = \"<div>\" + `<b>${x}</b>`;"},
+		{Name: "Shift", Input: "const bits = 1 << 4;"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			if got := findJSX(tc.Input) >= 0; got != tc.JSX {
+				t.Errorf("Expected JSX %v, got %v for %q", tc.JSX, got, tc.Input)
+			}
+		})
+	}
+
+	// Library callers get the input back with the warning too
+	source := "#!/usr/bin/env node\nconst el = <App   title=\"x\" />;"
+	result, found := NewMinifier(source, true, true).MinifyWithWarnings()
+	if result != source {
+		t.Errorf("Minify changed JSX: %q", result)
+	}
+	if len(found) != 1 || found[0].String() != "2:12: "+jsxMessage {
+		t.Errorf("Expected a JSX warning at 2:12, got %v", found)
+	}
+	result, found = NewIncrementalMinifier(DefaultOptions()).MinifyWithWarnings(source)
+	if result != source || len(found) != 1 {
+		t.Errorf("Incremental minifier gave %q with warnings %v for JSX", result, found)
+	}
+
+	dir := t.TempDir()
+	inputPath := filepath.Join(dir, "app.js")
+	input := "import React from \"react\";\n\nexport const App = () => <h1 className=\"title\">Hello,  world</h1>;\n"
+	if err := ioutil.WriteFile(inputPath, []byte(input), 0644); err != nil {
+		t.Fatalf("Failed to write input file: %v", err)
+	}
+	var warnings bytes.Buffer
+	userOutput.SetOutput(&warnings)
+	defer userOutput.SetOutput(os.Stderr)
+
+	if err := processFile(inputPath, "", DefaultOptions(), make(chan MinificationStats, 1)); err != nil {
+		t.Fatalf("Failed to process file: %v", err)
+	}
+	content, err := ioutil.ReadFile(filepath.Join(dir, "app.min.js"))
+	if err != nil {
+		t.Fatalf("Failed to read output file: %v", err)
+	}
+	if string(content) != input {
+		t.Errorf("JSX file was changed: %q", string(content))
+	}
+	expected := "warning: " + inputPath + ":3:26: JSX is not supported; copying the file unchanged\n"
+	if warnings.String() != expected {
+		t.Errorf("Expected warning %q, got %q", expected, warnings.String())
+	}
+}
+
+// TestTypeScriptGuard tests that TypeScript-only syntax is refused with an
+// error, while the JavaScript that shares its punctuation is not
+func TestTypeScriptGuard(t *testing.T) {
+	testCases := []struct {
+		Name  string
+		Input string
+		TS    bool
+	}{
+		{Name: "Variable Annotation", Input: "let count: number = 0;", TS: true},
+		{Name: "Parameter Annotations", Input: "function add(a: number, b: number) { return a + b; }", TS: true},
+		{Name: "Optional Parameter", Input: "const f = (a, b?) => a;\nfunction g(a, b?: string) {}", TS: true},
+		{Name: "Interface", Input: "export interface Props {\n\ttitle: string;\n}", TS: true},
+		{Name: "Enum", Input: "enum Color { Red, Green }", TS: true},
+		{Name: "Type Alias", Input: "const x = 1;\ntype ID = string | number;", TS: true},
+		{Name: "Declare", Input: "declare const VERSION: string;", TS: true},
+		{Name: "Object Keys And Ternaries", Input: "f({a: 1, b: c ? d : e}, x ? (y) : z);\nswitch (k) { case (a): break; default: }"},
+		{Name: "Labels", Input: "outer: for (;;) { break outer; }"},
+		{Name: "Names Spelled Like Keywords", Input: "let type = 1, enumerate = 2;\ntype = type + 1;\nconst o = {interface: 1, enum: 2};"},
+		{Name: "Colon In Strings", Input: "log(\"let a: number\", `(b: ${c})`);"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			if got := findTypeScript(tc.Input) >= 0; got != tc.TS {
+				t.Errorf("Expected TypeScript %v, got %v for %q", tc.TS, got, tc.Input)
+			}
+		})
+	}
+
+	dir := t.TempDir()
+	inputPath := filepath.Join(dir, "app.js")
+	input := "// Greets a user\nfunction greet(name: string): string {\n\treturn \"Hello, \" + name;\n}\n"
+	if err := ioutil.WriteFile(inputPath, []byte(input), 0644); err != nil {
+		t.Fatalf("Failed to write input file: %v", err)
+	}
+	err := processFile(inputPath, "", DefaultOptions(), make(chan MinificationStats, 1))
+	expected := inputPath + ":2:20: TypeScript is not supported; compile to JS first"
+	if err == nil || err.Error() != expected {
+		t.Errorf("Expected error %q, got %v", expected, err)
+	}
+	if _, err := ioutil.ReadFile(filepath.Join(dir, "app.min.js")); err == nil {
+		t.Error("Output was written for a TypeScript file")
+	}
+}
+
+// TestProfile tests that -profile reports a timing for each pass that ran
+func TestProfile(t *testing.T) {
+	dir := t.TempDir()
+	inputPath := filepath.Join(dir, "app.js")
+	input := "import { a } from 'm';\nimport { b } from 'm';\nconst total = { _count: a + b }; // sum\n"
+	if err := ioutil.WriteFile(inputPath, []byte(input), 0644); err != nil {
+		t.Fatalf("Failed to write input file: %v", err)
+	}
+
+	var profile bytes.Buffer
+	profileOutput = &profile
+	defer func() { profileOutput = os.Stderr }()
+
+	opts := DefaultOptions()
+	opts.Profile = true
+	opts.ShortenVars = true
+	opts.MergeImports = true
+	opts.MangleProps = regexp.MustCompile("^_")
+	if err := processFile(inputPath, "", opts, make(chan MinificationStats, 1)); err != nil {
+		t.Fatalf("processFile failed: %v", err)
+	}
+
+	out := profile.String()
+	if !strings.HasPrefix(out, "profile: "+inputPath+"\n") {
+		t.Errorf("Profile does not start with the file name:\n%s", out)
+	}
+	passes := []string{
+		"remove comments",
+		"collapse whitespace",
+		"remove semicolons",
+		"merge imports",
+		"shorten variables",
+		"mangle properties",
+		"restore literals",
+		"total",
+	}
+	for _, pass := range passes {
+		if !strings.Contains(out, "  "+pass+" ") {
+			t.Errorf("Profile does not list the %q pass:\n%s", pass, out)
+		}
+	}
+
+	profile.Reset()
+	opts.Profile = false
+	opts.Force = true
+	if err := processFile(inputPath, "", opts, make(chan MinificationStats, 1)); err != nil {
+		t.Fatalf("processFile failed: %v", err)
+	}
+	if profile.Len() != 0 {
+		t.Errorf("Profile written without -profile:\n%s", profile.String())
+	}
+}
+
+// TestVarsMangled tests that the statistics count the distinct variable
+// names that were shortened
+func TestVarsMangled(t *testing.T) {
+	dir := t.TempDir()
+	inputPath := filepath.Join(dir, "app.js")
+	// f is a function name and keeps its spelling; i is declared twice
+	input := "function f(width, height) {\n\tconst area = width * height;\n" +
+		"\tfor (let i = 0; i < 2; i++) {}\n\tfor (let i = 0; i < 3; i++) {}\n\treturn area;\n}\n"
+	if err := ioutil.WriteFile(inputPath, []byte(input), 0644); err != nil {
+		t.Fatalf("Failed to write input file: %v", err)
+	}
+
+	for _, shorten := range []bool{false, true} {
+		opts := DefaultOptions()
+		opts.ShortenVars = shorten
+		opts.Force = true // the second run replaces the output of the first
+		stats := make(chan MinificationStats, 1)
+		if err := processFile(inputPath, "", opts, stats); err != nil {
+			t.Fatalf("processFile failed: %v", err)
+		}
+		want := 0
+		if shorten {
+			want = 4 // width, height, area and i
+		}
+		if stat := <-stats; stat.VarsMangled != want {
+			t.Errorf("With ShortenVars %v, expected %d variables mangled, got %d", shorten, want, stat.VarsMangled)
+		}
+	}
+}
+
+// TestEvalWarning tests that variables are not shortened in code calling
+// eval directly, and that a warning says so
+func TestEvalWarning(t *testing.T) {
+	input := "function run(code) {\n\tvar local = 1;\n\treturn eval(code) + local;\n}"
+	result, warnings := NewMinifier(input, false, true).MinifyWithWarnings()
+	if expected := "function run(code){var local=1;return eval(code)+local;}"; result != expected {
+		t.Errorf("Expected: %s\nGot: %s", expected, result)
+	}
+	if len(warnings) != 1 || warnings[0].String() != "3:9: "+evalMessage {
+		t.Errorf("Expected a warning about eval at 3:9, got %v", warnings)
+	}
+
+	for _, input := range []string{
+		"function run(code) { return window.eval(code); }",
+		"function run(code) { const evaluate = code; return evaluate; }",
+	} {
+		minifier := NewMinifier(input, false, true)
+		if _, warnings := minifier.MinifyWithWarnings(); len(warnings) != 0 {
+			t.Errorf("Unexpected warnings for %q: %v", input, warnings)
+		}
+		if len(minifier.VarMap()) == 0 {
+			t.Errorf("Variables of %q were not shortened", input)
+		}
+	}
+
+	dir := t.TempDir()
+	inputPath := filepath.Join(dir, "app.js")
+	if err := ioutil.WriteFile(inputPath, []byte(input), 0644); err != nil {
+		t.Fatalf("Failed to write input file: %v", err)
+	}
+	var errs bytes.Buffer
+	userOutput.SetOutput(&errs)
+	defer userOutput.SetOutput(os.Stderr)
+	opts := DefaultOptions()
+	opts.ShortenVars = true
+	if err := processFile(inputPath, "", opts, make(chan MinificationStats, 1)); err != nil {
+		t.Fatalf("processFile failed: %v", err)
+	}
+	if expected := "warning: " + inputPath + ":3:9: " + evalMessage + "\n"; errs.String() != expected {
+		t.Errorf("Expected %q, got %q", expected, errs.String())
+	}
+}
+
+// TestSafeMangle tests that SafeMangle keeps the globals of scripts and
+// leaves a file with a with statement unrenamed, with a warning
+func TestSafeMangle(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected string
+		warning  string
+	}{
+		{
+			name:     "Script Globals Kept",
+			input:    "var counter = 0;\nfunction bump(amount) {\n\tvar next = counter + amount;\n\tcounter = next;\n\treturn next;\n}",
+			expected: "var counter=0;function bump(a){var b=counter+a;counter=b;return b;}",
+		},
+		{
+			name:     "Module Top Level Renamed",
+			input:    "import { x } from \"./x.js\";\nconst total = x + 1;\nexport function show(value) { return value + total; }",
+			expected: "import{x}from \"./x.js\";const a=x+1;export function show(b){return b+a;}",
+		},
+		{
+			name:     "Dynamic Import In Script",
+			input:    "const loaded = import(\"./x.js\");\nfunction wait(p) { return p; }",
+			expected: "const loaded=import(\"./x.js\");function wait(a){return a;}",
+		},
+		{
+			name:     "With Statement",
+			input:    "function area(shape) {\n\tvar width = 2;\n\twith (shape) {\n\t\treturn width * height;\n\t}\n}",
+			expected: "function area(shape){var width=2;with(shape){return width*height;}}",
+			warning:  "3:2: " + withMessage,
+		},
+		{
+			name:     "Method Named With",
+			input:    "function run(list) { return list.with(0, 1); }",
+			expected: "function run(a){return a.with(0,1);}",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := DefaultOptions()
+			opts.ShortenVars = true
+			opts.SafeMangle = true
+			result, warnings := NewMinifierWithOptions(tt.input, opts).MinifyWithWarnings()
+			if result != tt.expected {
+				t.Errorf("Expected: %s\nGot: %s", tt.expected, result)
+			}
+			if tt.warning == "" && len(warnings) != 0 {
+				t.Errorf("Unexpected warnings: %v", warnings)
+			}
+			if tt.warning != "" && (len(warnings) != 1 || warnings[0].String() != tt.warning) {
+				t.Errorf("Expected warning %q, got %v", tt.warning, warnings)
+			}
+		})
+	}
+}
+
+// TestPathologicalInput tests that input built to make a pass search the
+// rest of the code again and again, as a service minifying untrusted code
+// could be sent, is still minified in linear time. Each case took seconds
+// or minutes when that time was quadratic.
+func TestPathologicalInput(t *testing.T) {
+	previous := debugLogger.Writer()
+	debugLogger.SetOutput(ioutil.Discard)
+	defer debugLogger.SetOutput(previous)
+
+	const n = 100000
+	tests := []struct {
+		name  string
+		input string
+		opts  func(*Options)
+	}{
+		{"Unclosed Comment Starts", strings.Repeat("a/*", 2*n), nil},
+		{"Unclosed Regular Expressions", strings.Repeat("(/[", n) + "\n" + strings.Repeat("(/[/", n), nil},
+		{"Arrow Chain", strings.Repeat("(a)=>", n) + "a", func(o *Options) { o.ShortenVars = true }},
+		{"String Chain", "x=" + strings.Repeat("'a'+", n) + "'b'", func(o *Options) { o.FoldStrings = true }},
+		{"Operator Run", "/*!" + strings.Repeat("*", n), func(o *Options) { o.Beautify = true }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := DefaultOptions()
+			if tt.opts != nil {
+				tt.opts(&opts)
+			}
+			start := time.Now()
+			NewMinifierWithOptions(tt.input, opts).Minify()
+			if elapsed := time.Since(start); elapsed > 2*time.Second {
+				t.Errorf("Minifying %d bytes took %v", len(tt.input), elapsed)
+			}
+		})
+	}
+}
+
+// TestNameGenerator tests that a custom name generator supplies the short
+// names, skipping those that clash with keywords or names in the code
+func TestNameGenerator(t *testing.T) {
+	input := "function area(width, height) {\n\tconst result = width * height;\n\treturn B(result);\n}"
+	minifier := NewMinifier(input, false, true)
+	minifier.SetNameGenerator(func(index int) string {
+		return strings.ToUpper(shortName(index))
+	})
+	expected := "function area(A,C){const D=A*C;return B(D);}"
+	if result := minifier.Minify(); result != expected {
+		t.Errorf("Expected: %s\nGot: %s", expected, result)
+	}
+
+	minifier.Reset("let first = 1, second = first;")
+	expected = "let A=1,B=A;"
+	if result := minifier.Minify(); result != expected {
+		t.Errorf("Generator was not kept by Reset.\nExpected: %s\nGot: %s", expected, result)
+	}
+
+	names := []string{"do", "in", "$x", "_y"}
+	minifier.Reset("let first = 1, second = first;")
+	minifier.SetNameGenerator(func(index int) string { return names[index] })
+	expected = "let $x=1,_y=$x;"
+	if result := minifier.Minify(); result != expected {
+		t.Errorf("Keywords were not skipped.\nExpected: %s\nGot: %s", expected, result)
+	}
+
+	minifier.Reset("let first = 1, second = first;")
+	minifier.SetNameGenerator(nil)
+	expected = "let a=1,b=a;"
+	if result := minifier.Minify(); result != expected {
+		t.Errorf("Default names were not restored.\nExpected: %s\nGot: %s", expected, result)
+	}
+}
+
+// TestVarMap tests that VarMap returns a copy of the renames and that
+// -names-map writes them next to the minified file
+func TestVarMap(t *testing.T) {
+	input := "function area(width, height) {\n\tconst result = width * height;\n\treturn result;\n}"
+	minifier := NewMinifier(input, false, true)
+	minifier.Minify()
+
+	expected := map[string]string{"width": "a", "height": "b", "result": "c"}
+	names := minifier.VarMap()
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("Expected %v, got %v", expected, names)
+	}
+	names["width"] = "z"
+	if minifier.VarMap()["width"] != "a" {
+		t.Error("Changing the returned map changed the minifier's names")
+	}
+
+	dir := t.TempDir()
+	inputPath := filepath.Join(dir, "app.js")
+	if err := ioutil.WriteFile(inputPath, []byte(input), 0644); err != nil {
+		t.Fatalf("Failed to write input file: %v", err)
+	}
+	if code := run([]string{"-input", inputPath, "-shorten-vars", "-names-map"}); code != 0 {
+		t.Fatalf("Expected exit code 0, got %d", code)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, "app.min.names.json"))
+	if err != nil {
+		t.Fatalf("Failed to read names map: %v", err)
+	}
+	var written map[string]string
+	if err := json.Unmarshal(data, &written); err != nil {
+		t.Fatalf("Names map is not valid JSON: %v", err)
+	}
+	if !reflect.DeepEqual(written, expected) {
+		t.Errorf("Expected %v in the names map, got %v", expected, written)
+	}
+}
+
+// TestReadRetries tests that a read failing while a file is being saved is
+// retried, and that a file that stays unreadable is skipped with a warning
+// and an error entry in its stats
+func TestReadRetries(t *testing.T) {
+	dir := t.TempDir()
+	inputPath := filepath.Join(dir, "app.js")
+	if err := ioutil.WriteFile(inputPath, []byte("const value = 1;\n"), 0644); err != nil {
+		t.Fatalf("Failed to write input file: %v", err)
+	}
+
+	failures := 0
+	readFile = func(path string) ([]byte, error) {
+		if failures > 0 {
+			failures--
+			return nil, errors.New("file is busy")
+		}
+		return ioutil.ReadFile(path)
+	}
+	readBackoff = time.Millisecond
+	var warnings bytes.Buffer
+	userOutput.SetOutput(&warnings)
+	defer func() {
+		readFile = ioutil.ReadFile
+		readBackoff = 50 * time.Millisecond
+		userOutput.SetOutput(os.Stderr)
+	}()
+
+	opts := DefaultOptions()
+	opts.ReadRetries = 2
+	stats := make(chan MinificationStats, 1)
+	failures = 2
+	if err := processFile(inputPath, "", opts, stats); err != nil {
+		t.Fatalf("Expected the read to succeed on retry, got %v", err)
+	}
+	if stat := <-stats; stat.Error != "" || stat.MinifiedSize != len("const value=1;") {
+		t.Errorf("Unexpected stats after a retried read: %+v", stat)
+	}
+
+	failures = 3
+	if err := processFile(inputPath, "", opts, stats); err == nil {
+		t.Fatal("Expected an error once the retries are exhausted")
+	}
+	if stat := <-stats; stat.InputFile != inputPath || stat.Error != "file is busy" {
+		t.Errorf("Expected an error entry for the skipped file, got %+v", stat)
+	}
+	if !strings.Contains(warnings.String(), "skipping "+inputPath+" after 3 attempts: file is busy") {
+		t.Errorf("Expected a skip warning, got %q", warnings.String())
+	}
+}
+
+// TestFilesFrom tests that -files-from minifies every file in the list and
+// nothing else
+func TestFilesFrom(t *testing.T) {
+	dir := t.TempDir()
+	sources := map[string]string{
+		"a.js":        "const first = 1;\n",
+		"b.js":        "const second = 2;\n",
+		"unlisted.js": "const third = 3;\n",
+	}
+	for name, source := range sources {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(source), 0644); err != nil {
+			t.Fatalf("Failed to write input file: %v", err)
+		}
+	}
+	manifest := filepath.Join(dir, "list.txt")
+	list := filepath.Join(dir, "a.js") + "\n\n" + filepath.Join(dir, "b.js") + "\n"
+	if err := ioutil.WriteFile(manifest, []byte(list), 0644); err != nil {
+		t.Fatalf("Failed to write manifest: %v", err)
+	}
+
+	if code := run([]string{"-files-from", manifest}); code != 0 {
+		t.Fatalf("Expected exit code 0, got %d", code)
+	}
+
+	expected := map[string]string{"a.min.js": "const first=1;", "b.min.js": "const second=2;"}
+	for name, want := range expected {
+		content, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Errorf("Listed file was not minified: %v", err)
+		} else if string(content) != want {
+			t.Errorf("%s: expected %q, got %q", name, want, string(content))
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "unlisted.min.js")); err == nil {
+		t.Error("A file missing from the manifest was minified")
+	}
+
+	if code := run([]string{"-files-from", manifest, "-input", dir}); code != 1 {
+		t.Errorf("Expected exit code 1 when combined with -input, got %d", code)
+	}
+}
+
+// TestArchive tests that the JavaScript files in a .zip or .tar.gz archive
+// are minified into a new archive, while its other entries are copied
+func TestArchive(t *testing.T) {
+	sources := map[string]string{
+		"js/app.js":     "function add(a, b) {\n\treturn a + b; // sum\n}\n",
+		"js/util.js":    "const answer = 42;\n",
+		"js/lib.min.js": "var x = 1 ;",
+		"README.txt":    "Keep  this  text\n",
+	}
+	expected := map[string]string{
+		"js/app.js":     "function add(a,b){return a+b;}",
+		"js/util.js":    "const answer=42;",
+		"js/lib.min.js": "var x = 1 ;",
+		"README.txt":    "Keep  this  text\n",
+	}
+	names := []string{"README.txt", "js/app.js", "js/lib.min.js", "js/util.js"}
+
+	t.Run("Zip", func(t *testing.T) {
+		dir := t.TempDir()
+		var buf bytes.Buffer
+		zw := zip.NewWriter(&buf)
+		for _, name := range names {
+			w, err := zw.Create(name)
+			if err != nil {
+				t.Fatalf("Failed to create zip entry: %v", err)
+			}
+			w.Write([]byte(sources[name]))
+		}
+		zw.Close()
+		inputPath := filepath.Join(dir, "assets.zip")
+		if err := ioutil.WriteFile(inputPath, buf.Bytes(), 0644); err != nil {
+			t.Fatalf("Failed to write archive: %v", err)
+		}
+
+		if code := run([]string{"-input", inputPath}); code != 0 {
+			t.Fatalf("Expected exit code 0, got %d", code)
+		}
+		r, err := zip.OpenReader(filepath.Join(dir, "assets.min.zip"))
+		if err != nil {
+			t.Fatalf("Failed to open minified archive: %v", err)
+		}
+		defer r.Close()
+		got := map[string]string{}
+		for _, f := range r.File {
+			rc, err := f.Open()
+			if err != nil {
+				t.Fatalf("Failed to open %s: %v", f.Name, err)
+			}
+			content, _ := ioutil.ReadAll(rc)
+			rc.Close()
+			got[f.Name] = string(content)
+		}
+		if !reflect.DeepEqual(got, expected) {
+			t.Errorf("Archive differs.\nExpected: %q\nGot: %q", expected, got)
+		}
+	})
+
+	t.Run("Tar Gz", func(t *testing.T) {
+		dir := t.TempDir()
+		var buf bytes.Buffer
+		gw := gzip.NewWriter(&buf)
+		tw := tar.NewWriter(gw)
+		for _, name := range names {
+			tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(sources[name]))})
+			tw.Write([]byte(sources[name]))
+		}
+		tw.Close()
+		gw.Close()
+		inputPath := filepath.Join(dir, "assets.tar.gz")
+		if err := ioutil.WriteFile(inputPath, buf.Bytes(), 0644); err != nil {
+			t.Fatalf("Failed to write archive: %v", err)
+		}
+
+		outputPath := filepath.Join(dir, "out.tgz")
+		if code := run([]string{"-input", inputPath, "-output", outputPath}); code != 0 {
+			t.Fatalf("Expected exit code 0, got %d", code)
+		}
+		f, err := os.Open(outputPath)
+		if err != nil {
+			t.Fatalf("Failed to open minified archive: %v", err)
+		}
+		defer f.Close()
+		gr, err := gzip.NewReader(f)
+		if err != nil {
+			t.Fatalf("Minified archive is not gzipped: %v", err)
+		}
+		got := map[string]string{}
+		tr := tar.NewReader(gr)
+		for {
+			header, err := tr.Next()
+			if err != nil {
+				break
+			}
+			content, _ := ioutil.ReadAll(tr)
+			got[header.Name] = string(content)
+		}
+		if !reflect.DeepEqual(got, expected) {
+			t.Errorf("Archive differs.\nExpected: %q\nGot: %q", expected, got)
+		}
+	})
+}
+
+// TestConcurrentOutput tests that the warnings of files minified at the
+// same time come out as whole lines, and that -concurrency-safe-output
+// reports the files in the order they were listed
+func TestConcurrentOutput(t *testing.T) {
+	dir := t.TempDir()
+	var files []string
+	for i := 0; i < 30; i++ {
+		path := filepath.Join(dir, fmt.Sprintf("f%02d.js", i))
+		source := "var a=" + strings.Repeat("1+", 300) + "1;"
+		if err := ioutil.WriteFile(path, []byte(source), 0644); err != nil {
+			t.Fatalf("Failed to write input file: %v", err)
+		}
+		files = append(files, path)
+	}
+
+	var warnings, reports bytes.Buffer
+	userOutput.SetOutput(&warnings)
+	debugOutput := debugLogger.Writer()
+	debugLogger.SetOutput(&reports)
+	defer func() {
+		userOutput.SetOutput(os.Stderr)
+		debugLogger.SetOutput(debugOutput)
+	}()
+
+	opts := DefaultOptions()
+	opts.OrderedOutput = true
+	processFiles(files, opts, false)
+
+	lines := strings.Split(strings.TrimSuffix(warnings.String(), "\n"), "\n")
+	if len(lines) != len(files) {
+		t.Fatalf("Expected %d warnings, got %d:\n%s", len(files), len(lines), warnings.String())
+	}
+	warning := regexp.MustCompile(`^warning: .*f\d\d\.js looks already minified$`)
+	for _, line := range lines {
+		if !warning.MatchString(line) {
+			t.Errorf("Garbled warning line: %q", line)
+		}
+	}
+
+	var order []string
+	for _, line := range strings.Split(reports.String(), "\n") {
+		if strings.HasPrefix(line, "Processed ") {
+			order = append(order, strings.TrimSuffix(strings.TrimPrefix(line, "Processed "), ":"))
+		}
+	}
+	if !reflect.DeepEqual(order, files) {
+		t.Errorf("Files reported out of order:\n%s", strings.Join(order, "\n"))
+	}
+}
+
+// TestManyFiles tests that a directory with many more files than workers
+// is processed completely, in order with OrderedOutput, without the
+// workers blocking each other on the small statistics channel
+func TestManyFiles(t *testing.T) {
+	dir := t.TempDir()
+	var files []string
+	for i := 0; i < 500; i++ {
+		path := filepath.Join(dir, fmt.Sprintf("f%03d.js", i))
+		if err := ioutil.WriteFile(path, []byte(fmt.Sprintf("const value = %d;\n", i)), 0644); err != nil {
+			t.Fatalf("Failed to write input file: %v", err)
+		}
+		files = append(files, path)
+	}
+	files = append(files, filepath.Join(dir, "missing.js"))
+
+	workers := processWorkers
+	processWorkers = 2
+	debugOutput := debugLogger.Writer()
+	debugLogger.SetOutput(ioutil.Discard)
+	defer func() {
+		processWorkers = workers
+		debugLogger.SetOutput(debugOutput)
+	}()
+
+	for _, ordered := range []bool{false, true} {
+		opts := DefaultOptions()
+		opts.StatsOnly = true
+		opts.OrderedOutput = ordered
+		done := make(chan []MinificationStats)
+		go func() { done <- processFiles(files, opts, false) }()
+
+		var stats []MinificationStats
+		select {
+		case stats = <-done:
+		case <-time.After(10 * time.Second):
+			t.Fatal("processFiles did not finish")
+		}
+		if len(stats) != len(files) {
+			t.Fatalf("Expected statistics for %d files, got %d", len(files), len(stats))
+		}
+		seen := make(map[string]bool)
+		for i, stat := range stats {
+			seen[stat.InputFile] = true
+			if ordered && stat.InputFile != files[i] {
+				t.Errorf("Expected %s at position %d with OrderedOutput, got %s", files[i], i, stat.InputFile)
+			}
+		}
+		if len(seen) != len(files) {
+			t.Errorf("Expected %d distinct files, got %d", len(files), len(seen))
+		}
+	}
+}
+
+// TestHTMLReport tests that -emit-report writes an HTML table with a row
+// for every processed file, including one that failed
+func TestHTMLReport(t *testing.T) {
+	dir := t.TempDir()
+	sources := map[string]string{
+		"a.js":   "const first = 1; // one\n",
+		"b.js":   "function second() {\n\treturn 2;\n}\n",
+		"bad.js": "let count: number = 0;\n",
+	}
+	for name, source := range sources {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(source), 0644); err != nil {
+			t.Fatalf("Failed to write input file: %v", err)
+		}
+	}
+	var errs bytes.Buffer
+	userOutput.SetOutput(&errs)
+	defer userOutput.SetOutput(os.Stderr)
+
+	reportPath := filepath.Join(t.TempDir(), "report.html")
+	if code := run([]string{"-input", dir, "-emit-report", reportPath}); code != 1 {
+		t.Fatalf("Expected exit code 1 for the failed file, got %d", code)
+	}
+	content, err := ioutil.ReadFile(reportPath)
+	if err != nil {
+		t.Fatalf("Report was not written: %v", err)
+	}
+	report := string(content)
+	if !strings.HasPrefix(report, "<!DOCTYPE html>") || !strings.Contains(report, "<table") {
+		t.Errorf("Report is not an HTML table:\n%s", report)
+	}
+	for _, name := range []string{"a.js", "b.js"} {
+		row := "<tr><td>" + filepath.Join(dir, name) + "</td>"
+		if !strings.Contains(report, row) {
+			t.Errorf("Report has no row for %s", name)
+		}
+	}
+	if !strings.Contains(report, "<tr class=\"failed\"><td>"+filepath.Join(dir, "bad.js")+"</td>") {
+		t.Error("Report has no row for the failed file")
+	}
+	if !strings.Contains(report, "TypeScript is not supported") {
+		t.Error("Report does not give the reason the file failed")
+	}
+}
+
+// TestNoMinifyPragma tests that a file marked `@no-minify` is copied to its
+// output unchanged while the other files of a directory are minified
+func TestNoMinifyPragma(t *testing.T) {
+	dir := t.TempDir()
+	sources := map[string]string{
+		"line.js":   "#!/usr/bin/env node\n// @no-minify\nconst  keep = 1; // spacing matters\n",
+		"block.js":  "/*! (c) Vendor */\n/* @no-minify */\nfunction keep ( ) { }\n",
+		"normal.js": "// Not @no-minify\nconst value = 1;\n",
+	}
+	for name, source := range sources {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(source), 0644); err != nil {
+			t.Fatalf("Failed to write input file: %v", err)
+		}
+	}
+
+	if code := run([]string{"-input", dir, "-shorten-vars"}); code != 0 {
+		t.Fatalf("Expected exit code 0, got %d", code)
+	}
+
+	expected := map[string]string{
+		"line.min.js":   sources["line.js"],
+		"block.min.js":  sources["block.js"],
+		"normal.min.js": "const a=1;",
+	}
+	for name, want := range expected {
+		content, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Errorf("Failed to read output file: %v", err)
+		} else if string(content) != want {
+			t.Errorf("%s: expected %q, got %q", name, want, string(content))
+		}
+	}
+}
+
+// TestGitignore tests the .gitignore matcher and that -gitignore leaves the
+// files it matches out of a directory run
+func TestGitignore(t *testing.T) {
+	ignore := parseGitignore("# build output\n/dist/\n*.bundle.js\n!keep.bundle.js\nvendor/**/*.js\nlib?.js\n")
+	testCases := []struct {
+		path    string
+		isDir   bool
+		ignored bool
+	}{
+		{"app.js", false, false},
+		{"app.bundle.js", false, true},
+		{"src/app.bundle.js", false, true},
+		{"keep.bundle.js", false, false},
+		{"dist", true, true},
+		{"dist/app.js", false, true},
+		{"src/dist", true, false},
+		{"dist", false, false},
+		{"vendor/a/b/lib.js", false, true},
+		{"lib1.js", false, true},
+		{"lib10.js", false, false},
+	}
+	for _, tc := range testCases {
+		if got := ignore.ignored(tc.path, tc.isDir); got != tc.ignored {
+			t.Errorf("ignored(%q, %v) = %v, want %v", tc.path, tc.isDir, got, tc.ignored)
+		}
+	}
+
+	dir := t.TempDir()
+	files := map[string]string{
+		".gitignore":     "vendor.js\n*.bundle.js\n!keep.bundle.js\n",
+		"app.js":         "const app = 1;\n",
+		"vendor.js":      "const vendor = 1;\n",
+		"x.bundle.js":    "const bundled = 1;\n",
+		"keep.bundle.js": "const kept = 1;\n",
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+	if code := run([]string{"-input", dir, "-gitignore"}); code != 0 {
+		t.Fatalf("Expected exit code 0, got %d", code)
+	}
+	for name, want := range map[string]bool{"app.min.js": true, "keep.bundle.min.js": true, "vendor.min.js": false, "x.bundle.min.js": false} {
+		if _, err := os.Stat(filepath.Join(dir, name)); (err == nil) != want {
+			t.Errorf("Expected %s to exist: %v, stat error: %v", name, want, err)
+		}
+	}
+}
+
+// TestInPlace tests that -inplace replaces a file with its minified content
+func TestInPlace(t *testing.T) {
+	dir := t.TempDir()
+	inputPath := filepath.Join(dir, "app.js")
+	input := "function add(a, b) {\n\t// Sum\n\treturn a + b;\n}\n"
+	if err := ioutil.WriteFile(inputPath, []byte(input), 0644); err != nil {
+		t.Fatalf("Failed to write input file: %v", err)
+	}
+
+	if code := run([]string{"-input", inputPath, "-inplace"}); code != 0 {
+		t.Fatalf("Expected exit code 0, got %d", code)
+	}
+
+	content, err := ioutil.ReadFile(inputPath)
+	if err != nil {
+		t.Fatalf("Failed to read minified file: %v", err)
+	}
+	expected := NewMinifier(input, false, false).Minify()
+	if string(content) != expected {
+		t.Errorf("File was not replaced with minified content.\nExpected: %s\nGot: %s", expected, content)
+	}
+
+	leftovers, _ := filepath.Glob(filepath.Join(dir, ".*"))
+	if len(leftovers) != 0 {
+		t.Errorf("Temporary files were left behind: %v", leftovers)
+	}
+}
+
+// TestInPlaceValidationError tests that an unbalanced file is reported
+// with its position and left untouched
+func TestInPlaceValidationError(t *testing.T) {
+	testCases := []struct {
+		name  string
+		input string
+		line  int
+		col   int
+		msg   string
+	}{
+		{"Unclosed Brace", "function add(a, b) {\n\tif (a) {\n\t\treturn a + b;\n}\n", 1, 20, "unclosed '{'"},
+		{"Unexpected Bracket", "const list = [1, 2);\n", 1, 19, "unexpected ')'"},
+		{"Unterminated String", "const name = 'abc;\nconst x = 1;\n", 1, 14, "unterminated ' literal"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			inputPath := filepath.Join(t.TempDir(), "app.js")
+			if err := ioutil.WriteFile(inputPath, []byte(tc.input), 0644); err != nil {
+				t.Fatalf("Failed to write input file: %v", err)
+			}
+
+			opts := DefaultOptions()
+			opts.InPlace = true
+			err := processFile(inputPath, "", opts, make(chan MinificationStats, 1))
+			var minifyErr *MinifyError
+			if !errors.As(err, &minifyErr) {
+				t.Fatalf("Expected a *MinifyError, got %v", err)
+			}
+			if minifyErr.File != inputPath || minifyErr.Line != tc.line || minifyErr.Col != tc.col || minifyErr.Msg != tc.msg {
+				t.Errorf("Expected %s:%d:%d: %s, got %v", inputPath, tc.line, tc.col, tc.msg, minifyErr)
+			}
+
+			content, _ := ioutil.ReadFile(inputPath)
+			if string(content) != tc.input {
+				t.Errorf("Unbalanced file was overwritten: %s", content)
+			}
+		})
+	}
+}
+
+// TestOutputSameAsInput tests that the input file is never overwritten without -inplace
+func TestOutputSameAsInput(t *testing.T) {
+	dir := t.TempDir()
+	inputPath := filepath.Join(dir, "app.js")
+	input := "function add(a, b) {\n\treturn a + b;\n}\n"
+	if err := ioutil.WriteFile(inputPath, []byte(input), 0644); err != nil {
+		t.Fatalf("Failed to write input file: %v", err)
+	}
+
+	if code := run([]string{"-input", inputPath, "-output", inputPath}); code == 0 {
+		t.Error("Expected non-zero exit code when output is the input file")
+	}
+
+	content, err := ioutil.ReadFile(inputPath)
+	if err != nil {
+		t.Fatalf("Failed to read input file: %v", err)
+	}
+	if string(content) != input {
+		t.Errorf("Input file was modified.\nGot: %s", content)
+	}
+}
+
+// TestManifest tests that -manifest names each output after a hash of its
+// content and writes a manifest mapping the inputs to them, and that a
+// second run neither needs -force nor minifies the hashed outputs again
+func TestManifest(t *testing.T) {
+	dir := t.TempDir()
+	inputPath := filepath.Join(dir, "app.js")
+	if err := ioutil.WriteFile(inputPath, []byte("function add(a, b) {\n\treturn a + b;\n}\n"), 0644); err != nil {
+		t.Fatalf("Failed to write input file: %v", err)
+	}
+	manifestPath := filepath.Join(dir, "manifest.json")
+
+	for i := 0; i < 2; i++ {
+		if code := run([]string{"-input", dir, "-manifest", manifestPath}); code != 0 {
+			t.Fatalf("Run %d: expected exit code 0, got %d", i+1, code)
+		}
+	}
+
+	data, err := ioutil.ReadFile(manifestPath)
+	if err != nil {
+		t.Fatalf("Failed to read manifest: %v", err)
+	}
+	var manifest map[string]string
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		t.Fatalf("Invalid manifest %s: %v", data, err)
+	}
+	if len(manifest) != 1 {
+		t.Fatalf("Expected one entry in the manifest, got %v", manifest)
+	}
+	output, err := ioutil.ReadFile(filepath.Join(dir, manifest["app.js"]))
+	if err != nil {
+		t.Fatalf("Failed to read the output named in the manifest: %v", err)
+	}
+	if expected := "function add(a,b){return a+b;}"; string(output) != expected {
+		t.Errorf("Expected: %s\nGot: %s", expected, output)
+	}
+	sum := sha256.Sum256(output)
+	if expected := "app.min." + hex.EncodeToString(sum[:])[:8] + ".js"; manifest["app.js"] != expected {
+		t.Errorf("Expected the output to be named %s, got %s", expected, manifest["app.js"])
+	}
+}
+
+// TestExistingOutput tests that an output file that already exists is only
+// replaced with -force
+func TestExistingOutput(t *testing.T) {
+	dir := t.TempDir()
+	inputPath := filepath.Join(dir, "app.js")
+	outputPath := filepath.Join(dir, "app.min.js")
+	if err := ioutil.WriteFile(inputPath, []byte("function add(a, b) {\n\treturn a + b;\n}\n"), 0644); err != nil {
+		t.Fatalf("Failed to write input file: %v", err)
+	}
+	if err := ioutil.WriteFile(outputPath, []byte("// hand-written\n"), 0644); err != nil {
+		t.Fatalf("Failed to write output file: %v", err)
+	}
+
+	var out bytes.Buffer
+	userOutput.SetOutput(&out)
+	defer userOutput.SetOutput(os.Stderr)
+
+	if code := run([]string{"-input", inputPath}); code == 0 {
+		t.Error("Expected non-zero exit code when the output file exists")
+	}
+	if !strings.Contains(out.String(), outputPath+" already exists, use -force") {
+		t.Errorf("Expected an error naming the existing output, got %q", out.String())
+	}
+	if content, _ := ioutil.ReadFile(outputPath); string(content) != "// hand-written\n" {
+		t.Errorf("Existing output was overwritten: %q", content)
+	}
+
+	if code := run([]string{"-input", inputPath, "-force"}); code != 0 {
+		t.Fatalf("Expected exit code 0 with -force, got %d", code)
+	}
+	if content, _ := ioutil.ReadFile(outputPath); string(content) != "function add(a,b){return a+b;}" {
+		t.Errorf("Output was not replaced with -force: %q", content)
+	}
+}
+
+// TestWatchStartup tests that the watcher minifies the files already in
+// the directory when it starts, without waiting for them to change
+func TestWatchStartup(t *testing.T) {
+	dir := t.TempDir()
+	inputPath := filepath.Join(dir, "app.js")
+	if err := ioutil.WriteFile(inputPath, []byte("function add(a, b) {\n\treturn a + b;\n}\n"), 0644); err != nil {
+		t.Fatalf("Failed to write input file: %v", err)
+	}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		watchDirectory(dir, DefaultOptions(), stop)
+		close(done)
+	}()
+	defer func() {
+		close(stop)
+		<-done
+	}()
+
+	outputPath := filepath.Join(dir, "app.min.js")
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		content, err := ioutil.ReadFile(outputPath)
+		if err == nil && len(content) > 0 {
+			if string(content) != "function add(a,b){return a+b;}" {
+				t.Errorf("Unexpected output: %q", content)
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("The existing file was not minified on startup")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// checkIncremental fails the test if the incremental minifier, which
+// minifies top-level statements apart and joins them, gives other output
+// for the test case than minifying its input whole
+func checkIncremental(t *testing.T, tc TestCase) {
+	t.Helper()
+	opts := DefaultOptions()
+	opts.PreserveLicense = tc.Options.PreserveLicense
+	opts.ShortenVars = tc.Options.ShortenVars
+	expected := NewMinifierWithOptions(tc.Input, opts).Minify()
+	if result := NewIncrementalMinifier(opts).Minify(tc.Input); result != expected {
+		t.Errorf("Incremental output differs.\nExpected: %q\nGot: %q", expected, result)
+	}
+}
+
+// TestIncrementalMinifier tests that incremental minification of edited
+// files matches minifying every version from scratch
+func TestIncrementalMinifier(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join("test", "testdata", "*.js"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keepComments := DefaultOptions()
+	keepComments.StripLineComments = false
+	keepComments.PreserveLicense = true
+	optionSets := map[string]Options{
+		"Default":      DefaultOptions(),
+		"KeepComments": keepComments,
+		"ShortenVars":  {ShortenVars: true, StripLineComments: true, StripBlockComments: true},
+	}
+
+	for _, file := range files {
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatalf("Failed to read test file %s: %v", file, err)
+		}
+		versions := []string{
+			string(content),
+			string(content) + "\nconst appended = 1;;\n",
+			"/*! header */\n" + strings.Replace(string(content), "return", "return /x/.test(s) ||", 1),
+		}
+		for name, opts := range optionSets {
+			t.Run(filepath.Base(file)+"/"+name, func(t *testing.T) {
+				inc := NewIncrementalMinifier(opts)
+				for i, version := range versions {
+					expected := NewMinifierWithOptions(version, opts).Minify()
+					if result := inc.Minify(version); result != expected {
+						t.Errorf("Version %d differs.\nExpected: %s\nGot: %s", i, expected, result)
+					}
+				}
+			})
+		}
 	}
 }
 
@@ -116,6 +3710,389 @@ func TestFileProcessing(t *testing.T) {
 	}
 }
 
+// TestMultiLineLiterals tests that object and array literals written across
+// several lines collapse to their compact form, keeping every element and
+// any trailing comma, and that a statement after one stays separate from it
+func TestMultiLineLiterals(t *testing.T) {
+	testCases := []TestCase{
+		{
+			Name:           "Object",
+			Input:          "const point = {\n  x: 1,\n  y: 2\n};",
+			ExpectedOutput: "const point={x:1,y:2};",
+		},
+		{
+			Name:           "Array With Trailing Comma",
+			Input:          "const list = [\n  'a',\n  'b',\n];",
+			ExpectedOutput: "const list=['a','b',];",
+		},
+		{
+			Name: "Nested",
+			Input: "const config = {\n  name: 'app',\n  ports: [\n    80,\n    443,\n  ],\n  routes: [\n    { path: '/', " +
+				"handler: home },\n    {\n      path: '/about',\n      handler: about,\n    },\n  ],\n  empty: {\n  },\n};",
+			ExpectedOutput: "const config={name:'app',ports:[80,443,],routes:[{path:'/',handler:home},{path:'/about',handler:about,},],empty:{},};",
+		},
+		{
+			Name:           "Object Without Semicolon",
+			Input:          "const point = {\n  x: 1,\n  y: 2\n}\nconst list = [\n  1\n]\nmove(point)\nrender()",
+			ExpectedOutput: "const point={x:1,y:2}\nconst list=[1]\nmove(point)\nrender()",
+		},
+		{
+			Name:           "Function Expression Without Semicolon",
+			Input:          "const f = function () {\n  return 1\n}\nconst g = () => {\n  return 2\n}\nf(g)",
+			ExpectedOutput: "const f=function(){return 1}\nconst g=()=>{return 2}\nf(g)",
+		},
+		{
+			Name:           "Block After Declaration",
+			Input:          "var x = 1\n{ foo() }\nlet s = 'a'\n{ bar() }",
+			ExpectedOutput: "var x=1\n{foo()}\nlet s='a'\n{bar()}",
+		},
+		{
+			Name:           "Block After Expression",
+			Input:          "x = y\n{ z() }\nf(a)\n{ g() }\nlist = [1]\n{ h() }",
+			ExpectedOutput: "x=y\n{z()}\nf(a)\n{g()}\nlist=[1]\n{h()}",
+		},
+		{
+			Name:           "Brace After Keyword",
+			Input:          "if (a)\n{\n  b()\n}\nelse\n{\n  c()\n}\ntry\n{\n  d()\n}\nfinally\n{\n  e()\n}\nfunction f()\n{\n  return 1\n}",
+			ExpectedOutput: "if(a){b()}else{c()}try{d()}finally{e()}function f(){return 1}",
+		},
+		{
+			Name:           "Statements After Function Expression",
+			Input:          "x = function () {}\n{ foo() }\ny = function () {}\n++count\nz = function () {}\n/re/.test(s)",
+			ExpectedOutput: "x=function(){}\n{foo()}y=function(){}\n++count\nz=function(){}\n/re/.test(s)",
+		},
+		{
+			Name:           "Blocks Need No Separator",
+			Input:          "function f() {\n  if (a) {\n    b()\n  }\n  return c\n}\nclass A {\n  m() {\n    return 1\n  }\n  n() {}\n}\nf()",
+			ExpectedOutput: "function f(){if(a){b()}return c}class A{m(){return 1}n(){}}f()",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			result := NewMinifier(tc.Input, false, false).Minify()
+			checkIncremental(t, tc)
+			if result != tc.ExpectedOutput {
+				t.Errorf("%s failed.\nExpected: %q\nGot: %q", tc.Name, tc.ExpectedOutput, result)
+			}
+		})
+	}
+}
+
+// TestTopLevelNewlines tests that top-level statements are put on lines of
+// their own while the statements nested in them stay collapsed
+func TestTopLevelNewlines(t *testing.T) {
+	input := "const config = { debug: true };\nfunction init(x) {\n  if (x) { return x; } else { return 0; }\n}\n" +
+		"class App { run() { for (let i = 0; i < 3; i++) { log(i); } } }\ntry { init(1); } catch (e) { } finally { done(); }\n" +
+		"const t = `${ {a: 1}.a }`; do { i++; } while (i < 3)\nconst f = function () { return 1; }, g = () => {};\nrun(f, g);"
+	expected := "const config={debug:true};\nfunction init(x){if(x){return x;}else{return 0;}}\n" +
+		"class App{run(){for(let i=0;i<3;i++){log(i);}}}\ntry{init(1);}catch(e){}finally{done();}\n" +
+		"const t=`${{a:1}.a}`;\ndo{i++;}while(i<3)\nconst f=function(){return 1;},g=()=>{};\nrun(f,g);"
+
+	opts := DefaultOptions()
+	opts.TopLevelNewlines = true
+	if result := NewMinifierWithOptions(input, opts).Minify(); result != expected {
+		t.Errorf("Top-level newlines failed.\nExpected:\n%s\nGot:\n%s", expected, result)
+	}
+}
+
+// TestRemoveEmpty tests that empty statements and empty blocks are removed
+// where the code means the same without them, and that the braces a
+// statement requires are kept
+func TestRemoveEmpty(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected string
+	}{
+		{"repeated semicolons", "a();;;\nb();", "a();b();"},
+		{"semicolon after a block", "if (x) { a(); };\nfunction f() {};", "if(x){a();}function f(){}"},
+		{"semicolon opening a block", "while (x) { ; a(); }", "while(x){a();}"},
+		{"block statement", "a(); {}\n{ ; }\nb();", "a();b();"},
+		{"function body", "function f() {}\nconst g = () => {};", "function f(){}const g=()=>{};"},
+		{"if and else bodies", "if (x) {} else {}", "if(x);else;"},
+		{"loop bodies", "for (;;) {}\nwhile (x) {}\ndo {} while (y);", "for(;;);while(x);do;while(y);"},
+		{"required braces", "try {} catch (e) {} finally {}\nswitch (x) {}\nclass A {}", "try{}catch(e){}finally{}switch(x){}class A{}"},
+		{"object literal", "const o = {};\nf({});", "const o={};f({});"},
+		{"methods named like statements", "class A { if() {} for() {} }\nconst o = { while() {} }", "class A{if(){}for(){}}const o={while(){}}"},
+		{"statements in methods", "class A { m() { if (x) {} } }\nconst o = { m() { while (x) {} } }", "class A{m(){if(x);}}const o={m(){while(x);}}"},
+		{"leading semicolons", ";;a();;;b();", "a();b();"},
+		{"leading semicolon before a call", ";(function () {})();", "(function(){})();"},
+		{"kept comment", "if (x) { /*! keep */ }", "if(x){/*! keep */}"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := DefaultOptions()
+			opts.RemoveEmpty = true
+			opts.KeepLegalComments = true
+			if result := NewMinifierWithOptions(tt.input, opts).Minify(); result != tt.expected {
+				t.Errorf("Expected %q, got %q", tt.expected, result)
+			}
+		})
+	}
+}
+
+// TestFoldStrings tests that string literals added to each other are
+// joined, and that additions involving anything else, or in which another
+// operator binds a literal more tightly, are kept
+func TestFoldStrings(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected string
+	}{
+		{"two literals", `const s = "foo" + "bar";`, `const s="foobar";`},
+		{"not literals", `const s = x + "b", t = "a" + x;`, `const s=x+"b",t="a"+x;`},
+		{"inside a chain", `const s = x + "a" + "b" + y;`, `const s=x+"ab"+y;`},
+		{"mixed quotes", `const s = 'it\'s ' + "a \"q\"" + "'x'";`, `const s='it\'s a \"q\"\'x\'';`},
+		{"tighter operators", `const s = -"1" + "2", t = "a" + "b".length, u = x * "a" + "b";`, `const s=-"1"+"2",t="a"+"b".length,u=x*"a"+"b";`},
+		{"unary plus", `const s = +"1" + "2";`, `const s=+"1"+"2";`},
+		{"directive", `"use " + "strict";`, `"use "+"strict";`},
+		{"octal escape", `f("\0" + "1", "\0" + "a");`, `f("\0"+"1","\0a");`},
+		{"return and case", `switch (k) { case "a" + "b": return "c" + "d"; }`, `switch(k){case "ab":return "cd";}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := DefaultOptions()
+			opts.FoldStrings = true
+			if result := NewMinifierWithOptions(tt.input, opts).Minify(); result != tt.expected {
+				t.Errorf("Expected %s, got %s", tt.expected, result)
+			}
+		})
+	}
+}
+
+// TestLineWidth tests that lines of the output are broken before they get
+// longer than the width, only where a line break cannot change the code
+func TestLineWidth(t *testing.T) {
+	input := "const config = { name: 'app', version: 3, flags: [1, 2, 3], label: `v${3}` };\n" +
+		"function update(state, action) {\n\tswitch (action.type) {\n\t\tcase 'add': return { ...state, count: state.count + 1 };\n" +
+		"\t\tdefault: return state;\n\t}\n}\nlet i = 0;\n++i;\nfor (let j = 0; j < 10; j++) { i += j; }\nexport { config, update };\n"
+	unwrapped := NewMinifier(input, false, false).Minify()
+
+	opts := DefaultOptions()
+	opts.LineWidth = 40
+	result := NewMinifierWithOptions(input, opts).Minify()
+	for _, line := range strings.Split(result, "\n") {
+		if len(line) > opts.LineWidth {
+			t.Errorf("Line longer than %d bytes: %q", opts.LineWidth, line)
+		}
+	}
+	if strings.Count(result, "\n") < 3 {
+		t.Errorf("Expected the output to be wrapped:\n%s", result)
+	}
+	if strings.Contains(result, "\n++") {
+		t.Errorf("Line broken before a prefix increment:\n%s", result)
+	}
+	if joined := strings.ReplaceAll(result, "\n", ""); joined != unwrapped {
+		t.Errorf("Wrapping changed more than line breaks.\nExpected: %s\nGot: %s", unwrapped, joined)
+	}
+}
+
+// TestSwitchFallthrough tests that the cases of a switch statement that
+// fall through to the next one keep every statement, with no break or
+// statement end added between them, with and without -remove-empty
+func TestSwitchFallthrough(t *testing.T) {
+	input := "switch (n) {\n\tcase 1:\n\tcase 2:\n\t\tlow();\n\tcase 3: {\n\t\tmid();\n\t}\n\tcase 4: ;;\n\tcase 5: {}\n" +
+		"\t\tfive();\n\t\t// falls through\n\tdefault:\n\t\tany();\n\t\tbreak;\n\tcase 6:\n\t\tsix();\n}"
+	expected := "switch(n){case 1:case 2:low();case 3:{mid();}\ncase 4:;case 5:{}\nfive();default:any();break;case 6:six();}"
+
+	for _, removeEmpty := range []bool{false, true} {
+		opts := DefaultOptions()
+		opts.RemoveEmpty = removeEmpty
+		if result := NewMinifierWithOptions(input, opts).Minify(); result != expected {
+			t.Errorf("With RemoveEmpty %v:\nExpected: %s\nGot: %s", removeEmpty, expected, result)
+		}
+	}
+}
+
+// TestBeautify tests that the beautify output format re-indents code with
+// one statement per line and that minifying it again gives the same result
+// as minifying the original
+func TestBeautify(t *testing.T) {
+	input := "function f(items, n) {\n  for (let i = 0; i < n; i++) { if (!items[i]) continue; else total += -items[i] * 1e-3; }\n" +
+		"  const x = a ?? b, y = ok ? 1 : 2;\n  return { x, label: `${x}:${y}` };\n}\n"
+	expected := `function f(items, n) {
+  for (let i = 0; i < n; i++) {
+    if (!items[i]) continue;
+    else total += -items[i] * 1e-3;
+  }
+  const x = a ?? b, y = ok ? 1 : 2;
+  return {
+    x,
+    label: ` + "`${x}:${y}`" + `
+  };
+}
+`
+
+	opts := DefaultOptions()
+	opts.Beautify = true
+	if result := NewMinifierWithOptions(input, opts).Minify(); result != expected {
+		t.Errorf("Beautify failed.\nExpected:\n%s\nGot:\n%s", expected, result)
+	}
+
+	// Generator stars and prefix ++ and -- are unary and take no space
+	input = "class A { static async *m() { yield* g() } *n() {} }\nconst o = { async *p() {} }\nx = a * b\n--z"
+	expected = `class A {
+  static async *m() {
+    yield* g()
+  }
+  *n() {}
+}
+const o = {
+  async *p() {}
+}
+x = a * b
+--z
+`
+	if result := NewMinifierWithOptions(input, opts).Minify(); result != expected {
+		t.Errorf("Beautify failed for generators.\nExpected:\n%s\nGot:\n%s", expected, result)
+	}
+
+	files, err := filepath.Glob(filepath.Join("test", "testdata", "*.js"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		t.Run(filepath.Base(file), func(t *testing.T) {
+			content, err := ioutil.ReadFile(file)
+			if err != nil {
+				t.Fatalf("Failed to read test file: %v", err)
+			}
+			beautified := NewMinifierWithOptions(string(content), opts).Minify()
+			if !strings.Contains(beautified, "\n  ") {
+				t.Errorf("Beautified output is not indented:\n%s", beautified)
+			}
+			want := NewMinifier(string(content), false, false).Minify()
+			if got := NewMinifier(beautified, false, false).Minify(); got != want {
+				t.Errorf("Beautified output minifies differently.\nExpected: %s\nGot: %s", want, got)
+			}
+		})
+	}
+
+	if code := run([]string{"-input", "app.js", "-output-format", "pretty"}); code != 1 {
+		t.Errorf("Expected exit code 1 for an unknown output format, got %d", code)
+	}
+}
+
+// TestMultiLineTemplateLiteral tests that line breaks and indentation inside
+// template literals are kept, since they are part of the string, while the
+// code in their substitutions is still minified
+func TestMultiLineTemplateLiteral(t *testing.T) {
+	input := "function render(items) {\n\treturn `<ul>\n  ${items.map(item =>\n      `<li>${item}</li>`).join(\"\\n\")}\n</ul>\r\n`;\n}\n"
+	expected := "function render(a){return `<ul>\n  ${a.map(b=>`<li>${b}</li>`).join(\"\\n\")}\n</ul>\r\n`;}"
+
+	result := NewMinifier(input, false, true).Minify()
+	if result != expected {
+		t.Errorf("Multi-line template literal was not preserved.\nExpected: %q\nGot: %q", expected, result)
+	}
+}
+
+// TestNestedTemplateLiterals tests that templates nested in substitutions,
+// and braces and backticks inside their literals, keep the outer template
+// intact while the code of every substitution is minified
+func TestNestedTemplateLiterals(t *testing.T) {
+	testCases := []TestCase{
+		{
+			Name:           "Two Levels",
+			Input:          "const label = `outer ${ `inner ${ x + 1 } and ${ `deep ${ y ? 'a' : \"b\" }` }` } end`;",
+			ExpectedOutput: "const label=`outer ${`inner ${x+1} and ${`deep ${y?'a':\"b\"}`}`} end`;",
+		},
+		{
+			Name:           "Braces In Substitutions",
+			Input:          "const text = `a ${ { key: `v${ 1 }` }.key } b ${ join(`}`, '${') }`;",
+			ExpectedOutput: "const text=`a ${{key:`v${1}`}.key} b ${join(`}`,'${')}`;",
+		},
+		{
+			Name:           "Shortened Names",
+			Input:          "function row(cells, sep) {\n\treturn `<tr>${ cells.map(cell => `<td>${ cell }${ sep }</td>`).join('') }</tr>`;\n}",
+			ExpectedOutput: "function row(a,b){return `<tr>${a.map(c=>`<td>${c}${b}</td>`).join('')}</tr>`;}",
+			Options:        MinificationOptions{ShortenVars: true},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			minifier := NewMinifier(tc.Input, tc.Options.PreserveLicense, tc.Options.ShortenVars)
+			result := minifier.Minify()
+			checkIncremental(t, tc)
+			if result != tc.ExpectedOutput {
+				t.Errorf("%s failed.\nExpected: %s\nGot: %s", tc.Name, tc.ExpectedOutput, result)
+			}
+		})
+	}
+}
+
+// lastToken returns the last token of code that is not a comment, with
+// literals spelled out
+func lastToken(code string) string {
+	var literals []string
+	tokens := tokenize(NewMinifier("", false, false).protectLiterals(code, &literals))
+	for i := len(tokens) - 1; i >= 0; i-- {
+		switch tokens[i].kind {
+		case tokSpace:
+			continue
+		case tokLiteral:
+			text, _ := literalText(tokens[i].text, literals)
+			return text
+		}
+		return tokens[i].text
+	}
+	return ""
+}
+
+// TestTrailingContent tests that no pass drops the end of a file: the last
+// token of every input, apart from comments, ends its output too, and the
+// final statement of each test file survives intact
+func TestTrailingContent(t *testing.T) {
+	inputs := map[string]string{
+		"line comment without newline": "const a = 1; // done",
+		"url in a string":              "const url = 'http://example.com'; fetch(url)",
+		"regex":                        "const re = /\\/\\//g",
+		"template":                     "render(`${a}`)\n`tail`",
+		"no semicolon":                 "let x = 1\nx++",
+	}
+	files, err := filepath.Glob(filepath.Join("test", "testdata", "*.js"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatalf("Failed to read test file: %v", err)
+		}
+		inputs[filepath.Base(file)] = string(content)
+	}
+
+	variants := map[string]func(*Options){
+		"default":            func(*Options) {},
+		"shorten-vars":       func(opts *Options) { opts.ShortenVars = true },
+		"beautify":           func(opts *Options) { opts.Beautify = true },
+		"top-level-newlines": func(opts *Options) { opts.TopLevelNewlines = true },
+		"keep-comments":      func(opts *Options) { opts.StripLineComments, opts.StripBlockComments = false, false },
+	}
+	for name, input := range inputs {
+		chunks := splitStatements(input)
+		final := ""
+		for i := len(chunks) - 1; i >= 0 && final == ""; i-- {
+			final = NewMinifier(chunks[i], false, false).Minify()
+		}
+		for variant, configure := range variants {
+			t.Run(name+"/"+variant, func(t *testing.T) {
+				opts := DefaultOptions()
+				configure(&opts)
+				output := NewMinifierWithOptions(input, opts).Minify()
+				if got, want := lastToken(output), lastToken(input); got != want {
+					t.Errorf("Output ends with %q instead of %q:\n%s", got, want, output)
+				}
+				if variant == "default" && !strings.HasSuffix(output, final) {
+					t.Errorf("Output lost the final statement %q:\n%s", final, output)
+				}
+			})
+		}
+	}
+}
+
 // TestEdgeCases tests various edge cases
 func TestEdgeCases(t *testing.T) {
 	testCases := []TestCase{
@@ -143,12 +4120,19 @@ func TestEdgeCases(t *testing.T) {
 			ExpectedOutput: `const regex=/test/g;`,
 			Options:        MinificationOptions{false, false},
 		},
+		{
+			Name:           "Empty For Clauses",
+			Input:          "for (;;) { if (x) break; }\nfor (let i = 0;; i++) {}\nlet a = 1;;;",
+			ExpectedOutput: "for(;;){if(x)break;}for(let i=0;;i++){}let a=1;",
+			Options:        MinificationOptions{false, false},
+		},
 	}
 
 	for _, tc := range testCases {
 		t.Run(tc.Name, func(t *testing.T) {
 			minifier := NewMinifier(tc.Input, tc.Options.PreserveLicense, tc.Options.ShortenVars)
 			result := minifier.Minify()
+			checkIncremental(t, tc)
 			if normalizeWhitespace(result) != normalizeWhitespace(tc.ExpectedOutput) {
 				t.Errorf("%s failed.\nExpected: %s\nGot: %s", tc.Name, tc.ExpectedOutput, result)
 			}
@@ -156,6 +4140,120 @@ func TestEdgeCases(t *testing.T) {
 	}
 }
 
+// TestEmptyFileStats tests that empty and comment-only files are minified
+// to nothing with a well-defined reduction
+func TestEmptyFileStats(t *testing.T) {
+	testCases := []struct {
+		name      string
+		input     string
+		reduction float64
+	}{
+		{"Empty File", "", 0},
+		{"Whitespace Only", " \n\t\n", 100},
+		{"Comments Only", "// Just a comment\n/* Another comment */\n", 100},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			inputPath := filepath.Join(t.TempDir(), "empty.js")
+			if err := ioutil.WriteFile(inputPath, []byte(tc.input), 0644); err != nil {
+				t.Fatalf("Failed to write input file: %v", err)
+			}
+
+			stats := make(chan MinificationStats, 1)
+			if err := processFile(inputPath, "", DefaultOptions(), stats); err != nil {
+				t.Fatalf("Failed to process file: %v", err)
+			}
+			stat := <-stats
+			if stat.MinifiedSize != 0 {
+				t.Errorf("Expected empty output, got %d bytes", stat.MinifiedSize)
+			}
+			if stat.Reduction != tc.reduction {
+				t.Errorf("Expected a reduction of %v, got %v", tc.reduction, stat.Reduction)
+			}
+			if _, err := json.Marshal(stat); err != nil {
+				t.Errorf("Stats cannot be encoded as JSON: %v", err)
+			}
+		})
+	}
+}
+
+// TestFailedFileStats tests that a file that fails to minify still gets a
+// stats entry, flagged with the error, so that batch summaries count it
+func TestFailedFileStats(t *testing.T) {
+	dir := t.TempDir()
+	good := filepath.Join(dir, "good.js")
+	bad := filepath.Join(dir, "bad.js")
+	if err := ioutil.WriteFile(good, []byte("const value = 1;\n"), 0644); err != nil {
+		t.Fatalf("Failed to write input file: %v", err)
+	}
+	if err := ioutil.WriteFile(bad, []byte("let count: number = 0;\n"), 0644); err != nil {
+		t.Fatalf("Failed to write input file: %v", err)
+	}
+	var errs bytes.Buffer
+	userOutput.SetOutput(&errs)
+	defer userOutput.SetOutput(os.Stderr)
+
+	stats := map[string]MinificationStats{}
+	for _, stat := range processFiles([]string{good, bad}, DefaultOptions(), true) {
+		stats[stat.InputFile] = stat
+	}
+	if len(stats) != 2 {
+		t.Fatalf("Expected a stats entry for both files, got %+v", stats)
+	}
+	if stat := stats[good]; stat.Error != "" || stat.MinifiedSize != len("const value=1;") {
+		t.Errorf("Unexpected stats for the minified file: %+v", stat)
+	}
+	stat := stats[bad]
+	if stat.Error != bad+":1:10: TypeScript is not supported; compile to JS first" {
+		t.Errorf("Expected the error in the stats entry, got %q", stat.Error)
+	}
+	if stat.OutputFile != "" || stat.OriginalSize != len("let count: number = 0;\n") {
+		t.Errorf("Unexpected stats for the failed file: %+v", stat)
+	}
+	data, err := json.Marshal(stat)
+	if err != nil || !strings.Contains(string(data), `"error":`) {
+		t.Errorf("Expected the error in the JSON stats, got %s (%v)", data, err)
+	}
+}
+
+// TestFailureSummary tests that a directory run in which files fail ends
+// with a summary listing them, and exits with a non-zero status
+func TestFailureSummary(t *testing.T) {
+	dir := t.TempDir()
+	sources := map[string]string{
+		"a.js":   "const first = 1;\n",
+		"b.js":   "const second = 2;\n",
+		"bad.js": "let count: number = 0;\n",
+	}
+	for name, source := range sources {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(source), 0644); err != nil {
+			t.Fatalf("Failed to write input file: %v", err)
+		}
+	}
+	var errs bytes.Buffer
+	userOutput.SetOutput(&errs)
+	defer userOutput.SetOutput(os.Stderr)
+
+	if code := run([]string{"-input", dir}); code != 1 {
+		t.Errorf("Expected exit code 1, got %d", code)
+	}
+	bad := filepath.Join(dir, "bad.js")
+	summary := "1 of 3 files failed:\n  " + bad + ":1:10: TypeScript is not supported; compile to JS first\n"
+	if !strings.HasSuffix(errs.String(), summary) {
+		t.Errorf("Expected the output to end with the summary %q, got %q", summary, errs.String())
+	}
+
+	os.Remove(bad)
+	errs.Reset()
+	if code := run([]string{"-input", dir, "-force"}); code != 0 {
+		t.Errorf("Expected exit code 0 once no file fails, got %d", code)
+	}
+	if strings.Contains(errs.String(), "failed") {
+		t.Errorf("Unexpected summary without failures: %q", errs.String())
+	}
+}
+
 // TestTodoAppMinification tests the minification of the todo list application
 func TestTodoAppMinification(t *testing.T) {
 	// Read the original todo app JavaScript
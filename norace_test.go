@@ -0,0 +1,7 @@
+//go:build !race
+
+package main
+
+// raceEnabled reports whether the tests were built with -race, whose
+// instrumentation allocates on its own
+const raceEnabled = false
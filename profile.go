@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// passTiming records how long one pass of a Minify call took
+type passTiming struct {
+	pass     string
+	duration time.Duration
+}
+
+// profileOutput receives the per-pass timings printed with -profile
+var profileOutput io.Writer = os.Stderr
+
+// recordPass notes that the named pass, begun at start, has finished. It
+// does nothing unless profiling is enabled.
+func (m *Minifier) recordPass(pass string, start time.Time) {
+	if m.opts.Profile {
+		m.timings = append(m.timings, passTiming{pass, time.Since(start)})
+	}
+}
+
+// writeProfile prints the pass timings of one file as a single write, so
+// that the profiles of files minified concurrently do not interleave
+func writeProfile(w io.Writer, file string, timings []passTiming) {
+	var b strings.Builder
+	var total time.Duration
+	fmt.Fprintf(&b, "profile: %s\n", file)
+	for _, t := range timings {
+		fmt.Fprintf(&b, "  %-20s %8.3f ms\n", t.pass, float64(t.duration.Microseconds())/1000.0)
+		total += t.duration
+	}
+	fmt.Fprintf(&b, "  %-20s %8.3f ms\n", "total", float64(total.Microseconds())/1000.0)
+	io.WriteString(w, b.String())
+}
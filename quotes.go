@@ -0,0 +1,243 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// parseQuoteStyle returns the quote -quotes selects: keep, which leaves
+// every string as written, single or double
+func parseQuoteStyle(style string) (byte, error) {
+	switch style {
+	case "keep":
+		return 0, nil
+	case "single":
+		return '\'', nil
+	case "double":
+		return '"', nil
+	}
+	return 0, fmt.Errorf("unknown quote style %q, want keep, single or double", style)
+}
+
+// normalizeQuotes rewrites the string literals among the protected
+// literals to use quote where that needs no extra escapes
+func normalizeQuotes(literals []string, quote byte) {
+	for i, literal := range literals {
+		if len(literal) >= 2 && (literal[0] == '\'' || literal[0] == '"') && literal[0] != quote {
+			literals[i] = requote(literal, quote)
+		}
+	}
+}
+
+// requote returns the string literal s enclosed in quote instead of its own
+// quotes. Escapes of the old quote are no longer needed and are dropped,
+// apart from that the contents are kept byte for byte. A string containing
+// quote itself is returned unchanged, since it would need escapes that
+// make it longer.
+func requote(s string, quote byte) string {
+	old := s[0]
+	body := s[1 : len(s)-1]
+	var b strings.Builder
+	b.Grow(len(s))
+	b.WriteByte(quote)
+	for i := 0; i < len(body); i++ {
+		switch c := body[i]; {
+		case c == quote:
+			return s
+		case c == '\\' && i+1 < len(body):
+			i++
+			if body[i] != old {
+				b.WriteByte('\\')
+			}
+			b.WriteByte(body[i])
+		default:
+			b.WriteByte(c)
+		}
+	}
+	b.WriteByte(quote)
+	return b.String()
+}
+
+// foldStrings joins string literals added to each other in collapsed code,
+// so that `"foo"+"bar"` becomes `"foobar"`. A chain of additions is only
+// folded where no operator binds the literals more tightly than `+` does:
+// `-"a"+"b"` and `"a"+"b".length` are left alone, as is a string starting
+// an expression statement, which folded could become a directive such as
+// "use strict". literals holds the text of the placeholders in code and is
+// updated with the joined literals.
+func foldStrings(code string, literals []string) string {
+	var b strings.Builder
+	b.Grow(len(code))
+	for i := 0; i < len(code); i++ {
+		if code[i] != placeholderMark {
+			b.WriteByte(code[i])
+			continue
+		}
+		end := i + 1 + strings.IndexByte(code[i+1:], placeholderMark)
+		n, _ := strconv.Atoi(code[i+1 : end])
+		b.WriteString(code[i : end+1])
+		if !isStringLiteral(literals[n]) || !foldsAfter(b.String(), end-i+1, literals) {
+			i = end
+			continue
+		}
+		// The literals are joined in one builder, since joining them one
+		// pair at a time would copy a long chain over and over
+		var joined strings.Builder
+		left := literals[n]
+		octal := endsInOctalEscape(left)
+		folded := false
+		for {
+			plus := skipSpaces(code, end+1)
+			next := skipSpaces(code, plus+1)
+			if plus == len(code) || code[plus] != '+' || next >= len(code) || code[next] != placeholderMark {
+				break
+			}
+			nextEnd := next + 1 + strings.IndexByte(code[next+1:], placeholderMark)
+			right := placeholderText(code[next+1:nextEnd], literals)
+			if !isStringLiteral(right) || bindsTighter(code, nextEnd+1, literals) {
+				break
+			}
+			if octal && len(right) > 2 && right[1] >= '0' && right[1] <= '9' {
+				break
+			}
+			if !folded {
+				joined.WriteString(left[:len(left)-1])
+				folded = true
+			}
+			appendStringBody(&joined, right, left[0])
+			if len(right) > 2 {
+				octal = endsInOctalEscape(right)
+			}
+			end = nextEnd
+		}
+		if folded {
+			joined.WriteByte(left[0])
+			literals[n] = joined.String()
+		}
+		i = end
+	}
+	return b.String()
+}
+
+// isStringLiteral reports whether literal is a quoted string
+func isStringLiteral(literal string) bool {
+	return len(literal) >= 2 && (literal[0] == '"' || literal[0] == '\'')
+}
+
+// skipSpaces returns the offset of the first byte of code at or after i
+// that is not whitespace
+func skipSpaces(code string, i int) int {
+	for i < len(code) && isSpace(code[i]) {
+		i++
+	}
+	return i
+}
+
+// foldsAfter reports whether a string literal whose placeholder is the last
+// size bytes of out may be joined with the strings added to it, given what
+// comes before it. The literal must follow an operator that binds less
+// tightly than `+`, a binary `+` or a keyword such as return.
+func foldsAfter(out string, size int, literals []string) bool {
+	p := len(out) - size - 1
+	for p >= 0 && isSpace(out[p]) {
+		p--
+	}
+	if p < 0 {
+		return false
+	}
+	switch c := out[p]; {
+	case strings.IndexByte("([,:?=&|^<>", c) >= 0:
+		return true
+	case c == '+':
+		// A binary `+` follows an operand; a unary one would convert the
+		// first string to a number
+		q := p - 1
+		for q >= 0 && isSpace(out[q]) {
+			q--
+		}
+		if q < 0 {
+			return false
+		}
+		switch d := out[q]; {
+		case d == ')' || d == ']':
+			return true
+		case d == placeholderMark:
+			return !isComment(placeholderBefore(out, q+1, literals))
+		case isWordByte(d):
+			start := q
+			for start > 0 && isWordByte(out[start-1]) {
+				start--
+			}
+			return !jsKeywords[out[start:q+1]]
+		}
+		return false
+	case c == placeholderMark:
+		return strings.HasSuffix(placeholderBefore(out, p+1, literals), "${")
+	case isWordByte(c):
+		start := p
+		for start > 0 && isWordByte(out[start-1]) {
+			start--
+		}
+		switch out[start : p+1] {
+		case "return", "case", "in", "of", "instanceof", "yield", "throw":
+			return true
+		}
+	}
+	return false
+}
+
+// bindsTighter reports whether the code from offset i on, which follows a
+// string literal, applies an operator to it that binds more tightly than
+// `+`, such as a member access, a call or a multiplication
+func bindsTighter(code string, i int, literals []string) bool {
+	i = skipSpaces(code, i)
+	if i == len(code) {
+		return false
+	}
+	switch c := code[i]; {
+	case strings.IndexByte(".[(*/%", c) >= 0:
+		return true
+	case c == '?':
+		return i+1 < len(code) && code[i+1] == '.'
+	case c == placeholderMark:
+		return !strings.HasPrefix(placeholderAfter(code, i, literals), "}")
+	}
+	return false
+}
+
+// endsInOctalEscape reports whether the string literal ends with an octal
+// escape such as `\0`. A string starting with a digit cannot be joined to
+// it, since the digit would then become part of the escape.
+func endsInOctalEscape(literal string) bool {
+	octal := false
+	for i := 1; i < len(literal)-1; i++ {
+		if literal[i] == '\\' {
+			i++
+			j := i
+			for j < len(literal)-1 && literal[j] >= '0' && literal[j] <= '9' {
+				j++
+			}
+			octal = j > i && j == len(literal)-1
+		}
+	}
+	return octal
+}
+
+// appendStringBody writes the contents of the string literal to b as they
+// are written inside quote, escaping quote where the literal has it bare
+func appendStringBody(b *strings.Builder, literal string, quote byte) {
+	body := literal[1 : len(literal)-1]
+	for i := 0; i < len(body); i++ {
+		switch c := body[i]; {
+		case c == '\\' && i+1 < len(body):
+			b.WriteString(body[i : i+2])
+			i++
+		case c == quote:
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+}
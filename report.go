@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"html/template"
+	"io/ioutil"
+)
+
+// reportRow is one file in the HTML report
+type reportRow struct {
+	MinificationStats
+	// GzipSize is the gzip-compressed size of the minified output, or -1
+	// when no output file was written
+	GzipSize int
+}
+
+// reportTemplate lays out the HTML report: a table of the files with their
+// sizes that sorts by a column when its header is clicked
+var reportTemplate = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Minification report</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; }
+th, td { padding: 0.3em 0.8em; border-bottom: 1px solid #ddd; }
+th { cursor: pointer; text-align: left; background: #f4f4f4; }
+td.size { text-align: right; font-variant-numeric: tabular-nums; }
+tr.failed td { color: #b00; }
+</style>
+</head>
+<body>
+<h1>Minification report</h1>
+<table id="files">
+<thead><tr><th>File</th><th>Original</th><th>Minified</th><th>Reduction</th><th>Gzip</th></tr></thead>
+<tbody>
+{{- range .Rows}}
+{{- if .Error}}
+<tr class="failed"><td>{{.InputFile}}</td><td class="size" data-value="{{.OriginalSize}}">{{.OriginalSize}}</td><td colspan="3">{{.Error}}</td></tr>
+{{- else}}
+<tr><td>{{.InputFile}}</td><td class="size" data-value="{{.OriginalSize}}">{{.OriginalSize}}</td><td class="size" data-value="{{.MinifiedSize}}">{{.MinifiedSize}}</td><td class="size" data-value="{{printf "%.2f" .Reduction}}">{{printf "%.2f" .Reduction}}%</td><td class="size" data-value="{{.GzipSize}}">{{if ge .GzipSize 0}}{{.GzipSize}}{{else}}-{{end}}</td></tr>
+{{- end}}
+{{- end}}
+</tbody>
+<tfoot><tr><th>Total</th><td class="size">{{.Original}}</td><td class="size">{{.Minified}}</td><td colspan="2"></td></tr></tfoot>
+</table>
+<script>
+document.querySelectorAll("#files thead th").forEach(function (th, column) {
+  var ascending = false;
+  th.addEventListener("click", function () {
+    var body = document.querySelector("#files tbody");
+    var rows = Array.from(body.rows);
+    ascending = !ascending;
+    rows.sort(function (a, b) {
+      var x = a.cells[column], y = b.cells[column];
+      if (!x || !y) return 0;
+      var order = x.dataset.value !== undefined && y.dataset.value !== undefined
+        ? x.dataset.value - y.dataset.value
+        : x.textContent.localeCompare(y.textContent);
+      return ascending ? order : -order;
+    });
+    rows.forEach(function (row) { body.appendChild(row); });
+  });
+});
+</script>
+</body>
+</html>
+`))
+
+// writeHTMLReport writes an HTML page to path that lists every file of
+// stats with its original, minified and gzipped minified sizes, for
+// sharing the results of a run
+func writeHTMLReport(path string, stats []MinificationStats) error {
+	data := struct {
+		Rows               []reportRow
+		Original, Minified int
+	}{}
+	for _, stat := range stats {
+		row := reportRow{MinificationStats: stat, GzipSize: -1}
+		if stat.Error == "" {
+			data.Original += stat.OriginalSize
+			data.Minified += stat.MinifiedSize
+			row.GzipSize = gzipSize(stat.OutputFile)
+		}
+		data.Rows = append(data.Rows, row)
+	}
+
+	var b bytes.Buffer
+	if err := reportTemplate.Execute(&b, data); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, b.Bytes(), 0644)
+}
+
+// gzipSize returns the size of the file at path once compressed with gzip,
+// or -1 when there is no such file
+func gzipSize(path string) int {
+	if path == "" {
+		return -1
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return -1
+	}
+	var b bytes.Buffer
+	w := gzip.NewWriter(&b)
+	w.Write(content)
+	w.Close()
+	return b.Len()
+}
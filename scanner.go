@@ -0,0 +1,671 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// placeholderMark delimits placeholders for protected source spans. It is a
+// NUL byte, which cannot appear in JavaScript code outside of literals, and
+// is neither whitespace, punctuation nor a word character, so the later
+// passes treat a placeholder as an opaque token and leave it alone.
+const placeholderMark = '\x00'
+
+// regexPrecedingKeywords lists the keywords after which a `/` starts a
+// regular expression literal rather than a division
+var regexPrecedingKeywords = map[string]bool{
+	"return":     true,
+	"typeof":     true,
+	"instanceof": true,
+	"in":         true,
+	"of":         true,
+	"new":        true,
+	"delete":     true,
+	"void":       true,
+	"throw":      true,
+	"case":       true,
+	"do":         true,
+	"else":       true,
+	"yield":      true,
+	"await":      true,
+}
+
+// Kinds of significant token the scanner last emitted, used to decide
+// whether a `/` starts a regular expression or is a division operator
+const (
+	tokenNone    = iota // start of input or start of a template expression
+	tokenWord           // identifier, keyword or number
+	tokenLiteral        // string, template or regular expression literal
+	tokenPunct          // any other punctuator
+)
+
+// scanner walks JavaScript source once, removing comments and swapping
+// string, template and regular expression literals for placeholders so
+// that the whitespace and renaming passes can never alter their contents
+type scanner struct {
+	m     *Minifier
+	src   string
+	out   strings.Builder
+	store *[]string
+
+	last     int    // kind of the last significant token
+	lastWord string // text of the last token when it is a word
+	lastByte byte   // last byte of the last punctuator
+
+	// afterOperand records whether the token before the last punctuator
+	// ended an operand, which tells a postfix ++ from a prefix one
+	afterOperand bool
+
+	// templates tracks open `${` expressions of enclosing template
+	// literals, holding the brace depth inside each expression
+	templates []int
+
+	// depth is the bracket nesting depth outside of literals, and ends
+	// records the offsets just past each `;` or `}` that closes a
+	// top-level statement
+	depth int
+	ends  []int
+
+	// generators holds the depth outside each open generator body, in
+	// which yield is a keyword; elsewhere it is an ordinary identifier.
+	// genHead tracks a generator function or method being declared, and
+	// genParams the depth outside its parameter list.
+	generators []int
+	genHead    int
+	genParams  int
+
+	// unclosedComment records that a `/*` has no `*/` after it, so that
+	// neither does any later one
+	unclosedComment bool
+
+	// regexFail is the offset of the line end reached by the last scan
+	// for a regular expression that found none, and regexClasses the
+	// character classes it passed through, from `[` to `]`, that do not
+	// end before the `/` last scanned from
+	regexFail    int
+	regexClasses [][2]int
+
+	// jsx is the offset just past the first `<` that opens a JSX element,
+	// or zero when there is none
+	jsx int
+
+	// scanOnly skips writing the output when only the positions found by
+	// the scan are wanted
+	scanOnly bool
+
+	// tokens, when set, is called with every word, punctuator and literal
+	// outside of comments, with its offset in the source
+	tokens func(kind int, text string, offset int)
+
+	// check, when set, is called with the offset of every bracket outside
+	// of literals and of every quote that does not start a complete literal
+	check func(c byte, offset int)
+}
+
+// protectLiterals strips comments from code and replaces the literals it
+// contains with placeholders, recording the original text in store.
+// Comments that keepComment selects are protected the same way.
+//
+// Whether a `/` starts a regular expression is decided from the previous
+// significant token, as a JavaScript parser would: after an identifier,
+// number, literal, `)`, `]` or a postfix `++`/`--` it is a division; after
+// any other punctuator, a keyword such as `return` or `typeof`, or at the
+// start of input it starts a regular expression. A `}` is assumed to close a
+// block, so a `/` after it starts a regular expression.
+func (m *Minifier) protectLiterals(code string, store *[]string) string {
+	s := &scanner{m: m, src: code, store: store}
+	s.out.Grow(len(code))
+	s.scan()
+	m.jsx = s.jsx
+	return s.out.String()
+}
+
+func (s *scanner) scan() {
+	src := s.src
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case isSpace(c):
+			s.write(src[i : i+1])
+			i++
+		case c == '/':
+			if end := s.commentEnd(i); end >= 0 {
+				s.comment(src[i:end], src[end:])
+				i = end
+			} else if s.regexAllowed() {
+				if end := s.regexEnd(i); end >= 0 {
+					s.literal(i, end, tokenLiteral)
+					i = end
+					continue
+				}
+				s.punct(i)
+				i++
+			} else {
+				s.punct(i)
+				i++
+			}
+		case c == '<' && strings.HasPrefix(src[i:], "<!--"),
+			c == '-' && strings.HasPrefix(src[i:], "-->") && atLineStart(src, i):
+			// HTML-like comments, which scripts inherit from the days of
+			// hiding them from browsers without JavaScript
+			end := len(src)
+			if nl := strings.IndexByte(src[i:], '\n'); nl >= 0 {
+				end = i + nl
+			}
+			s.comment(src[i:end], src[end:])
+			i = end
+		case c == '"' || c == '\'':
+			end := stringEnd(src, i)
+			if end < 0 {
+				if s.check != nil {
+					s.check(c, i)
+				}
+				s.punct(i)
+				i++
+				continue
+			}
+			s.literal(i, end, tokenLiteral)
+			i = end
+		case c == '`':
+			i = s.template(i + 1)
+		case c == '}' && len(s.templates) > 0 && s.templates[len(s.templates)-1] == 0:
+			// Closing brace of a `${` expression: resume the template
+			s.templates = s.templates[:len(s.templates)-1]
+			i = s.template(i + 1)
+		case isWordByte(c):
+			start := i
+			for i < len(src) && isWordByte(src[i]) {
+				i++
+			}
+			s.write(src[start:i])
+			s.token(tokenWord, src[start:i], start)
+			s.last, s.lastWord = tokenWord, src[start:i]
+			if memberName(src, start) || s.lastWord == "yield" && len(s.generators) == 0 {
+				// A keyword after a dot, as in `map.delete / 2`, is a
+				// property name and ends an operand, and so does a
+				// yield outside of generators, where it is a name
+				s.lastWord = ""
+			}
+		default:
+			if len(s.templates) > 0 {
+				switch c {
+				case '{':
+					s.templates[len(s.templates)-1]++
+				case '}':
+					s.templates[len(s.templates)-1]--
+				}
+			}
+			switch c {
+			case '(', '[', '{':
+				s.depth++
+			case ')', ']', '}':
+				s.depth--
+			}
+			if s.check != nil && strings.IndexByte("()[]{}", c) >= 0 {
+				s.check(c, i)
+			}
+			if c == '<' && s.jsx == 0 && s.regexAllowed() && i+1 < len(src) && (isWordByte(src[i+1]) || src[i+1] == '>') {
+				// No operator starts with `<`, so where an operand is
+				// expected it opens a JSX element or fragment
+				s.jsx = i + 1
+			}
+			if (c == ';' || c == '}') && s.depth == 0 && len(s.templates) == 0 {
+				s.ends = append(s.ends, i+1)
+			}
+			s.trackGenerator(c)
+			s.punct(i)
+			i++
+		}
+	}
+}
+
+// States of genHead while a generator function or method is declared
+const (
+	genNone   = iota
+	genName   // after the `*`, up to the parameter list
+	genParams // in the parameter list
+	genBody   // after the parameter list, before the body
+)
+
+// trackGenerator follows the head of a generator function or method from
+// its `*` to the brace opening its body, and each body to its closing
+// brace. It is called with every punctuator after the bracket depth has
+// been updated for it.
+func (s *scanner) trackGenerator(c byte) {
+	switch {
+	case c == '*' && s.startsGenerator():
+		s.genHead = genName
+	case c == '(' && s.genHead == genName:
+		s.genHead, s.genParams = genParams, s.depth-1
+	case c == ')' && s.genHead == genParams && s.depth == s.genParams:
+		s.genHead = genBody
+	case c == '{' && s.genHead == genBody:
+		s.generators = append(s.generators, s.depth-1)
+		s.genHead = genNone
+	case c == '}' && len(s.generators) > 0 && s.depth == s.generators[len(s.generators)-1]:
+		s.generators = s.generators[:len(s.generators)-1]
+	case s.genHead == genBody:
+		s.genHead = genNone
+	}
+}
+
+// startsGenerator reports whether a `*` after the last token declares a
+// generator, as in `function*`, `async *gen()` or `{ *[Symbol.iterator]() {} }`
+func (s *scanner) startsGenerator() bool {
+	switch s.last {
+	case tokenWord:
+		return s.lastWord == "function" || s.lastWord == "async" || s.lastWord == "static"
+	case tokenPunct:
+		return strings.IndexByte("{,;}", s.lastByte) >= 0
+	}
+	return false
+}
+
+// template scans template literal text starting at src[start], just after
+// an opening backtick or the `}` closing an interpolation. The text up to
+// and including the closing backtick or the next `${` becomes one literal.
+// It returns the offset at which scanning should continue.
+func (s *scanner) template(start int) int {
+	src := s.src
+	from := start - 1
+	for i := start; i < len(src); i++ {
+		switch src[i] {
+		case '\\':
+			i++
+		case '`':
+			s.literal(from, i+1, tokenLiteral)
+			return i + 1
+		case '$':
+			if i+1 < len(src) && src[i+1] == '{' {
+				s.literal(from, i+2, tokenNone)
+				s.templates = append(s.templates, 0)
+				return i + 2
+			}
+		}
+	}
+	// Unterminated template: keep the rest of the input as it is
+	if s.check != nil {
+		s.check('`', from)
+	}
+	s.literal(from, len(src), tokenLiteral)
+	return len(src)
+}
+
+// comment handles comment c, followed by the source in rest
+func (s *scanner) comment(c, rest string) {
+	if !s.m.keepComment(c, rest) {
+		// The comment still separates the tokens around it, as in
+		// `static/**/async`, and one spanning lines ends a statement
+		// the way a line break does
+		if strings.ContainsAny(c, "\n\r") {
+			s.write("\n")
+		} else {
+			s.write(" ")
+		}
+		return
+	}
+	if strings.HasPrefix(c, "-->") {
+		// `-->` only starts a comment at the start of a line, which
+		// collapsing whitespace may join to the previous one
+		c = "//" + c
+	}
+	if isLineComment(c) {
+		// A kept line comment must stay terminated by a newline,
+		// otherwise the code that follows would become part of it
+		c += "\n"
+	}
+	s.placeholder(c)
+}
+
+// commentEnd is commentEnd for the source of the scanner. Once a block
+// comment is found to be unclosed, the `/*` after it are not searched for
+// a `*/` again, which on input full of them would take quadratic time.
+func (s *scanner) commentEnd(i int) int {
+	if s.unclosedComment && strings.HasPrefix(s.src[i:], "/*") {
+		return -1
+	}
+	end := commentEnd(s.src, i)
+	if end < 0 && strings.HasPrefix(s.src[i:], "/*") {
+		s.unclosedComment = true
+	}
+	return end
+}
+
+// memberName reports whether the word starting at offset start follows a
+// member access dot, but not a spread
+func memberName(src string, start int) bool {
+	p := start - 1
+	for p >= 0 && isSpace(src[p]) {
+		p--
+	}
+	return p >= 0 && src[p] == '.' && (p == 0 || src[p-1] != '.')
+}
+
+// atLineStart reports whether only spaces and tabs precede offset i on its
+// line of src
+func atLineStart(src string, i int) bool {
+	for i > 0 && (src[i-1] == ' ' || src[i-1] == '\t') {
+		i--
+	}
+	return i == 0 || src[i-1] == '\n' || src[i-1] == '\r'
+}
+
+// literal protects the source from start to end and records it as the last
+// token of the given kind
+func (s *scanner) literal(start, end int, kind int) {
+	s.placeholder(s.src[start:end])
+	s.token(kind, s.src[start:end], start)
+	s.last = kind
+}
+
+// token passes a significant token starting at offset to the tokens hook
+func (s *scanner) token(kind int, text string, offset int) {
+	if s.tokens != nil {
+		s.tokens(kind, text, offset)
+	}
+}
+
+// write emits text to the output
+func (s *scanner) write(text string) {
+	if !s.scanOnly {
+		s.out.WriteString(text)
+	}
+}
+
+// punct emits the punctuator byte at offset i
+func (s *scanner) punct(i int) {
+	c := s.src[i]
+	s.token(tokenPunct, s.src[i:i+1], i)
+	if !s.scanOnly {
+		s.out.WriteByte(c)
+	}
+	// A postfix ++ or -- ends an operand, so a following `/` divides
+	if (c == '+' || c == '-') && s.last == tokenPunct && s.lastByte == c && s.afterOperand {
+		s.last, s.lastWord = tokenWord, ""
+		return
+	}
+	s.afterOperand = s.endsOperand()
+	s.last, s.lastByte = tokenPunct, c
+}
+
+// endsOperand reports whether the last significant token ends an operand
+func (s *scanner) endsOperand() bool {
+	switch s.last {
+	case tokenWord:
+		return !regexPrecedingKeywords[s.lastWord]
+	case tokenLiteral:
+		return true
+	case tokenPunct:
+		return s.lastByte == ')' || s.lastByte == ']'
+	}
+	return false
+}
+
+// placeholder writes a placeholder for text and records it in the store
+func (s *scanner) placeholder(text string) {
+	if s.scanOnly {
+		return
+	}
+	*s.store = append(*s.store, text)
+	var buf [20]byte
+	s.out.WriteByte(placeholderMark)
+	s.out.Write(strconv.AppendInt(buf[:0], int64(len(*s.store)-1), 10))
+	s.out.WriteByte(placeholderMark)
+}
+
+// regexAllowed reports whether a `/` at the current position starts a
+// regular expression literal, based on the previous significant token
+func (s *scanner) regexAllowed() bool {
+	switch s.last {
+	case tokenNone:
+		return true
+	case tokenLiteral:
+		return false
+	case tokenWord:
+		return regexPrecedingKeywords[s.lastWord]
+	}
+	return !s.endsOperand()
+}
+
+// splitStatements splits code into chunks that each end with the `;` or
+// `}` closing a top-level statement, apart from the last chunk which holds
+// whatever follows. Brackets inside comments and literals are ignored.
+func splitStatements(code string) []string {
+	s := &scanner{m: &Minifier{}, src: code, scanOnly: true}
+	s.scan()
+
+	var chunks []string
+	start := 0
+	for _, end := range s.ends {
+		chunks = append(chunks, code[start:end])
+		start = end
+	}
+	if start < len(code) || len(chunks) == 0 {
+		chunks = append(chunks, code[start:])
+	}
+	return chunks
+}
+
+// findJSX returns the offset of the first JSX element or fragment in code,
+// such as `<App />` or `<>`, or -1 when there is none. The minifier does
+// not understand JSX: the text inside elements is not JavaScript and the
+// `<` and `>` around tags are not operators, so minifying it would break
+// the code.
+func findJSX(code string) int {
+	s := &scanner{m: &Minifier{}, src: code, scanOnly: true}
+	s.scan()
+	return s.jsx - 1
+}
+
+// restoreLiterals replaces the placeholders in code with the text recorded
+// in store in a single pass
+func restoreLiterals(code string, store []string) string {
+	if len(store) == 0 {
+		return code
+	}
+	var b strings.Builder
+	b.Grow(len(code))
+	for i := 0; i < len(code); {
+		open := strings.IndexByte(code[i:], placeholderMark)
+		if open < 0 {
+			b.WriteString(code[i:])
+			break
+		}
+		open += i
+		b.WriteString(code[i:open])
+		close := strings.IndexByte(code[open+1:], placeholderMark)
+		if close < 0 {
+			b.WriteString(code[open:])
+			break
+		}
+		close += open + 1
+		n, err := strconv.Atoi(code[open+1 : close])
+		if err != nil || n >= len(store) {
+			b.WriteString(code[open : close+1])
+		} else {
+			b.WriteString(store[n])
+		}
+		i = close + 1
+	}
+	return b.String()
+}
+
+// placeholderBefore returns the text recorded for the placeholder ending
+// just before code[end], or "" if there is none
+func placeholderBefore(code string, end int, store []string) string {
+	open := strings.LastIndexByte(code[:end-1], placeholderMark)
+	if open < 0 {
+		return ""
+	}
+	return placeholderText(code[open+1:end-1], store)
+}
+
+// placeholderAfter returns the text recorded for the placeholder starting
+// at code[start], or "" if there is none
+func placeholderAfter(code string, start int, store []string) string {
+	close := strings.IndexByte(code[start+1:], placeholderMark)
+	if close < 0 {
+		return ""
+	}
+	return placeholderText(code[start+1:start+1+close], store)
+}
+
+// placeholderText returns the stored text for placeholder number n
+func placeholderText(n string, store []string) string {
+	i, err := strconv.Atoi(n)
+	if err != nil || i >= len(store) {
+		return ""
+	}
+	return store[i]
+}
+
+// checkBalance reports where the brackets in code, ignoring those inside
+// comments and literals, are not properly nested and closed, or where a
+// string or template literal is not terminated. It returns nil when the
+// code is balanced.
+func checkBalance(code string) *MinifyError {
+	var open []int
+	var err *MinifyError
+	s := &scanner{m: &Minifier{}, src: code, scanOnly: true}
+	s.check = func(c byte, offset int) {
+		if err != nil {
+			return
+		}
+		switch c {
+		case '(', '[', '{':
+			open = append(open, offset)
+		case ')', ']', '}':
+			if len(open) == 0 || code[open[len(open)-1]] != matchingBracket[c] {
+				err = newMinifyError(code, offset, fmt.Sprintf("unexpected %q", c))
+				return
+			}
+			open = open[:len(open)-1]
+		default:
+			err = newMinifyError(code, offset, fmt.Sprintf("unterminated %c literal", c))
+		}
+	}
+	s.scan()
+
+	if err == nil && len(open) > 0 {
+		offset := open[len(open)-1]
+		err = newMinifyError(code, offset, fmt.Sprintf("unclosed %q", code[offset]))
+	}
+	return err
+}
+
+// matchingBracket maps each closing bracket to its opening bracket
+var matchingBracket = map[byte]byte{')': '(', ']': '[', '}': '{'}
+
+// commentEnd returns the end offset of the comment starting at code[start],
+// or -1 if no complete comment starts there
+func commentEnd(code string, start int) int {
+	if start+1 >= len(code) {
+		return -1
+	}
+	switch code[start+1] {
+	case '/':
+		if nl := strings.IndexByte(code[start:], '\n'); nl >= 0 {
+			return start + nl
+		}
+		return len(code)
+	case '*':
+		if close := strings.Index(code[start+2:], "*/"); close >= 0 {
+			return start + 2 + close + 2
+		}
+	}
+	return -1
+}
+
+// stringEnd returns the end offset of the string literal whose opening
+// quote is at code[start], or -1 if it is not terminated on its line.
+// Escaped characters are skipped, and so are escaped line breaks, which
+// continue the literal on the next line; a `\r\n` line break counts as one.
+func stringEnd(code string, start int) int {
+	quote := code[start]
+	for i := start + 1; i < len(code); i++ {
+		switch code[i] {
+		case '\\':
+			i++
+			if strings.HasPrefix(code[i:], "\r\n") {
+				i++
+			}
+		case '\n', '\r':
+			return -1
+		case quote:
+			return i + 1
+		}
+	}
+	return -1
+}
+
+// regexEnd returns the end offset, including flags, of the regular
+// expression literal starting at offset start of the source, or -1 if none
+// starts there. A `/` inside a character class does not end the literal.
+//
+// A scan that finds none is remembered. A later one from a `/` before the
+// line end it reached is in step with it as soon as both are outside a
+// character class, or both inside one, and so fails too; only the part of
+// a class the first scan passed through before that is scanned again.
+// Otherwise a line full of `/` would take quadratic time.
+func (s *scanner) regexEnd(start int) int {
+	code := s.src
+	end := len(code)
+	if start < s.regexFail {
+		classes := s.regexClasses
+		for len(classes) > 0 && classes[0][1] <= start {
+			classes = classes[1:]
+		}
+		s.regexClasses = classes
+		if len(classes) == 0 || classes[0][0] > start {
+			return -1
+		}
+		end = classes[0][1]
+	} else {
+		s.regexClasses = s.regexClasses[:0]
+	}
+
+	class := -1 // the offset of the `[` of the open class
+	for i := start + 1; i < end; i++ {
+		switch code[i] {
+		case '\\':
+			i++
+		case '\n':
+			end = i
+		case '[':
+			if start < s.regexFail {
+				return -1
+			}
+			if class < 0 {
+				class = i
+			}
+		case ']':
+			if class >= 0 {
+				s.regexClasses = append(s.regexClasses, [2]int{class, i})
+				class = -1
+			}
+		case '/':
+			if class >= 0 {
+				continue
+			}
+			i++
+			for i < len(code) && isWordByte(code[i]) {
+				i++
+			}
+			return i
+		}
+	}
+	if start >= s.regexFail {
+		if class >= 0 {
+			s.regexClasses = append(s.regexClasses, [2]int{class, end})
+		}
+		s.regexFail = end
+	}
+	return -1
+}
+
+// isWordByte reports whether c can be part of an identifier, keyword or
+// number
+func isWordByte(c byte) bool {
+	return c == '_' || c == '$' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= 0x80
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"path"
+	"time"
+)
+
+// serveName is the file name a minification request is reported under
+// when it does not give one
+const serveName = "request.js"
+
+// serveMaxBodySize is the size in bytes above which a minification request
+// is refused when -max-file-size does not set a limit, so that a single
+// request cannot tie up the server
+const serveMaxBodySize = 10 << 20
+
+// serveReadTimeout and serveWriteTimeout bound how long the server waits
+// for a request to arrive and for its response to be minified and sent
+const (
+	serveReadTimeout  = 30 * time.Second
+	serveWriteTimeout = time.Minute
+)
+
+// minifyHandler answers minification requests for -serve: the body of a
+// POST is minified with opts and the minified code is the body of the
+// response. The name query parameter gives the file name used in errors
+// and warnings, and a name ending in .html has the inline scripts of the
+// page minified. Source the minifier refuses, such as TypeScript, is
+// answered with 422 and the error, and a body over MaxFileSize, or
+// serveMaxBodySize without one, with 413.
+type minifyHandler struct {
+	opts Options
+}
+
+// ServeHTTP minifies the body of a POST request
+func (h *minifyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "POST the JavaScript to minify", http.StatusMethodNotAllowed)
+		return
+	}
+	name := serveName
+	if n := r.URL.Query().Get("name"); n != "" {
+		name = path.Base(n)
+	}
+
+	limit, setBy := h.opts.MaxFileSize, " set by -max-file-size"
+	if limit <= 0 {
+		limit, setBy = serveMaxBodySize, ""
+	}
+	content, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, limit))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, fmt.Sprintf("%s: %v: it exceeds the limit of %d bytes%s", name, errFileTooLarge, tooLarge.Limit, setBy), http.StatusRequestEntityTooLarge)
+		} else {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+		processMetrics.recordError()
+		return
+	}
+
+	minified, _, err := minifySource(name, content, h.opts)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		processMetrics.recordError()
+		return
+	}
+	processMetrics.record(MinificationStats{OriginalSize: len(content), MinifiedSize: len(minified)})
+	if isHTMLFile(name) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	} else {
+		w.Header().Set("Content-Type", "text/javascript; charset=utf-8")
+	}
+	w.Write([]byte(minified))
+}
+
+// startServer serves minification requests for opts and the processing
+// metrics on /metrics at addr in the background, like startMetricsServer
+func startServer(addr string, opts Options) (net.Listener, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/", &minifyHandler{opts: opts})
+	mux.Handle("/metrics", &processMetrics)
+	server := &http.Server{Handler: mux, ReadTimeout: serveReadTimeout, WriteTimeout: serveWriteTimeout}
+	go func() {
+		if err := server.Serve(ln); err != nil {
+			debugLog("Server stopped: %v", err)
+		}
+	}()
+	return ln, nil
+}
+
+// runServe handles -serve, serving minification requests at addr until the
+// process is stopped
+func runServe(addr string, opts Options, stop <-chan struct{}) int {
+	ln, err := startServer(addr, opts)
+	if err != nil {
+		debugLog("Error starting server: %v", err)
+		return 1
+	}
+	defer ln.Close()
+	debugLog("Serving minification on http://%s/", ln.Addr())
+	<-stop
+	return 0
+}
@@ -63,3 +63,12 @@ function createLogger(prefix) {
         }
     };
 }
+
+// Module pattern using an immediately-invoked function expression
+const counterModule = (function () {
+    const counter = createCounter(10);
+
+    return {
+        next: () => counter.increment()
+    };
+})();
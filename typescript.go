@@ -0,0 +1,117 @@
+package main
+
+// typeDeclarations maps the words that start TypeScript-only declarations,
+// such as `interface Props {` or `type ID = string`, to the tokens that
+// may follow the declared name. Followed by a name, none of them can start
+// a JavaScript statement.
+var typeDeclarations = map[string]map[string]bool{
+	"interface": {"{": true, "<": true, "extends": true},
+	"enum":      {"{": true},
+	"type":      {"=": true, "<": true},
+	"namespace": {"{": true, ".": true},
+}
+
+// typeModifiers maps the TypeScript-only words that start a statement to
+// the words that may follow them, as in `declare const` or `abstract class`
+var typeModifiers = map[string]map[string]bool{
+	"abstract": {"class": true},
+	"declare": {
+		"const": true, "let": true, "var": true, "function": true, "class": true,
+		"enum": true, "type": true, "interface": true, "namespace": true, "module": true,
+	},
+}
+
+// scannedToken is a token passed to the scanner's tokens hook
+type scannedToken struct {
+	kind   int
+	text   string
+	offset int
+}
+
+// typeScriptDetector looks for TypeScript-only syntax in the tokens of a
+// scan, keeping the last three tokens and the open brackets around them
+type typeScriptDetector struct {
+	recent   [3]scannedToken // oldest first
+	brackets []string
+	found    int // offset of the first TypeScript syntax, or -1
+}
+
+// findTypeScript returns the offset of the first piece of syntax in code
+// that only TypeScript accepts, or -1 when there is none. It spots type
+// declarations, annotations of variables and parameters, as in
+// `let n: number` and `(a: string, b?: number)`, and declare and abstract
+// forms, which are the ways a TypeScript file usually gives itself away
+// early on. The minifier would otherwise treat a type annotation as an
+// object key or a label and corrupt the file.
+func findTypeScript(code string) int {
+	d := &typeScriptDetector{found: -1}
+	s := &scanner{m: &Minifier{}, src: code, scanOnly: true}
+	s.tokens = d.token
+	s.scan()
+	return d.found
+}
+
+// token checks the token t against the ones before it
+func (d *typeScriptDetector) token(kind int, text string, offset int) {
+	if d.found >= 0 {
+		return
+	}
+	t := scannedToken{kind, text, offset}
+	before, prev, last := d.recent[0], d.recent[1], d.recent[2]
+
+	switch {
+	case t.is(":") && last.is("?"):
+		// An optional parameter or property, `b?: number`
+		d.found = last.offset
+	case t.is(":") && last.isName() && prev.kind == tokenWord && (prev.text == "let" || prev.text == "const" || prev.text == "var"):
+		// `let n: number`
+		d.found = t.offset
+	case t.is(":") && last.isName() && (prev.is("(") || prev.is(",")) && d.inParens():
+		// A parameter annotation, `(a: string, b: number)`; in a
+		// JavaScript argument or parameter list a name is followed by
+		// a comma, an operator or the closing parenthesis
+		d.found = t.offset
+	case prev.kind == tokenWord && last.isName() && typeDeclarations[prev.text][t.text] && before.startsStatement():
+		d.found = prev.offset
+	case last.kind == tokenWord && t.kind == tokenWord && typeModifiers[last.text][t.text] && prev.startsStatement():
+		d.found = last.offset
+	}
+
+	switch text {
+	case "(", "[", "{":
+		d.brackets = append(d.brackets, text)
+	case ")", "]", "}":
+		if len(d.brackets) > 0 {
+			d.brackets = d.brackets[:len(d.brackets)-1]
+		}
+	}
+	d.recent = [3]scannedToken{prev, last, t}
+}
+
+// inParens reports whether the innermost open bracket is a parenthesis
+func (d *typeScriptDetector) inParens() bool {
+	return len(d.brackets) > 0 && d.brackets[len(d.brackets)-1] == "("
+}
+
+// is reports whether t is the punctuator p
+func (t scannedToken) is(p string) bool {
+	return t.kind == tokenPunct && t.text == p
+}
+
+// isName reports whether t is an identifier
+func (t scannedToken) isName() bool {
+	return t.kind == tokenWord && !jsKeywords[t.text] && !isNumber(t.text)
+}
+
+// startsStatement reports whether a statement can start after t
+func (t scannedToken) startsStatement() bool {
+	switch t.kind {
+	case tokenNone:
+		return t.text == ""
+	case tokenWord:
+		return t.text == "export"
+	case tokenPunct:
+		return t.text == ";" || t.text == "{" || t.text == "}"
+	}
+	return false
+}
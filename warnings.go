@@ -0,0 +1,108 @@
+package main
+
+import "fmt"
+
+// evalMessage explains why variables were not shortened in code calling
+// eval directly
+const evalMessage = "direct eval can refer to any variable by name; variable names are not shortened"
+
+// Warning describes a transformation that Minify skipped because it could
+// not be done safely, at the position in the input that prevented it
+type Warning struct {
+	Line int // 1-based line number
+	Col  int // 1-based column, counted in bytes
+	Msg  string
+}
+
+// String formats the warning as line:col: message
+func (w Warning) String() string {
+	return fmt.Sprintf("%d:%d: %s", w.Line, w.Col, w.Msg)
+}
+
+// in returns the warning, made about the part of code starting at offset,
+// at its position in the whole of code
+func (w Warning) in(code string, offset int) Warning {
+	start := newMinifyError(code, offset, "")
+	if w.Line == 1 {
+		w.Col += start.Col - 1
+	}
+	w.Line += start.Line - 1
+	return w
+}
+
+// warn records a warning for offset in the input of the minifier
+func (m *Minifier) warn(offset int, msg string) {
+	err := newMinifyError(m.input, offset, msg)
+	m.warnings = append(m.warnings, Warning{Line: err.Line, Col: err.Col, Msg: msg})
+}
+
+// MinifyWithWarnings minifies the input like Minify and also returns the
+// warnings about the transformations that were skipped to keep the code
+// working, such as variable shortening in code that calls eval
+func (m *Minifier) MinifyWithWarnings() (string, []Warning) {
+	result := m.Minify()
+	return result, append([]Warning(nil), m.warnings...)
+}
+
+// withMessage explains why variables were not shortened with SafeMangle in
+// code containing a with statement
+const withMessage = "a with statement can turn any variable name into a property lookup; variable names are not shortened"
+
+// mangleHazards records what in a piece of code limits which variables can
+// be renamed without changing what the code does
+type mangleHazards struct {
+	// eval is the offset of the first direct call to eval, or -1 when
+	// there is none. The code evaluated that way sees the variables of the
+	// calling scope by name, so renaming any of them could break it. Calls
+	// through a property, as in window.eval(s), evaluate the code in the
+	// global scope and do not count.
+	eval int
+	// with is the offset of the first with statement, or -1. Inside it a
+	// name may refer to a property of an object rather than to the
+	// variable.
+	with int
+	// module reports whether the code has import or export declarations.
+	// The top-level declarations of a script without them are globals,
+	// which other scripts on the page can use.
+	module bool
+}
+
+// findMangleHazards scans code for what limits variable renaming
+func findMangleHazards(code string) mangleHazards {
+	found := mangleHazards{eval: -1, with: -1}
+	evalAt, withAt, importAt := -1, -1, false // candidates waiting for the next token
+	var before, last string                   // the texts of the two previous tokens
+	s := &scanner{m: &Minifier{}, src: code, scanOnly: true}
+	s.tokens = func(kind int, text string, offset int) {
+		call := kind == tokenPunct && text == "("
+		if call && evalAt >= 0 && found.eval < 0 {
+			found.eval = evalAt
+		}
+		if call && withAt >= 0 && found.with < 0 {
+			found.with = withAt
+		}
+		if importAt && !call && text != "." {
+			// Not a dynamic import() or import.meta
+			found.module = true
+		}
+		evalAt, withAt, importAt = -1, -1, false
+
+		if kind == tokenWord && last != "." {
+			switch text {
+			case "with":
+				withAt = offset
+			case "import":
+				importAt = true
+			case "export":
+				found.module = true
+			}
+		}
+		// A spread, as in f(...eval(s)), is still a direct call
+		if kind == tokenWord && text == "eval" && (last != "." || before == ".") {
+			evalAt = offset
+		}
+		before, last = last, text
+	}
+	s.scan()
+	return found
+}
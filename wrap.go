@@ -0,0 +1,55 @@
+package main
+
+import "strings"
+
+// wrapLines breaks the lines of collapsed code that would be longer than
+// width once the literals are restored. A line break goes after the last
+// `;`, `,`, `{` or `}` that fits on the line, where it can neither end a
+// statement early nor fall inside a token, apart from one before `++` or
+// `--`, which would then apply to the next operand instead. A line with no
+// such place to break stays longer than width. literals holds the text of
+// the placeholders in code.
+func wrapLines(code string, literals []string, width int) string {
+	out := make([]byte, 0, len(code)+len(code)/width)
+	col := 0      // width of the current line with literals restored
+	breakAt := -1 // offset in out of the last place to break the line
+	breakCol := 0 // col at breakAt
+	for i := 0; i < len(code); i++ {
+		c := code[i]
+		if c == placeholderMark {
+			end := i + 1 + strings.IndexByte(code[i+1:], placeholderMark)
+			text := placeholderText(code[i+1:end], literals)
+			out = append(out, code[i:end+1]...)
+			if nl := strings.LastIndexByte(text, '\n'); nl >= 0 {
+				// A template literal or kept comment spanning lines
+				col = len(text) - nl - 1
+				breakAt = -1
+			} else {
+				col += len(text)
+			}
+			i = end
+		} else if c == '\n' {
+			out = append(out, c)
+			col = 0
+			breakAt = -1
+			continue
+		} else {
+			out = append(out, c)
+			col++
+		}
+
+		if col > width && breakAt >= 0 {
+			out = append(out, 0)
+			copy(out[breakAt+1:], out[breakAt:])
+			out[breakAt] = '\n'
+			col -= breakCol
+			breakAt = -1
+		}
+		if strings.IndexByte(";,{}", c) >= 0 && i+1 < len(code) && code[i+1] != '\n' &&
+			!strings.HasPrefix(code[i+1:], "++") && !strings.HasPrefix(code[i+1:], "--") {
+			breakAt = len(out)
+			breakCol = col
+		}
+	}
+	return string(out)
+}